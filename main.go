@@ -2,7 +2,12 @@ package main
 
 import (
 	"flag"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"fortio.org/cli"
 	"fortio.org/gvi/vi"
@@ -14,37 +19,130 @@ func main() {
 	os.Exit(Main())
 }
 
+// commands is the list of -c ex commands.
+type commands []string
+
+func (c *commands) String() string {
+	return strings.Join(*c, ", ")
+}
+
+func (c *commands) Set(cmd string) error {
+	*c = append(*c, cmd)
+	return nil
+}
+
+// splitArgs separates the files from the +N, + or +/pattern start position (the last one wins)
+// and the -c commands given after the files (flag parsing stops at the first file).
+func splitArgs(args []string, cmds *commands) (files []string, startPos string) {
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case strings.HasPrefix(a, "+"):
+			startPos = a
+		case a == "-c" && i+1 < len(args):
+			i++
+			*cmds = append(*cmds, args[i])
+		default:
+			files = append(files, a)
+		}
+	}
+	return files, startPos
+}
+
 func Main() int {
 	debug := flag.Bool("debug", false, "Enable debug mode to show refresh counters")
+	recoverFlag := flag.Bool("r", false, "Recover the file from its swap file (after a crash)")
+	readOnly := flag.Bool("R", false, "Read-only mode: the files are opened read-only and need :w! to be written (same as invoking as view)")
+	binary := flag.Bool("b", false, "Binary mode: read and write the file as is (no line ending or BOM conversion)")
+	encoding := flag.String("enc", "",
+		"File `encoding` (utf-8, latin1, cp1252, utf-16le, utf-16be), default is utf-8 or utf-16 detected from BOM")
+	var cmds commands
+	flag.Var(&cmds, "c", "Ex `command` to run after opening the first file, can be repeated (e.g. -c 'set ff=dos')")
 	cli.MinArgs = 0
-	cli.MaxArgs = 1 // we can take n files later and implement :n
-	cli.ArgsHelp = "[filename]\t\tto edit a file, vi style"
+	cli.MaxArgs = -1
+	cli.ArgsHelp = "[+N|+|+/pattern] [filename...]\tto edit files, vi style (:n for the next one), - to read from stdin," +
+		" starting at line N, the last line or the first match of pattern"
 	cli.Main()
+	files, startPos := splitArgs(flag.Args(), &cmds)
+	fi, err := os.Stdin.Stat()
+	stdinIsTerm := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	// gvi - or piping to gvi (e.g. git log | gvi) reads the text from stdin.
+	readStdin := len(files) == 1 && files[0] == "-" || len(files) == 0 && !stdinIsTerm
+	var stdinData []byte
+	if readStdin {
+		if stdinData, err = io.ReadAll(os.Stdin); err != nil {
+			return log.FErrf("Error reading stdin: %v", err)
+		}
+	}
+	if !stdinIsTerm {
+		// Get the keys from the terminal.
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return log.FErrf("Failed to open the terminal: %v", err)
+		}
+		os.Stdin = tty
+	}
 	ap := ansipixels.NewAnsiPixels(20.)
-	err := ap.Open()
+	err = ap.Open()
 	if err != nil {
 		return log.FErrf("Failed to open terminal: %v", err)
 	}
 	defer ap.Restore()
-	vi := vi.NewVi(ap)
+	// Get focus events to check if the file was changed by another program.
+	ap.WriteString(vi.FocusReportingOn)
+	defer ap.WriteString(vi.FocusReportingOff)
+	vi := vi.NewVi(vi.NewAnsiScreen(ap))
 	vi.Debug = *debug
+	vi.SetBinary(*binary)
+	vi.SetReadOnly(*readOnly || filepath.Base(os.Args[0]) == "view")
+	if *encoding != "" {
+		if err = vi.SetEncoding(*encoding); err != nil {
+			return log.FErrf("Invalid -enc: %v", err)
+		}
+	}
 	// Enable grapheme clustering (cursor movement by only width of the grapheme cluster not codepoint/rune)
 	ap.WriteString("\033[?2027h")
-	ap.OnResize = vi.UpdateRS
+	ap.OnResize = func() error {
+		err := vi.UpdateRS()
+		ap.EndSyncMode()
+		return err
+	}
 	_ = ap.OnResize()
-	if flag.NArg() == 1 {
-		vi.Open(flag.Arg(0))
+	vi.SetStartPosition(startPos)
+	switch {
+	case readStdin:
+		vi.OpenStdin(stdinData)
+	case len(files) > 0:
+		vi.SetArgs(files)
+		vi.Open(files[0])
+		if *recoverFlag {
+			vi.RecoverSwap()
+		}
 	}
 	cont := true
+	for _, cmd := range cmds {
+		if cont {
+			cont = vi.RunCommand(cmd)
+		}
+	}
+	vi.Render()
+	ap.EndSyncMode()
+	// Don't die on terminal hangup: reading will fail and we can save the swap file.
+	signal.Ignore(syscall.SIGHUP)
+	var n int
 	for cont {
-		err = ap.ReadOrResizeOrSignal()
+		n, err = ap.ReadOrResizeOrSignalOnce()
 		if err != nil {
+			vi.FlushSwap() // keep what's possible for recovery.
 			return log.FErrf("Error reading terminal: %v", err)
 		}
-		if len(ap.Data) > 0 {
-			cont = vi.Process()
+		if n == 0 {
+			vi.Idle()
+			continue
 		}
+		cont = vi.Process(ap.Data)
+		ap.EndSyncMode() // flush the updates.
 	}
+	vi.Close()
 	ap.MoveCursor(0, ap.H-1)
 	return 0
 }
@@ -0,0 +1,210 @@
+package vi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var errNoWrite = errors.New("no write since last change (add ! to override, or :set hidden)")
+
+// splitCommand splits an ex command into its name, whether it is followed by ! and its argument,
+// e.g. "e! foo" is "e", true, "foo" and "e#" is "e", false, "#".
+func splitCommand(cmd string) (name string, force bool, arg string) {
+	i := 0
+	for i < len(cmd) && (cmd[i] >= 'a' && cmd[i] <= 'z' || cmd[i] >= 'A' && cmd[i] <= 'Z') {
+		i++
+	}
+	name, arg = cmd[:i], cmd[i:]
+	arg, force = strings.CutPrefix(arg, "!")
+	return name, force, strings.TrimSpace(arg)
+}
+
+// cutMkdirs removes the ++p option (create the missing parent directories) of :w and :wq,
+// returns the command without it and whether it was there.
+func cutMkdirs(cmd string) (string, bool) {
+	name, force, arg := splitCommand(cmd)
+	opt, rest, _ := strings.Cut(arg, " ")
+	if (name != "w" && name != "wq") || opt != "++p" {
+		return cmd, false
+	}
+	if force {
+		name += "!"
+	}
+	return strings.TrimSpace(name + " " + strings.TrimSpace(rest)), true
+}
+
+// SetStartPosition sets where to put the cursor in the first file opened, from the +N (line N),
+// + (last line) or +/pattern (first match of the regular expression, searched like vi from the
+// second line and wrapping around to the first) argument.
+func (v *Vi) SetStartPosition(arg string) {
+	v.startPos = arg
+}
+
+// applyStartPosition moves the cursor to the start position, if there is one (only once).
+func (v *Vi) applyStartPosition() error {
+	pos, ok := strings.CutPrefix(v.startPos, "+")
+	v.startPos = ""
+	if !ok {
+		return nil
+	}
+	line := v.buf.NumLines()
+	switch {
+	case pos == "":
+	case pos[0] == '/':
+		re, err := regexp.Compile(pos[1:])
+		if err != nil {
+			return err
+		}
+		l, idx := v.buf.Search(re, 1)
+		if l < 0 {
+			return fmt.Errorf("pattern not found: %s", pos[1:])
+		}
+		v.gotoLine(l + 1)
+		v.cx = v.lineCol(l, idx)
+		return nil
+	default:
+		n, err := strconv.Atoi(pos)
+		if err != nil {
+			return fmt.Errorf("invalid start position +%s", pos)
+		}
+		line = n
+	}
+	v.gotoLine(line)
+	return nil
+}
+
+// gotoLine moves the cursor to the start of line n (from 1, clamped to the buffer), centered
+// on the screen. Doesn't redraw.
+func (v *Vi) gotoLine(n int) {
+	v.cx = 0
+	v.offset, v.cy = v.calculateCenteredPosition(max(0, n-1), v.buf.NumLines())
+}
+
+// RunCommand runs an ex command (without the leading :), like -c on the command line.
+// Returns false if the editor should exit.
+func (v *Vi) RunCommand(cmd string) bool {
+	return v.command([]byte(cmd))
+}
+
+// SetArgs sets the argument list (files from the command line), the first one is to be opened with [Vi.Open].
+func (v *Vi) SetArgs(files []string) {
+	v.args = files
+	v.argIdx = 0
+}
+
+// ArgsString returns the argument list with the current file in brackets, like :args.
+func (v *Vi) ArgsString() string {
+	res := make([]string, 0, len(v.args))
+	for i, a := range v.args {
+		if i == v.argIdx && a == v.cur.filename {
+			a = "[" + a + "]"
+		}
+		res = append(res, a)
+	}
+	return strings.Join(res, " ")
+}
+
+// fileCommand handles the argument list and file switching commands, returns false if cmd isn't one of them.
+func (v *Vi) fileCommand(cmd string) bool {
+	name, force, arg := splitCommand(cmd)
+	switch name {
+	case "n", "next":
+		v.gotoArg(v.argIdx+1, force)
+	case "N", "prev", "previous":
+		v.gotoArg(v.argIdx-1, force)
+	case "rew", "rewind", "first":
+		v.gotoArg(0, force)
+	case "la", "last":
+		v.gotoArg(len(v.args)-1, force)
+	case "args":
+		v.CmdResult("%s", v.ArgsString())
+	case "e", "edit":
+		v.EditCommand(arg, force)
+	default:
+		return v.bufferCommand(name, force, arg) || v.windowExCommand(name, force, arg) || v.tabCommand(name, force, arg) ||
+			v.syntaxCommand(name, arg) || v.highlightCommand(name, arg) || v.colorschemeCommand(name, arg)
+	}
+	return true
+}
+
+func (v *Vi) gotoArg(idx int, force bool) {
+	switch {
+	case len(v.args) == 0:
+		v.ShowError("Error", errors.New("no file names in the argument list"))
+		return
+	case idx < 0:
+		v.ShowError("Error", errors.New("cannot go before first file"))
+		return
+	case idx >= len(v.args):
+		v.ShowError("Error", errors.New("cannot go beyond last file"))
+		return
+	}
+	if v.Edit(v.args[idx], force) {
+		v.argIdx = idx
+	}
+}
+
+// EditCommand implements :e[!] [++enc=name] [file]: without file it re-reads the current file,
+// # is the alternate (previously edited) file.
+func (v *Vi) EditCommand(arg string, force bool) {
+	enc := ""
+	if opt, rest, found := strings.Cut(arg+" ", " "); strings.HasPrefix(opt, "++") && found {
+		key, value, _ := strings.Cut(strings.TrimPrefix(opt, "++"), "=")
+		if key != "enc" && key != "encoding" {
+			v.ShowError("Error", fmt.Errorf("unsupported option %s", opt))
+			return
+		}
+		if _, err := FindEncoding(value); err != nil {
+			v.ShowError("Error", err)
+			return
+		}
+		enc, arg = value, strings.TrimSpace(rest)
+	}
+	if arg == "#" {
+		if v.alt == nil || v.alt.filename == "" {
+			v.ShowError("Error", errors.New("no alternate file name"))
+			return
+		}
+		arg = v.alt.filename
+	}
+	if arg != "" && arg != v.cur.filename {
+		v.EditEncoding(arg, force, enc)
+		return
+	}
+	// Same file: re-read it.
+	if v.buf.IsDirty() && !force {
+		v.ShowError("Error", errors.New("no write since last change (add ! to override)"))
+		return
+	}
+	if enc != "" {
+		_ = v.buf.SetEncoding(enc)
+	}
+	v.Reload()
+}
+
+// Edit switches to editing filename. It returns false (and shows an error) if the current buffer
+// has unsaved changes and neither force nor the hidden option are set.
+func (v *Vi) Edit(filename string, force bool) bool {
+	return v.EditEncoding(filename, force, "")
+}
+
+// EditEncoding is [Vi.Edit] reading the file with the given encoding (if not empty and the file isn't
+// already loaded).
+func (v *Vi) EditEncoding(filename string, force bool, enc string) bool {
+	if filename == v.cur.filename {
+		v.CmdResult("Already editing %s", filename)
+		return true
+	}
+	if !v.canAbandon(force) {
+		return false
+	}
+	e := v.findFile(filename)
+	if e == nil {
+		e = v.newBufEntry(filename)
+	}
+	v.switchTo(e, enc)
+	return true
+}
@@ -0,0 +1,95 @@
+package vi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		name  string
+		force bool
+		arg   string
+	}{
+		{"n", "n", false, ""},
+		{"n!", "n", true, ""},
+		{"e foo.txt", "e", false, "foo.txt"},
+		{"e! foo.txt", "e", true, "foo.txt"},
+		{"e#", "e", false, "#"},
+		{"e ++enc=latin1 f", "e", false, "++enc=latin1 f"},
+		{"N", "N", false, ""},
+	}
+	for _, test := range tests {
+		name, force, arg := splitCommand(test.cmd)
+		if name != test.name || force != test.force || arg != test.arg {
+			t.Errorf("splitCommand(%q) = %q, %v, %q; expected %q, %v, %q",
+				test.cmd, name, force, arg, test.name, test.force, test.arg)
+		}
+	}
+}
+
+func TestArgsString(t *testing.T) {
+	v := &Vi{cur: &bufEntry{}}
+	v.SetArgs([]string{"a", "b", "c"})
+	v.cur.filename = "a"
+	if s := v.ArgsString(); s != "[a] b c" {
+		t.Errorf("ArgsString() = %q", s)
+	}
+	v.argIdx = 1
+	v.cur.filename = "b"
+	if s := v.ArgsString(); s != "a [b] c" {
+		t.Errorf("ArgsString() = %q", s)
+	}
+	v.cur.filename = "other" // :e other keeps the index but isn't one of the arguments.
+	if s := v.ArgsString(); s != "a b c" {
+		t.Errorf("ArgsString() = %q", s)
+	}
+}
+
+func TestCutMkdirs(t *testing.T) {
+	tests := []struct {
+		cmd      string
+		expected string
+		mkdirs   bool
+	}{
+		{"w", "w", false},
+		{"w ++p", "w", true},
+		{"wq ++p", "wq", true},
+		{"w! ++p a/b.txt", "w! a/b.txt", true},
+		{"w a/b.txt", "w a/b.txt", false},
+		{"e ++p", "e ++p", false},
+	}
+	for _, test := range tests {
+		cmd, mkdirs := cutMkdirs(test.cmd)
+		if cmd != test.expected || mkdirs != test.mkdirs {
+			t.Errorf("cutMkdirs(%q) = %q, %v; expected %q, %v", test.cmd, cmd, mkdirs, test.expected, test.mkdirs)
+		}
+	}
+}
+
+func TestStartPosition(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(fname, []byte("foo 1\nbar\n  foo 3\nlast\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		arg    string
+		cx, cy int
+	}{
+		{"+", 0, 3},
+		{"+2", 0, 1},
+		{"+/foo", 2, 2}, // Like vi, the first line is checked last.
+		{"+/1", 4, 0},
+	}
+	for _, test := range tests {
+		v := NewVi(NewVTerm(40, 10))
+		v.SetStartPosition(test.arg)
+		v.Open(fname)
+		if v.cx != test.cx || v.BufferLineNumber() != test.cy {
+			t.Errorf("%s: cursor at %d,%d, expected %d,%d", test.arg, v.cx, v.BufferLineNumber(), test.cx, test.cy)
+		}
+		v.Close()
+	}
+}
@@ -4,9 +4,14 @@ package vi
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 // ScreenPositionCalculator provides screen position to byte offset translation.
@@ -20,14 +25,96 @@ type Line struct {
 }
 */
 
+// FileFormat is the end of line convention of a file.
+type FileFormat int
+
+const (
+	FormatUnix FileFormat = iota // \n
+	FormatDos                    // \r\n
+	FormatMac                    // \r
+)
+
+func (ff FileFormat) String() string {
+	switch ff {
+	case FormatUnix:
+		return "unix"
+	case FormatDos:
+		return "dos"
+	case FormatMac:
+		return "mac"
+	default:
+		return "unknown"
+	}
+}
+
+// EOL returns the line separator for the format.
+func (ff FileFormat) EOL() string {
+	switch ff {
+	case FormatDos:
+		return "\r\n"
+	case FormatMac:
+		return "\r"
+	default:
+		return "\n"
+	}
+}
+
+// ParseFileFormat returns the FileFormat for name (unix, dos or mac).
+func ParseFileFormat(name string) (FileFormat, error) {
+	for _, ff := range []FileFormat{FormatUnix, FormatDos, FormatMac} {
+		if ff.String() == name {
+			return ff, nil
+		}
+	}
+	return FormatUnix, fmt.Errorf("invalid fileformat %q (unix, dos or mac)", name)
+}
+
+// DetectFileFormat guesses the format of data: dos if every \n is preceded by \r,
+// mac if there are only \r, unix otherwise.
+func DetectFileFormat(data []byte) FileFormat {
+	lf := bytes.Count(data, []byte{'\n'})
+	if lf == 0 {
+		if bytes.IndexByte(data, '\r') >= 0 {
+			return FormatMac
+		}
+		return FormatUnix
+	}
+	if bytes.Count(data, []byte("\r\n")) == lf {
+		return FormatDos
+	}
+	return FormatUnix
+}
+
+const utf8BOM = "\xEF\xBB\xBF"
+
 // Buffer represents a full buffer (file) in the editor.
 // A view of it is shown in the terminal.
 type Buffer struct {
-	f     *os.File // File handle for the buffer
-	lines []string
-	dirty bool // True if the buffer has unsaved changes
+	f        *os.File    // File handle for the buffer
+	name     string      // File name
+	diskInfo os.FileInfo // File state on disk when last read or written, to detect external changes.
+	lines    rope        // The lines of the buffer.
+	dirty    bool        // True if the buffer has unsaved changes
+	swap     *swapFile   // Swap file journaling changes since last save, nil when not swapping.
+	format   FileFormat  // Line endings to use when saving ('fileformat').
+	noEOL    bool        // Last line has no line ending (inverse of 'eol', so the zero value is the default).
+	fixEOL   bool        // Always add the line ending to the last line when saving ('fixeol').
+	bom      bool        // File starts with a UTF-8 byte order mark ('bomb').
+	binary   bool        // Read and write the file as is ('binary'): unix format, no BOM nor fixeol.
+	enc      *Encoding   // File encoding ('fileencoding'), nil means utf-8.
+	encSet   bool        // Encoding explicitly set (++enc), no BOM sniffing.
+	version  int         // Incremented on every change of the lines, so views know when to redraw.
+	readOnly bool        // Don't write the file ('readonly'): -R, view or file not writable.
+	fileRO   bool        // f is opened read-only, reopened for writing when saving.
+	newFile  bool        // The file doesn't exist yet, it's created on the first save.
+	lang     *language   // Syntax of the file ('filetype'), nil for none.
+	// Lexer state at the start of each line, valid for the first synValid lines.
+	synStates []int
+	synValid  int
 }
 
+var errReadOnly = errors.New("file is read-only (add ! to override)")
+
 // OpenNewFile doesn't overwrite existing files, returns false if file already exists.
 func (b *Buffer) OpenNewFile(filename string, overwrite bool) error {
 	mode := os.O_CREATE | os.O_WRONLY
@@ -38,25 +125,83 @@ func (b *Buffer) OpenNewFile(filename string, overwrite bool) error {
 	if err != nil {
 		return err
 	}
+	if b.f != nil {
+		b.f.Close()
+	}
 	b.f = f
+	b.name = filename
+	b.readOnly, b.fileRO, b.newFile = false, false, false
+	b.recordDiskState()
+	b.dirty = true // The new file needs the content.
 	return nil
 }
 
-// Open initializes the buffer with the contents of the file.
+// Open initializes the buffer with the contents of the file. The file is opened read-only
+// if the buffer is, or if it isn't writable (and the buffer becomes read-only). A missing
+// file is a new file (empty buffer), only created when saved.
 func (b *Buffer) Open(filename string) error {
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0o644)
+	var f *os.File
+	var err error
+	if !b.readOnly {
+		f, err = os.OpenFile(filename, os.O_RDWR, 0)
+		b.readOnly = os.IsPermission(err)
+	}
+	if b.readOnly {
+		f, err = os.Open(filename)
+	}
+	b.name = filename
+	b.newFile = os.IsNotExist(err)
+	if b.newFile {
+		b.recordDiskState()
+		return b.load(nil)
+	}
 	if err != nil {
 		return err
 	}
-	b.f = f
-	// Split the file into lines
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		b.lines = append(b.lines, s.Text())
-	}
-	if err := s.Err(); err != nil {
+	b.f, b.fileRO = f, b.readOnly
+	data, err := io.ReadAll(f)
+	if err != nil {
 		return err
 	}
+	b.recordDiskState()
+	return b.load(data)
+}
+
+// load sets the buffer content from the raw file data, converting it to UTF-8,
+// detecting and removing the BOM and the line endings.
+func (b *Buffer) load(data []byte) error {
+	b.lines = rope{}
+	b.version++
+	defer b.detectSyntax()
+	if !b.binary {
+		if !b.encSet {
+			b.enc = SniffEncoding(data)
+		}
+		if b.enc != nil {
+			text, err := b.enc.Decode(data)
+			if err != nil {
+				return err
+			}
+			data = []byte(text)
+		}
+	}
+	b.bom = !b.binary && bytes.HasPrefix(data, []byte(utf8BOM))
+	if b.bom {
+		data = data[len(utf8BOM):]
+	}
+	b.format = FormatUnix
+	if !b.binary {
+		b.format = DetectFileFormat(data)
+	}
+	b.noEOL = false
+	if len(data) == 0 {
+		return nil
+	}
+	eol := []byte(b.format.EOL())
+	data, hasEOL := bytes.CutSuffix(data, eol)
+	b.noEOL = !hasEOL
+	// The data is all in memory, but its lines are only split into strings when accessed.
+	b.lines = newRopeFromData(data, eol)
 	return nil
 }
 
@@ -65,11 +210,7 @@ func (b *Buffer) GetLines(start, num int) []string {
 	if start < 0 {
 		start = 0
 	}
-	end := min(start+num, len(b.lines))
-	if start >= end {
-		return nil // No lines to return
-	}
-	return b.lines[start:end]
+	return b.lines.Slice(start, num)
 }
 
 func (b *Buffer) Close() error {
@@ -80,19 +221,58 @@ func (b *Buffer) Close() error {
 }
 
 func (b *Buffer) NumLines() int {
-	return len(b.lines)
+	return b.lines.Len()
 }
 
 func (b *Buffer) IsDirty() bool {
 	return b.dirty
 }
 
+// IsNew returns true if the file doesn't exist yet (it will be created when saved).
+func (b *Buffer) IsNew() bool {
+	return b.newFile
+}
+
 func (b *Buffer) InsertLine(lineNum int, text string) {
-	if lineNum < 0 || lineNum > len(b.lines) {
+	if lineNum < 0 || lineNum > b.lines.Len() {
+		return // Invalid line number
+	}
+	b.lines.Insert(lineNum, text)
+	b.invalidateSyntax(lineNum)
+	b.dirty = true
+	b.version++
+	b.journal(opInsert, lineNum, text)
+}
+
+// DeleteLine removes a line from the buffer.
+func (b *Buffer) DeleteLine(lineNum int) {
+	if lineNum < 0 || lineNum >= b.lines.Len() {
 		return // Invalid line number
 	}
-	b.lines = append(b.lines[:lineNum], append([]string{text}, b.lines[lineNum:]...)...)
+	b.lines.Delete(lineNum)
+	b.invalidateSyntax(lineNum)
 	b.dirty = true
+	b.version++
+	b.journal(opDelete, lineNum, "")
+}
+
+// setLine replaces an existing line and journals the change.
+func (b *Buffer) setLine(lineNum int, text string) {
+	b.lines.Set(lineNum, text)
+	b.invalidateSyntax(lineNum)
+	b.dirty = true
+	b.version++
+	b.journal(opReplace, lineNum, text)
+}
+
+// extendTo pads the buffer with empty lines so lineNum is a valid line.
+func (b *Buffer) extendTo(lineNum int) {
+	for n := b.lines.Len(); lineNum >= n; n++ {
+		b.lines.Insert(n, "")
+		b.invalidateSyntax(n)
+		b.version++
+		b.journal(opInsert, n, "")
+	}
 }
 
 // InsertChars returns the full line if insert is in the middle, empty if that was already at the end.
@@ -103,14 +283,21 @@ func (b *Buffer) InsertChars(calc ScreenPositionCalculator, lineNum, at int, tex
 	if lineNum < 0 {
 		panic("negative line number")
 	}
-	b.dirty = true
 	// Pad with empty lines if inserting past the end of the buffer
-	for lineNum >= len(b.lines) {
-		b.lines = append(b.lines, "")
-	}
-	line := b.lines[lineNum]
+	b.extendTo(lineNum)
+	line := b.lines.Get(lineNum)
+	return b.InsertAt(lineNum, calc.ScreenAtToRune(at, line), text) // Convert screen position to byte offset
+}
 
-	atOffset := calc.ScreenAtToRune(at, line) // Convert screen position to byte offset
+// InsertAt inserts text at the byte offset atOffset of a line, padding it with spaces if atOffset
+// is past its end. Returns the full line if insert is in the middle, like InsertChars.
+func (b *Buffer) InsertAt(lineNum, atOffset int, text string) string {
+	if lineNum < 0 {
+		panic("negative line number")
+	}
+	// Pad with empty lines if inserting past the end of the buffer
+	b.extendTo(lineNum)
+	line := b.lines.Get(lineNum)
 	returnLine := false
 	if atOffset > len(line) {
 		// We're inserting beyond the end of the line content, need padding
@@ -121,7 +308,7 @@ func (b *Buffer) InsertChars(calc ScreenPositionCalculator, lineNum, at int, tex
 		returnLine = true // We are inserting in the middle of the line
 	}
 	line = line[:atOffset] + text + line[atOffset:]
-	b.lines[lineNum] = line
+	b.setLine(lineNum, line)
 	if returnLine {
 		return line
 	}
@@ -134,37 +321,51 @@ func (b *Buffer) AppendToLine(lineNum int, text string) {
 	if lineNum < 0 {
 		panic("negative line number")
 	}
-	b.dirty = true
 	// Pad with empty lines if inserting past the end of the buffer
-	for lineNum >= len(b.lines) {
-		b.lines = append(b.lines, "")
-	}
-	b.lines[lineNum] += text
+	b.extendTo(lineNum)
+	b.setLine(lineNum, b.lines.Get(lineNum)+text)
 }
 
 // DeleteChar deletes a character at the specified screen position.
 func (b *Buffer) DeleteChar(calc ScreenPositionCalculator, lineNum, at int) {
-	if lineNum < 0 || lineNum >= len(b.lines) {
+	if lineNum < 0 || lineNum >= b.lines.Len() {
 		return
 	}
-	line := b.lines[lineNum]
+	line := b.lines.Get(lineNum)
 	if len(line) == 0 {
 		return
 	}
 
-	byteOffset := calc.ScreenAtToRune(at, line)
+	b.DeleteAt(lineNum, calc.ScreenAtToRune(at, line))
+}
+
+// DeleteAt deletes the rune (or the single invalid byte) at the byte offset byteOffset of a line.
+func (b *Buffer) DeleteAt(lineNum, byteOffset int) {
+	if lineNum < 0 || lineNum >= b.lines.Len() {
+		return
+	}
+	line := b.lines.Get(lineNum)
 	if byteOffset >= len(line) {
 		return
 	}
 
-	// Find next rune boundary
-	runes := []rune(line)
-	for i := range runes {
-		if len(string(runes[:i])) == byteOffset {
-			b.lines[lineNum] = string(runes[:i]) + string(runes[i+1:])
-			b.dirty = true
-			return
-		}
+	// Delete the rune (or the single invalid byte) at that offset.
+	_, size := utf8.DecodeRuneInString(line[byteOffset:])
+	b.setLine(lineNum, line[:byteOffset]+line[byteOffset+size:])
+}
+
+// lineInfo returns the cached screen layout of a line, nil if there is none (yet).
+func (b *Buffer) lineInfo(lineNum int) *lineInfo {
+	if lineNum < 0 || lineNum >= b.lines.Len() {
+		return nil
+	}
+	return b.lines.Info(lineNum)
+}
+
+// setLineInfo caches the screen layout of a line, until it changes.
+func (b *Buffer) setLineInfo(lineNum int, info *lineInfo) {
+	if lineNum >= 0 && lineNum < b.lines.Len() {
+		b.lines.SetInfo(lineNum, info)
 	}
 }
 
@@ -175,11 +376,8 @@ func (b *Buffer) ReplaceLine(lineNum int, newContent string) {
 		panic("negative line number")
 	}
 	// Extend buffer if necessary
-	for lineNum >= len(b.lines) {
-		b.lines = append(b.lines, "")
-	}
-	b.lines[lineNum] = newContent
-	b.dirty = true
+	b.extendTo(lineNum)
+	b.setLine(lineNum, newContent)
 }
 
 // GetLine returns the content of a single line.
@@ -189,34 +387,234 @@ func (b *Buffer) GetLine(lineNum int) string {
 	if lineNum < 0 {
 		panic("line number out of range")
 	}
-	if lineNum >= len(b.lines) {
+	if lineNum >= b.lines.Len() {
 		return "" // Return empty string if line number is out of range
 	}
-	return b.lines[lineNum]
+	return b.lines.Get(lineNum)
+}
+
+// Search returns the line number and byte offset of the first match of re, starting at line
+// from and wrapping around the end, or -1 if not found.
+func (b *Buffer) Search(re *regexp.Regexp, from int) (int, int) {
+	n := b.lines.Len()
+	for i := range n {
+		lineNum := (from + i) % n
+		if loc := re.FindStringIndex(b.lines.Get(lineNum)); loc != nil {
+			return lineNum, loc[0]
+		}
+	}
+	return -1, 0
 }
 
 func (b *Buffer) Save() error {
+	if b.readOnly {
+		return errReadOnly
+	}
+	if b.newFile {
+		f, err := os.OpenFile(b.name, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		b.f, b.newFile, b.dirty = f, false, true
+	}
 	if b.f == nil {
 		return errors.New("no file to save")
 	}
 	if !b.dirty {
 		return nil // No changes to save
 	}
+	if err := b.reopenIfReplaced(true); err != nil {
+		return err
+	}
+	var converted bytes.Buffer
+	if b.encoding() != UTF8 {
+		// Convert first so characters that can't be encoded are reported before touching the file.
+		if _, err := b.writeTo(&converted); err != nil {
+			return err
+		}
+	}
 	_, err := b.f.Seek(0, 0) // Reset file pointer to the beginning
 	if err != nil {
 		return err
 	}
+	w := bufio.NewWriter(b.f)
+	var written int64
+	if converted.Len() > 0 {
+		written, err = converted.WriteTo(w)
+	} else {
+		written, err = b.writeTo(w)
+	}
+	if err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err := b.f.Truncate(written); err != nil {
+		return err
+	}
+	b.dirty = false // Reset dirty flag after saving
+	b.recordDiskState()
+	// The file on disk now matches the buffer: restart the journal from there.
+	return b.resetSwap()
+}
+
+// writeTo writes the buffer content with the buffer's encoding, BOM and line endings settings.
+func (b *Buffer) writeTo(w io.Writer) (int64, error) {
 	var written int64
-	var n int
-	for _, line := range b.lines {
-		if n, err = b.f.WriteString(line + "\n"); err != nil {
+	enc := b.encoding()
+	var encoded []byte
+	write := func(s string) error {
+		var err error
+		encoded, err = enc.Encode(encoded[:0], s)
+		if err != nil {
 			return err
 		}
+		n, err := w.Write(encoded)
 		written += int64(n)
+		return err
 	}
-	if err := b.f.Truncate(written); err != nil {
+	if b.bom && !b.binary && enc.bom != "" {
+		if err := write(utf8BOM); err != nil {
+			return written, err
+		}
+	}
+	eol := b.format.EOL()
+	fixEOL := b.fixEOL
+	if b.binary {
+		eol = "\n"
+		fixEOL = false
+	}
+	lineNum := 0
+	for line := range b.lines.All() {
+		lineNum++
+		if err := write(line); err != nil {
+			return written, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if lineNum == b.lines.Len() && b.noEOL && !fixEOL {
+			break
+		}
+		if err := write(eol); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// FileFormat returns the line ending format used when saving.
+func (b *Buffer) FileFormat() FileFormat {
+	return b.format
+}
+
+// SetFileFormat changes the line endings used when saving.
+func (b *Buffer) SetFileFormat(ff FileFormat) {
+	if ff != b.format {
+		b.format = ff
+		b.dirty = true
+	}
+}
+
+// EOL returns true if the last line has a line ending.
+func (b *Buffer) EOL() bool {
+	return !b.noEOL
+}
+
+// SetEOL changes whether the last line gets a line ending when saving.
+func (b *Buffer) SetEOL(eol bool) {
+	if eol == b.noEOL {
+		b.noEOL = !eol
+		b.dirty = true
+	}
+}
+
+// FixEOL returns true if a line ending is always added to the last line when saving.
+func (b *Buffer) FixEOL() bool {
+	return b.fixEOL
+}
+
+// SetFixEOL changes whether a missing last line ending gets added when saving.
+func (b *Buffer) SetFixEOL(fix bool) {
+	b.fixEOL = fix
+}
+
+// BOM returns true if the file is saved with a UTF-8 byte order mark.
+func (b *Buffer) BOM() bool {
+	return b.bom
+}
+
+// SetBOM changes whether the file is saved with a UTF-8 byte order mark.
+func (b *Buffer) SetBOM(bom bool) {
+	if bom != b.bom {
+		b.bom = bom
+		b.dirty = true
+	}
+}
+
+// Binary returns true if the buffer is in binary mode.
+func (b *Buffer) Binary() bool {
+	return b.binary
+}
+
+// SetBinary changes binary mode, applies to the next Open and Save.
+func (b *Buffer) SetBinary(on bool) {
+	b.binary = on
+}
+
+// ReadOnly returns true if the buffer can't be saved (without !).
+func (b *Buffer) ReadOnly() bool {
+	return b.readOnly
+}
+
+// SetReadOnly changes read-only mode, set before Open to open the file read-only.
+func (b *Buffer) SetReadOnly(on bool) {
+	b.readOnly = on
+}
+
+// encoding returns the encoding used to convert the file, UTF8 in binary mode or by default.
+func (b *Buffer) encoding() *Encoding {
+	if b.enc == nil || b.binary {
+		return UTF8
+	}
+	return b.enc
+}
+
+// Encoding returns the name of the file encoding.
+func (b *Buffer) Encoding() string {
+	return b.encoding().Name
+}
+
+// SetEncoding sets the file encoding used to save the file and, if called before Open,
+// to read it (instead of detecting UTF-16 from its BOM).
+func (b *Buffer) SetEncoding(name string) error {
+	enc, err := FindEncoding(name)
+	if err != nil {
 		return err
 	}
-	b.dirty = false // Reset dirty flag after saving
+	if enc != b.encoding() {
+		b.dirty = b.dirty || b.f != nil
+	}
+	b.enc = enc
+	b.encSet = true
 	return nil
 }
+
+// FormatInfo returns the file format flags for the status line, e.g. "unix" or "dos,noeol,bom".
+func (b *Buffer) FormatInfo() string {
+	if b.binary {
+		if b.noEOL {
+			return "binary,noeol"
+		}
+		return "binary"
+	}
+	info := b.format.String()
+	if enc := b.encoding(); enc != UTF8 {
+		info = enc.Name + "," + info
+	}
+	if b.noEOL && !b.fixEOL {
+		info += ",noeol"
+	}
+	if b.bom {
+		info += ",bom"
+	}
+	return info
+}
@@ -1,11 +1,22 @@
 package vi
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
 )
 
+// allLines returns all the lines of the buffer.
+func allLines(b *Buffer) []string {
+	return b.GetLines(0, b.NumLines())
+}
+
 func TestInsertSingleRune(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.tabs = []int{4, 8, 12, 16, 20} // Set tab stops
 
 	// Test simple cases where each rune advances cursor by 1 (+ special case of tabs)
@@ -18,12 +29,12 @@ func TestInsertSingleRune(t *testing.T) {
 		"A乒乓BéC",
 		"😀🎉",
 		"😀🎉x",
-		"a\001b", // Control character (Ctrl-A) with width 0
+		"a\001b", // Control character (Ctrl-A) shown as ^A
 		"a\001bc",
 	}
 	for _, str := range simpleTests {
-		v.buf.lines = nil // Reset the buffer lines
-		v.cx = 0          // Reset cursor x position
+		v.buf.lines = rope{} // Reset the buffer lines
+		v.cx = 0             // Reset cursor x position
 		// Simulate inserting a string one by one
 		var line string
 		runes := []rune(str)
@@ -37,14 +48,14 @@ func TestInsertSingleRune(t *testing.T) {
 			case r == '\t':
 				v.cx = 4
 			case r < ' ':
-				// v.cx unchanged.
+				v.cx += 2 // Shown as ^A.
 			default:
 				v.cx += 2 // asian characters and smileys are double width
 			}
 			if line != "" {
 				t.Errorf("Expected empty line after inserting %q, got %q", string(r), line)
 			}
-			actual := v.buf.lines[0]
+			actual := v.buf.GetLine(0)
 			expected := string(runes[:i+1])
 			if actual != expected {
 				t.Errorf("Expected %q got %q", expected, actual)
@@ -54,11 +65,11 @@ func TestInsertSingleRune(t *testing.T) {
 }
 
 func TestInsertMultiRuneGraphemes(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 
 	// Test complex multi-rune graphemes with manual cursor control
 	// Test: "a👍🏽b" - thumbs up with skin tone modifier
-	v.buf.lines = nil
+	v.buf.lines = rope{}
 	v.cx = 0
 
 	// Insert 'a' at position 0
@@ -73,13 +84,13 @@ func TestInsertMultiRuneGraphemes(t *testing.T) {
 	v.buf.InsertChars(v, 0, v.cx, "b")
 
 	expected := "a👍🏽b"
-	actual := v.buf.lines[0]
+	actual := v.buf.GetLine(0)
 	if actual != expected {
 		t.Errorf("Multi-rune test 1: Expected %q got %q", expected, actual)
 	}
 
 	// Test: "x👩‍🚀y" - woman astronaut (complex multi-rune grapheme)
-	v.buf.lines = nil
+	v.buf.lines = rope{}
 	v.cx = 0
 
 	// Insert 'x' at position 0
@@ -98,7 +109,7 @@ func TestInsertMultiRuneGraphemes(t *testing.T) {
 	v.buf.InsertChars(v, 0, v.cx, "B")
 
 	expected = "x👩‍🚀BAy"
-	actual = v.buf.lines[0]
+	actual = v.buf.GetLine(0)
 	if actual != expected {
 		t.Errorf("Multi-rune test 2: Expected %q got %q", expected, actual)
 	}
@@ -110,14 +121,14 @@ func TestInsertMultiRuneGraphemes(t *testing.T) {
 	v.buf.InsertChars(v, 0, v.cx, "Z")
 
 	expected = "x👩‍🚀BAy    Z" // 4 spaces of padding between 'y' and 'Z'
-	actual = v.buf.lines[0]
+	actual = v.buf.GetLine(0)
 	if actual != expected {
 		t.Errorf("Past-end insert test: Expected %q got %q", expected, actual)
 	}
 }
 
 func TestDeleteChar(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.tabs = []int{4, 8, 12, 16, 20} // Set tab stops
 
 	tests := []struct {
@@ -167,14 +178,14 @@ func TestDeleteChar(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			// Setup buffer with initial content
-			v.buf.lines = []string{test.initialContent}
+			v.buf.lines = newRope([]string{test.initialContent})
 			v.buf.dirty = false // Reset dirty flag
 
 			// Delete character at specified position
 			v.buf.DeleteChar(v, 0, test.deleteAt)
 
 			// Check the buffer was updated
-			actual := v.buf.lines[0]
+			actual := v.buf.GetLine(0)
 			if actual != test.expected {
 				t.Errorf("Buffer line is %q, expected %q", actual, test.expected)
 			}
@@ -188,28 +199,277 @@ func TestDeleteChar(t *testing.T) {
 
 	// Test edge cases
 	t.Run("Delete from empty line", func(t *testing.T) {
-		v.buf.lines = []string{""}
+		v.buf.lines = newRope([]string{""})
 		v.buf.DeleteChar(v, 0, 0)
-		if v.buf.lines[0] != "" {
-			t.Errorf("Empty line should remain empty, got %q", v.buf.lines[0])
+		if v.buf.GetLine(0) != "" {
+			t.Errorf("Empty line should remain empty, got %q", v.buf.GetLine(0))
 		}
 	})
 
 	t.Run("Delete beyond line length", func(t *testing.T) {
-		v.buf.lines = []string{"abc"}
-		original := v.buf.lines[0]
+		v.buf.lines = newRope([]string{"abc"})
+		original := v.buf.GetLine(0)
 		v.buf.DeleteChar(v, 0, 10)
-		if v.buf.lines[0] != original {
+		if v.buf.GetLine(0) != original {
 			t.Errorf("Line should be unchanged when deleting beyond length")
 		}
 	})
 
 	t.Run("Delete from non-existent line", func(t *testing.T) {
-		v.buf.lines = []string{"abc"}
-		original := v.buf.lines[0]
+		v.buf.lines = newRope([]string{"abc"})
+		original := v.buf.GetLine(0)
 		v.buf.DeleteChar(v, 5, 0)
-		if v.buf.lines[0] != original {
+		if v.buf.GetLine(0) != original {
 			t.Errorf("Line should be unchanged when deleting from non-existent line")
 		}
 	})
 }
+
+func TestOpenSaveRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		lines   []string
+		info    string
+	}{
+		{"empty", "", nil, "unix"},
+		{"unix", "a\nb\n", []string{"a", "b"}, "unix"},
+		{"unix no eol", "a\nb", []string{"a", "b"}, "unix,noeol"},
+		{"dos", "a\r\nb\r\n", []string{"a", "b"}, "dos"},
+		{"dos no eol", "a\r\nb", []string{"a", "b"}, "dos,noeol"},
+		{"mac", "a\rb\r", []string{"a", "b"}, "mac"},
+		{"mixed stays unix", "a\r\nb\n", []string{"a\r", "b"}, "unix"},
+		{"bom", "\xEF\xBB\xBFa\n", []string{"a"}, "unix,bom"},
+		{"bom dos no eol", "\xEF\xBB\xBFa\r\n\r\nb", []string{"a", "", "b"}, "dos,noeol,bom"},
+		{"empty line", "\n", []string{""}, "unix"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "f.txt")
+			if err := os.WriteFile(fname, []byte(test.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var b Buffer
+			if err := b.Open(fname); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(allLines(&b), test.lines) {
+				t.Errorf("Lines %q, expected %q", allLines(&b), test.lines)
+			}
+			if info := b.FormatInfo(); info != test.info {
+				t.Errorf("FormatInfo %q, expected %q", info, test.info)
+			}
+			b.dirty = true // force the write
+			if err := b.Save(); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.content {
+				t.Errorf("Saved %q, expected unchanged %q", data, test.content)
+			}
+		})
+	}
+}
+
+func TestSaveChangedFormat(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "f.txt")
+	if err := os.WriteFile(fname, []byte("\xEF\xBB\xBFa\r\nb"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b Buffer
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	b.SetFileFormat(FormatUnix)
+	b.SetBOM(false)
+	b.SetFixEOL(true)
+	if !b.IsDirty() {
+		t.Error("Changing the format should make the buffer dirty")
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a\nb\n" {
+		t.Errorf("Saved %q, expected %q", data, "a\nb\n")
+	}
+}
+
+func TestLongLineAndInvalidBytes(t *testing.T) {
+	v := &Vi{buf: &Buffer{}}
+	long := strings.Repeat("x", 200_000)
+	content := long + "\na\xff\xfeb\n\x00\x01\r\n"
+	fname := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(fname, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b Buffer
+	b.SetBinary(true)
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	if b.NumLines() != 3 || b.GetLine(0) != long || b.GetLine(2) != "\x00\x01\r" {
+		t.Fatalf("Unexpected lines %d %q", b.NumLines(), b.GetLines(1, 2))
+	}
+	if w := v.ScreenWidth(b.GetLine(1)); w != 10 {
+		t.Errorf("Screen width of invalid bytes line %d, expected 10", w)
+	}
+	// Delete the 'b' after the 2 invalid bytes shown as <ff><fe>.
+	b.DeleteChar(v, 1, 9)
+	if b.GetLine(1) != "a\xff\xfe" {
+		t.Errorf("After delete got %q", b.GetLine(1))
+	}
+	b.InsertChars(v, 1, 9, "c")
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != long+"\na\xff\xfec\n\x00\x01\r\n" {
+		t.Errorf("Binary content not preserved: %q", data[len(long):])
+	}
+}
+
+func TestDisplayString(t *testing.T) {
+	v := &Vi{buf: &Buffer{}}
+	v.tabs = []int{4, 8, 12, 16, 20}
+	tests := []struct {
+		input    string
+		width    int
+		expected string
+	}{
+		{"hello", 80, "hello"},
+		{"hello", 3, "hel"},
+		{"a\tb", 80, "a   b"},
+		{"a\xffb", 80, "a<ff>b"},
+		{"a\xffb", 4, "a"},
+		{"乒乓", 3, "乒"},
+		{"x😀", 80, "x😀"},
+	}
+	for _, test := range tests {
+		if res := v.DisplayString(test.input, test.width); res != test.expected {
+			t.Errorf("DisplayString(%q, %d) = %q, expected %q", test.input, test.width, res, test.expected)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.txt")
+	var b Buffer
+	b.SetReadOnly(true)
+	if err := b.Open(missing); err != nil || !b.IsNew() {
+		t.Errorf("Open(missing) read-only = %v, new %v, expected a new file", err, b.IsNew())
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Viewing a missing file should not create it: %v", err)
+	}
+	fname := filepath.Join(dir, "f.txt")
+	if err := os.WriteFile(fname, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b = Buffer{}
+	b.SetReadOnly(true)
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	b.ReplaceLine(0, "new")
+	if err := b.Save(); !errors.Is(err, errReadOnly) {
+		t.Errorf("Save() read-only = %v, expected %v", err, errReadOnly)
+	}
+	b.SetReadOnly(false) // :w!
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil || string(data) != "new\n" {
+		t.Errorf("Saved %q %v, expected %q", data, err, "new\n")
+	}
+}
+
+func TestWriteQuitReadOnly(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "ro.txt")
+	if err := os.WriteFile(fname, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	v := NewVi(NewVTerm(40, 10))
+	v.SetReadOnly(true) // -R
+	v.Open(fname)
+	if !v.Process([]byte("x:wq\r")) {
+		t.Error(":wq on a read-only buffer should not exit")
+	}
+	if data, _ := os.ReadFile(fname); string(data) != "old\n" {
+		t.Errorf(":wq wrote %q to a read-only buffer's file", data)
+	}
+	if v.Process([]byte(":wq!\r")) {
+		t.Error(":wq! should write and exit")
+	}
+	if data, _ := os.ReadFile(fname); string(data) != "ld\n" {
+		t.Errorf(":wq! wrote %q, expected %q", data, "ld\n")
+	}
+	v.Close()
+}
+
+func TestNewFile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "new.txt")
+	var b Buffer
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	if !b.IsNew() || b.IsDirty() || b.NumLines() != 0 {
+		t.Errorf("Open(missing): new %v, dirty %v, %d lines; expected a new empty buffer", b.IsNew(), b.IsDirty(), b.NumLines())
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Fatalf("Opening a missing file should not create it: %v", err)
+	}
+	if b.ChangedOnDisk() {
+		t.Error("New file should not be changed on disk")
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fname); err != nil || fi.Size() != 0 || b.IsNew() {
+		t.Errorf("Save of the new file: %v, new %v; expected an empty file", err, b.IsNew())
+	}
+	b.InsertLine(0, "hello")
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("Saved %q %v, expected %q", data, err, "hello\n")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	var b Buffer
+	if err := b.load([]byte("alpha\nbeta\ngamma beta\n")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pattern string
+		from    int
+		line    int
+		idx     int
+	}{
+		{"beta", 0, 1, 0},
+		{"beta", 2, 2, 6},
+		{"^al", 1, 0, 0}, // wraps around
+		{"a$", 0, 0, 4},
+		{"delta", 0, -1, 0},
+	}
+	for _, test := range tests {
+		line, idx := b.Search(regexp.MustCompile(test.pattern), test.from)
+		if line != test.line || idx != test.idx {
+			t.Errorf("Search(%q, %d) = %d, %d; expected %d, %d", test.pattern, test.from, line, idx, test.line, test.idx)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package vi
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// bufEntry is a buffer of the buffer list (:ls), with the cursor position to restore
+// when switching back to it.
+type bufEntry struct {
+	buf      *Buffer // nil when not loaded (abandoned without changes, or :bd).
+	num      int     // Buffer number, for :b N.
+	filename string  // Empty for a new buffer without a name.
+	listed   bool    // False after :bd.
+	line     int     // Last cursor line,
+	cx       int     // column
+	offset   int     // and scroll offset.
+	noSwap   bool    // Swap file not started (read-only or new file in a missing directory) until saved.
+}
+
+func (e *bufEntry) name() string {
+	if e.filename == "" {
+		return "[No Name]"
+	}
+	return e.filename
+}
+
+func (v *Vi) newBufEntry(filename string) *bufEntry {
+	v.lastBufNum++
+	e := &bufEntry{num: v.lastBufNum, filename: filename, listed: true}
+	v.bufs = append(v.bufs, e)
+	return e
+}
+
+// newBuffer returns an empty buffer with the binary and encoding settings from the command line,
+// or enc if not empty.
+func (v *Vi) newBuffer(enc string) *Buffer {
+	b := &Buffer{}
+	b.SetBinary(v.binary)
+	b.SetReadOnly(v.readOnly)
+	if enc == "" {
+		enc = v.encoding
+	}
+	if enc != "" {
+		_ = b.SetEncoding(enc) // already validated.
+	}
+	return b
+}
+
+func (v *Vi) findFile(filename string) *bufEntry {
+	for _, e := range v.bufs {
+		if e.filename == filename {
+			return e
+		}
+	}
+	return nil
+}
+
+// findBuffer finds a buffer by number, # for the alternate buffer, or unique partial file name.
+func (v *Vi) findBuffer(arg string) (*bufEntry, error) {
+	if arg == "#" {
+		if v.alt == nil {
+			return nil, errors.New("no alternate buffer")
+		}
+		return v.alt, nil
+	}
+	if num, err := strconv.Atoi(arg); err == nil {
+		for _, e := range v.bufs {
+			if e.num == num {
+				return e, nil
+			}
+		}
+		return nil, fmt.Errorf("buffer %d does not exist", num)
+	}
+	var found *bufEntry
+	for _, e := range v.bufs {
+		if !e.listed || !strings.Contains(e.filename, arg) {
+			continue
+		}
+		if e.filename == arg {
+			return e, nil
+		}
+		if found != nil {
+			return nil, fmt.Errorf("more than one match for %s", arg)
+		}
+		found = e
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no matching buffer for %s", arg)
+	}
+	return found, nil
+}
+
+// nextListed returns the listed buffer delta positions away from e in the list, wrapping around.
+func (v *Vi) nextListed(e *bufEntry, delta int) *bufEntry {
+	idx := 0
+	for i, b := range v.bufs {
+		if b == e {
+			idx = i
+		}
+	}
+	n := len(v.bufs)
+	for i := 1; i <= n; i++ {
+		b := v.bufs[((idx+delta*i)%n+n)%n]
+		if b.listed && b != e {
+			return b
+		}
+	}
+	return e
+}
+
+// canAbandon checks that the current buffer can be left: it has no unsaved changes,
+// is shown in another window, or force (discard the changes) or the hidden option
+// (keep them loaded) is set.
+func (v *Vi) canAbandon(force bool) bool {
+	if v.buf.IsDirty() && !force && !v.hidden && v.shown(v.cur, v.win) == 0 {
+		v.ShowError("Error", errNoWrite)
+		return false
+	}
+	return true
+}
+
+// switchTo makes e the current buffer, after checking with canAbandon that the current one can be left.
+func (v *Vi) switchTo(e *bufEntry, enc string) {
+	old := v.cur
+	old.line, old.cx, old.offset = v.BufferLineNumber(), v.cx, v.offset
+	v.enter(e, enc)
+	switch {
+	case v.shown(old, nil) > 0:
+		// Still displayed in another window.
+	case old.buf.IsDirty() && v.hidden:
+		// Keep it loaded (hidden), with its swap file.
+	case old.filename == "" && !old.buf.IsDirty() && old.buf.NumLines() == 0:
+		v.wipe(old) // Nothing to come back to.
+	case old.filename == "":
+		// Keep it loaded (hidden), there is no file to read it back from (e.g. read from stdin).
+	default:
+		v.unload(old)
+	}
+	if old.listed && slices.Contains(v.bufs, old) {
+		v.alt = old
+	}
+}
+
+// enter makes e the current buffer, loading it if needed, and restores its cursor position.
+func (v *Vi) enter(e *bufEntry, enc string) {
+	v.cur = e
+	v.win.e = e
+	e.listed = true
+	v.cmdMode = NavMode
+	if e.buf == nil {
+		e.buf = v.newBuffer(enc)
+		v.buf = e.buf
+		if e.filename == "" {
+			v.restoreCursor()
+			v.Update()
+			return
+		}
+		v.Open(e.filename)
+		v.keepMessage = true
+		v.UpdateStatus()
+		return
+	}
+	v.buf = e.buf
+	v.restoreCursor()
+	v.Update()
+	if v.buf.IsDirty() {
+		v.CmdResult("Editing %s (modified)", e.name())
+	}
+}
+
+// restoreCursor sets the cursor and scroll position to the ones saved for the current buffer.
+func (v *Vi) restoreCursor() {
+	e := v.cur
+	line := min(e.line, max(0, v.buf.NumLines()-1))
+	v.cx = e.cx
+	v.offset, v.cy = e.offset, line-e.offset
+	if v.cy < 0 || v.cy >= v.usableHeight {
+		v.offset, v.cy = v.calculateCenteredPosition(line, v.buf.NumLines())
+	}
+}
+
+// unload closes the buffer's file and removes its swap file, discarding unsaved changes.
+func (v *Vi) unload(e *bufEntry) {
+	if e.buf == nil {
+		return
+	}
+	if err := e.buf.RemoveSwap(); err != nil {
+		log.Errf("Error removing swap file: %v", err)
+	}
+	_ = e.buf.Close()
+	e.buf = nil
+}
+
+// wipe unloads e and removes it from the buffer list.
+func (v *Vi) wipe(e *bufEntry) {
+	v.unload(e)
+	for i, b := range v.bufs {
+		if b == e {
+			v.bufs = append(v.bufs[:i], v.bufs[i+1:]...)
+			break
+		}
+	}
+	if v.alt == e {
+		v.alt = nil
+	}
+}
+
+// dirtyBuffer returns a buffer, other than the current one, with unsaved changes, if any.
+func (v *Vi) dirtyBuffer() *bufEntry {
+	for _, e := range v.bufs {
+		if e != v.cur && e.buf != nil && e.buf.IsDirty() {
+			return e
+		}
+	}
+	return nil
+}
+
+// BufferList returns the lines of :ls, like vim's: number, flags (u unlisted, % current,
+// # alternate, a active, h hidden, + modified), name and line.
+func (v *Vi) BufferList(all bool) []string {
+	var res []string
+	for _, e := range v.bufs {
+		if !e.listed && !all {
+			continue
+		}
+		flags := []byte("     ")
+		if !e.listed {
+			flags[0] = 'u'
+		}
+		line := e.line
+		switch e {
+		case v.cur:
+			flags[1] = '%'
+			line = v.BufferLineNumber()
+		case v.alt:
+			flags[1] = '#'
+		}
+		switch {
+		case e == v.cur:
+			flags[2] = 'a'
+		case e.buf != nil:
+			flags[2] = 'h'
+		}
+		if e.buf != nil && e.buf.IsDirty() {
+			flags[4] = '+'
+		}
+		res = append(res, fmt.Sprintf("%3d%s %-30q line %d", e.num, flags, e.name(), line+1))
+	}
+	return res
+}
+
+// bufferCommand handles the buffer list commands, returns false if cmd isn't one of them.
+func (v *Vi) bufferCommand(name string, force bool, arg string) bool {
+	switch name {
+	case "ls", "buffers", "files":
+		v.ShowLines(v.BufferList(force))
+	case "b", "bu", "buf", "buffer":
+		if arg == "" {
+			v.CmdResult("Buffer %d: %s", v.cur.num, v.cur.name())
+			break
+		}
+		e, err := v.findBuffer(arg)
+		if err != nil {
+			v.ShowError("Error", err)
+			break
+		}
+		v.gotoBuffer(e, force)
+	case "bn", "bnext":
+		v.gotoBuffer(v.nextListed(v.cur, 1), force)
+	case "bp", "bprevious", "bN", "bNext":
+		v.gotoBuffer(v.nextListed(v.cur, -1), force)
+	case "bd", "bdelete", "bw", "bwipeout":
+		e := v.cur
+		if arg != "" {
+			var err error
+			if e, err = v.findBuffer(arg); err != nil {
+				v.ShowError("Error", err)
+				break
+			}
+		}
+		v.DeleteBuffer(e, force, name == "bw" || name == "bwipeout")
+	default:
+		return false
+	}
+	return true
+}
+
+func (v *Vi) gotoBuffer(e *bufEntry, force bool) {
+	if e == v.cur {
+		v.CmdResult("Already in buffer %d: %s", e.num, e.name())
+		return
+	}
+	if v.canAbandon(force) {
+		v.switchTo(e, "")
+	}
+}
+
+// DeleteBuffer implements :bd (unload and remove from the list, the cursor position is
+// remembered for when the file is edited again) and :bw (wipe, forget it completely).
+func (v *Vi) DeleteBuffer(e *bufEntry, force, wipe bool) {
+	if e.buf != nil && e.buf.IsDirty() && !force {
+		v.ShowError("Error", fmt.Errorf("no write since last change for buffer %d (add ! to override)", e.num))
+		return
+	}
+	closed := v.closeTabWindows(e)
+	for _, w := range v.windows() {
+		if w.e == e && w != v.win {
+			v.tab.removeWindow(w)
+			closed = true
+		}
+	}
+	if closed {
+		v.arrange()
+	}
+	var next *bufEntry
+	if e == v.cur {
+		e.line, e.cx, e.offset = v.BufferLineNumber(), v.cx, v.offset
+		next = v.alt
+		if next == nil || next == e || !next.listed {
+			next = v.nextListed(e, 1)
+		}
+	}
+	v.unload(e)
+	e.listed = false
+	if wipe {
+		v.wipe(e)
+	}
+	if next == nil {
+		if closed {
+			v.Update()
+		}
+		v.CmdResult("Deleted buffer %d: %s", e.num, e.name())
+		return
+	}
+	if next == e {
+		next = v.newBufEntry("")
+	}
+	if v.alt == next {
+		v.alt = nil
+	}
+	v.enter(next, "")
+}
@@ -0,0 +1,80 @@
+package vi
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBufferList(t *testing.T) {
+	v := &Vi{}
+	a := v.newBufEntry("dir/a.txt")
+	b := v.newBufEntry("b.txt")
+	ab := v.newBufEntry("ab.txt")
+	a.buf, b.buf = &Buffer{}, &Buffer{}
+	b.buf.dirty = true
+	b.line = 41
+	v.cur, v.buf, v.alt = a, a.buf, b
+	v.cy = 2
+	tests := []struct {
+		arg      string
+		expected *bufEntry
+		err      string
+	}{
+		{"1", a, ""},
+		{"3", ab, ""},
+		{"4", nil, "buffer 4 does not exist"},
+		{"#", b, ""},
+		{"b.txt", b, ""},
+		{"ab", ab, ""},
+		{"a", nil, "more than one match for a"},
+		{"z", nil, "no matching buffer for z"},
+	}
+	for _, test := range tests {
+		e, err := v.findBuffer(test.arg)
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		if e != test.expected || errStr != test.err {
+			t.Errorf("findBuffer(%q) = %v, %q; expected %v, %q", test.arg, e, errStr, test.expected, test.err)
+		}
+	}
+	if n := v.nextListed(a, 1); n != b {
+		t.Errorf("next of a should be b, got %v", n)
+	}
+	if n := v.nextListed(a, -1); n != ab {
+		t.Errorf("previous of a should wrap to ab, got %v", n)
+	}
+	ab.listed = false
+	if n := v.nextListed(b, 1); n != a {
+		t.Errorf("next of b should skip unlisted and wrap to a, got %v", n)
+	}
+	expected := []string{
+		`  1 %a   "dir/a.txt"                    line 3`,
+		`  2 #h + "b.txt"                        line 42`,
+	}
+	if l := v.BufferList(false); !slices.Equal(l, expected) {
+		t.Errorf("BufferList:\n%q\nexpected\n%q", l, expected)
+	}
+	expected = append(expected, `  3u     "ab.txt"                       line 1`)
+	if l := v.BufferList(true); !slices.Equal(l, expected) {
+		t.Errorf("BufferList(all):\n%q\nexpected\n%q", l, expected)
+	}
+	if e := v.dirtyBuffer(); e != b {
+		t.Errorf("dirtyBuffer() = %v, expected b", e)
+	}
+}
+
+func TestReleaseNoName(t *testing.T) {
+	v := &Vi{}
+	empty, stdin := v.newBufEntry(""), v.newBufEntry("")
+	empty.buf, stdin.buf = &Buffer{}, &Buffer{}
+	if err := stdin.buf.load([]byte("read\nfrom stdin\n")); err != nil {
+		t.Fatal(err)
+	}
+	v.release(empty)
+	v.release(stdin)
+	if !slices.Equal(v.bufs, []*bufEntry{stdin}) || stdin.buf == nil {
+		t.Errorf("the empty buffer should be wiped and the one read from stdin kept loaded: %v", v.bufs)
+	}
+}
@@ -0,0 +1,476 @@
+package vi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"fortio.org/terminal/ansipixels/tcolor"
+	"github.com/rivo/uniseg"
+)
+
+// historySize is the number of lines remembered by the : and / histories.
+const historySize = 100
+
+// exCommands are the command names completed with Tab: the full names of what command and
+// fileCommand handle.
+var exCommands = []string{
+	"args", "bdelete", "bnext", "bprevious", "buffer", "buffers", "bwipeout", "checktime", "close",
+	"colorscheme", "edit", "files", "first", "highlight", "last", "ls", "new", "next", "only",
+	"previous", "q", "recover", "rewind", "set", "split", "syntax", "tabclose", "tabedit", "tabnew",
+	"tabnext", "tabonly", "tabprevious", "tabs", "vnew", "vsplit", "w", "wq",
+}
+
+// cmdLine is the line edited in CommandMode, after : (ex command) or / (search).
+type cmdLine struct {
+	prompt byte
+	text   string
+	pos    int // Byte offset of the cursor in text.
+	// History navigation: index of the entry shown (len of the history when none) and the text
+	// typed before, which the entries shown start with (Up/Down).
+	histIdx    int
+	typed      string
+	navigating bool
+	// Tab completion: the candidates for the word at start, the one shown (-1 for the word typed).
+	matches []string
+	match   int
+	start   int
+	word    string
+}
+
+// startCmdLine switches to CommandMode to edit a new line after prompt (: or /).
+func (v *Vi) startCmdLine(prompt byte) {
+	v.cmdMode = CommandMode
+	v.cmdline = cmdLine{prompt: prompt}
+}
+
+// history returns the history of the command line being edited.
+func (v *Vi) history() *[]string {
+	if v.cmdline.prompt == '/' {
+		return &v.searchHistory
+	}
+	return &v.cmdHistory
+}
+
+// addHistory adds line at the end of hist, removing the older copy.
+func addHistory(hist []string, line string) []string {
+	if line == "" {
+		return hist
+	}
+	hist = slices.DeleteFunc(hist, func(h string) bool { return h == line })
+	hist = append(hist, line)
+	return hist[max(0, len(hist)-historySize):]
+}
+
+// nextKey returns the length of the key at the start of input: an escape sequence, a UTF-8
+// character or a byte. 0 when incomplete: the rest is yet to be read.
+func nextKey(input []byte) int {
+	switch {
+	case input[0] == 0x1b && len(input) == 1:
+		return 1 // Escape alone.
+	case input[0] == 0x1b && input[1] == '[':
+		for i := 2; i < len(input); i++ {
+			if input[i] >= 0x40 && input[i] <= 0x7e {
+				return i + 1
+			}
+		}
+		return 0
+	case input[0] == 0x1b && input[1] == 'O':
+		if len(input) < 3 {
+			return 0
+		}
+		return 3
+	case input[0] < utf8.RuneSelf:
+		return 1
+	case !utf8.FullRune(input):
+		return 0
+	}
+	_, n := utf8.DecodeRune(input)
+	return n
+}
+
+// prevCluster returns the start of the grapheme cluster before the byte offset pos of s.
+func prevCluster(s string, pos int) int {
+	start, state := 0, -1
+	for offset := 0; offset < pos; {
+		cluster, _, _, newState := uniseg.FirstGraphemeClusterInString(s[offset:pos], state)
+		start, state = offset, newState
+		offset += len(cluster)
+	}
+	return start
+}
+
+// nextCluster returns the end of the grapheme cluster at the byte offset pos of s.
+func nextCluster(s string, pos int) int {
+	if pos >= len(s) {
+		return len(s)
+	}
+	cluster, _, _, _ := uniseg.FirstGraphemeClusterInString(s[pos:], -1)
+	return pos + len(cluster)
+}
+
+// isWordChar returns true for the characters of words, for Ctrl-W.
+func isWordChar(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// cmdLineKey handles the next key typed in CommandMode: editing keys, history, completion, return
+// runs the line and escape cancels it. Returns false when the editor should exit (:q).
+func (v *Vi) cmdLineKey() bool {
+	n := nextKey(v.inputBuf)
+	if n == 0 {
+		return true // Wait for the rest of the key.
+	}
+	key := string(v.inputBuf[:n])
+	v.inputBuf = v.inputBuf[n:]
+	c := &v.cmdline
+	if key == "\t" || key == "\x1b[Z" { // Tab, Shift-Tab.
+		if c.prompt == ':' {
+			v.complete(key == "\t")
+		}
+		v.UpdateStatus()
+		return true
+	}
+	v.endCompletion()
+	switch key {
+	case "\r":
+		text, prompt := c.text, c.prompt
+		*c = cmdLine{prompt: prompt} // New line if the command leaves CommandMode on (errors).
+		if prompt == '/' {
+			v.searchHistory = addHistory(v.searchHistory, text)
+			v.search(text)
+			v.UpdateStatus()
+			return true
+		}
+		v.cmdHistory = addHistory(v.cmdHistory, text)
+		return v.command([]byte(text))
+	case "\x1b", "\x03": // Escape, Ctrl-C.
+		v.cmdMode = NavMode
+	case "\x7f", "\x08": // Backspace, Ctrl-H: leaves the empty line.
+		if c.text == "" {
+			v.cmdMode = NavMode
+			break
+		}
+		v.cmdDelete(prevCluster(c.text, c.pos), c.pos)
+	case "\x1b[3~": // Delete.
+		v.cmdDelete(c.pos, nextCluster(c.text, c.pos))
+	case "\x17": // Ctrl-W: the word before the cursor.
+		start := c.pos
+		for start > 0 && c.text[start-1] == ' ' {
+			start--
+		}
+		word := start > 0 && isWordChar(c.text[prevCluster(c.text, start):])
+		for start > 0 {
+			p := prevCluster(c.text, start)
+			if cl := c.text[p:start]; cl == " " || isWordChar(cl) != word {
+				break
+			}
+			start = p
+		}
+		v.cmdDelete(start, c.pos)
+	case "\x15": // Ctrl-U: up to the cursor.
+		v.cmdDelete(0, c.pos)
+	case "\x1b[D":
+		c.pos = prevCluster(c.text, c.pos)
+	case "\x1b[C":
+		c.pos = nextCluster(c.text, c.pos)
+	case "\x1b[H", "\x1bOH", "\x1b[1~", "\x1b[7~", "\x02": // Home, Ctrl-B.
+		c.pos = 0
+	case "\x1b[F", "\x1bOF", "\x1b[4~", "\x1b[8~", "\x05": // End, Ctrl-E.
+		c.pos = len(c.text)
+	case "\x1b[A", "\x1bOA":
+		v.historyMove(-1, true)
+	case "\x1b[B", "\x1bOB":
+		v.historyMove(1, true)
+	case "\x10": // Ctrl-P: previous entry, whatever its start.
+		v.historyMove(-1, false)
+	case "\x0e": // Ctrl-N.
+		v.historyMove(1, false)
+	default:
+		if r, _ := utf8.DecodeRuneInString(key); key[0] == 0x1b || r < ' ' || r == 0x7f || r == utf8.RuneError {
+			v.Beep() // Other keys and controls.
+			break
+		}
+		if key == ":" && c.text == "" && c.prompt == ':' {
+			break // Extra leading :, typed again after an error.
+		}
+		c.text = c.text[:c.pos] + key + c.text[c.pos:]
+		c.pos += len(key)
+		c.navigating = false
+	}
+	v.UpdateStatus()
+	return true
+}
+
+// cmdDelete deletes the bytes from start to end of the command line, the cursor goes to start.
+func (v *Vi) cmdDelete(start, end int) {
+	c := &v.cmdline
+	c.text = c.text[:start] + c.text[end:]
+	c.pos = start
+	c.navigating = false
+}
+
+// historyMove shows the previous (dir -1) or next entry of the history, starting with what was
+// typed before if prefix is true. Past the last one the typed text is back.
+func (v *Vi) historyMove(dir int, prefix bool) {
+	c, hist := &v.cmdline, *v.history()
+	if !c.navigating {
+		c.navigating, c.typed, c.histIdx = true, c.text, len(hist)
+	}
+	for i := c.histIdx + dir; i >= 0 && i < len(hist); i += dir {
+		if !prefix || strings.HasPrefix(hist[i], c.typed) {
+			c.histIdx, c.text = i, hist[i]
+			c.pos = len(c.text)
+			return
+		}
+	}
+	if dir > 0 && c.histIdx < len(hist) {
+		c.histIdx, c.text = len(hist), c.typed
+		c.pos = len(c.text)
+		return
+	}
+	v.Beep()
+}
+
+// completions returns the candidates for the word of the command line from start to the cursor:
+// the command names for the first word, then depending on the command option, buffer, color
+// scheme or file names.
+func (v *Vi) completions(start int) []string {
+	c := &v.cmdline
+	word := c.text[start:c.pos]
+	var res []string
+	add := func(candidates ...string) {
+		for _, s := range candidates {
+			if strings.HasPrefix(s, word) {
+				res = append(res, s)
+			}
+		}
+	}
+	if strings.TrimSpace(c.text[:start]) == "" {
+		add(exCommands...)
+		return res
+	}
+	name, _, _ := splitCommand(strings.TrimSpace(c.text[:start]))
+	switch name {
+	case "se", "set":
+		for _, o := range options {
+			add(o.names[0])
+			if o.isBool() && strings.HasPrefix(word, "no") {
+				add("no" + o.names[0])
+			}
+			if o.isBool() && strings.HasPrefix(word, "inv") {
+				add("inv" + o.names[0])
+			}
+		}
+	case "b", "bu", "buf", "buffer", "bd", "bdelete", "bw", "bwipeout":
+		for _, e := range v.bufs {
+			if e.listed && e.filename != "" && strings.Contains(e.filename, word) {
+				res = append(res, e.filename) // Like :b, any part of the name.
+			}
+		}
+	case "colo", "colorscheme":
+		add(builtinColorSchemes()...)
+	case "e", "edit", "w", "wq", "sp", "split", "new", "vs", "vsplit", "vne", "vnew", "tabnew", "tabe", "tabedit":
+		res = fileCompletions(word)
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+// fileCompletions returns the paths starting with prefix, directories ending with a /. Hidden
+// files only when the name starts with a dot.
+func fileCompletions(prefix string) []string {
+	dir, base := filepath.Split(prefix)
+	entries, err := os.ReadDir(filepath.Clean(dir + "."))
+	if err != nil {
+		return nil
+	}
+	var res []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, base) || (name[0] == '.' && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if e.IsDir() {
+			name += string(filepath.Separator)
+		}
+		res = append(res, dir+name)
+	}
+	return res
+}
+
+// complete completes the word before the cursor with Tab: to the candidate when there is only
+// one, to their longest common start when longer than the word, otherwise it cycles through
+// them (backward when next is false), shown on the line above.
+func (v *Vi) complete(next bool) {
+	c := &v.cmdline
+	if c.matches == nil {
+		c.start = strings.LastIndexByte(c.text[:c.pos], ' ') + 1
+		c.word = c.text[c.start:c.pos]
+		matches := v.completions(c.start)
+		switch {
+		case len(matches) == 0:
+			v.Beep()
+			return
+		case len(matches) == 1:
+			v.replaceWord(matches[0])
+			return
+		}
+		c.matches, c.match = matches, -1
+		if common := commonPrefix(matches); len(common) > len(c.word) && strings.HasPrefix(common, c.word) {
+			v.replaceWord(common) // Next Tabs cycle.
+			c.word = common
+			return
+		}
+		// Otherwise this Tab goes to the first one.
+	}
+	n := len(c.matches) + 1 // And the word typed.
+	step := 1
+	if !next {
+		step = n - 1
+	}
+	c.match = (c.match+1+step)%n - 1
+	if c.match < 0 {
+		v.replaceWord(c.word)
+		return
+	}
+	v.replaceWord(c.matches[c.match])
+}
+
+// commonPrefix returns the longest start common to all of list.
+func commonPrefix(list []string) string {
+	prefix := list[0]
+	for _, s := range list[1:] {
+		n := 0
+		for n < len(prefix) && n < len(s) && prefix[n] == s[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return strings.ToValidUTF8(prefix, "")
+}
+
+// replaceWord replaces the word being completed (from start to the cursor) by s.
+func (v *Vi) replaceWord(s string) {
+	c := &v.cmdline
+	c.text = c.text[:c.start] + s + c.text[c.pos:]
+	c.pos = c.start + len(s)
+	c.navigating = false
+}
+
+// endCompletion ends the Tab completion, the status lines under its matches are drawn again.
+func (v *Vi) endCompletion() {
+	if v.cmdline.matches == nil {
+		return
+	}
+	v.cmdline.matches = nil
+	for _, w := range v.windows() {
+		v.drawStatus(w)
+	}
+	v.drawSeparators(v.tab.layout)
+}
+
+// drawMatches shows the completion matches over the status line above the command line, the
+// current one highlighted, scrolled so it is visible.
+func (v *Vi) drawMatches() {
+	c := &v.cmdline
+	width, h := v.screen.W(), v.screen.H()
+	if h < 2 {
+		return
+	}
+	first, used := max(c.match, 0), 0
+	for first > 0 && used+uniseg.StringWidth(c.matches[first-1])+2 <= width-uniseg.StringWidth(c.matches[max(c.match, 0)]) {
+		first--
+		used += uniseg.StringWidth(c.matches[first]) + 2
+	}
+	style := v.hl("StatusLine")
+	var sb strings.Builder
+	if first > 0 {
+		sb.WriteString("< ")
+	}
+	for i, m := range c.matches[first:] {
+		if i > 0 {
+			sb.WriteString("  ")
+		}
+		if first+i == c.match {
+			sb.WriteString(tcolor.Reset + v.hlText(style, "WildMenu", m))
+		} else {
+			sb.WriteString(m)
+		}
+	}
+	v.screen.MoveCursor(0, h-2)
+	v.screen.WriteString(style + fitWidth(sb.String(), width) + tcolor.Reset)
+}
+
+// CommandStatus draws the command line, scrolled so the cursor is visible, with the cursor on it.
+func (v *Vi) CommandStatus() {
+	c := &v.cmdline
+	if c.matches != nil {
+		v.drawMatches()
+	}
+	width, y := v.screen.W(), v.screen.H()-1
+	prompt, text, pos := string(c.prompt), c.text, c.pos
+	for text != "" && 1+v.ScreenWidth(text[:pos]) >= width { // Widths of the text as shown (escapes).
+		next := nextCluster(text, 0)
+		text, pos = text[next:], pos-next
+		prompt = "<"
+	}
+	shown := v.DisplayString(text, width-1)
+	v.screen.MoveCursor(0, y)
+	v.screen.WriteString(prompt + shown)
+	if 1+uniseg.StringWidth(shown) < width {
+		v.screen.ClearEndOfLine() // Not when full: it would erase the last column.
+	}
+	v.screen.MoveCursor(1+v.ScreenWidth(text[:pos]), y)
+}
+
+// search moves the cursor to the next match of the regexp pattern after it, wrapping around the
+// end of the buffer. An empty pattern is the last one searched (n).
+func (v *Vi) search(pattern string) {
+	v.cmdMode = NavMode
+	if pattern == "" {
+		pattern = v.lastSearch
+	}
+	if pattern == "" {
+		v.searchError(errors.New("no previous pattern"))
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		v.searchError(err)
+		return
+	}
+	v.lastSearch = pattern
+	lineNum := v.BufferLineNumber()
+	l, offset := -1, 0
+	at := v.lineAtToByte(lineNum, v.cx)
+	for _, loc := range re.FindAllStringIndex(v.buf.GetLine(lineNum), -1) {
+		if loc[0] > at {
+			l, offset = lineNum, loc[0]
+			break
+		}
+	}
+	if l < 0 {
+		l, offset = v.buf.Search(re, lineNum+1)
+	}
+	if l < 0 {
+		v.searchError(fmt.Errorf("pattern not found: %s", pattern))
+		return
+	}
+	v.VScroll(l - lineNum)
+	v.cx = v.lineCol(l, offset)
+}
+
+// searchError shows err until the next key.
+func (v *Vi) searchError(err error) {
+	v.ShowError("Search", err)
+	v.screen.ClearEndOfLine()
+	v.keepMessage = true
+}
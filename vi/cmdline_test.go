@@ -0,0 +1,203 @@
+package vi
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newCmdLineVi returns a Vi editing a file with content on a 40x10 VTerm.
+func newCmdLineVi(t *testing.T, content string) (*Vi, *VTerm) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "cmdline.txt")
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	term := NewVTerm(40, 10)
+	v := NewVi(term)
+	v.Open(file)
+	_ = v.UpdateRS()
+	return v, term
+}
+
+func TestCmdLineEditing(t *testing.T) {
+	v, term := newCmdLineVi(t, "x\n")
+	tests := []struct {
+		keys, line string
+		x          int
+	}{
+		{":abc", ":abc", 4},
+		{"\x1b[D\x1b[DX", ":aXbc", 3},
+		{"\x1b[H>", ":>aXbc", 2},
+		{"\x1b[F<", ":>aXbc<", 7},
+		{"\x7f\x01\x1b[3~", ":>aXbc", 6}, // Ctrl-A ignored, nothing to delete at the end.
+		{"\x1bOH\x1b[3~", ":aXbc", 1},
+		{"\x05 set foo.bar", ":aXbc set foo.bar", 17},
+		{"\x17", ":aXbc set foo.", 14},
+		{"\x17", ":aXbc set foo", 13},
+		{"\x17\x17", ":aXbc", 6},
+		{"\x1b[D\x15", ":", 1},
+		{"\x1b[Cé\U0001F469‍\U0001F680\x1b[D", ": é\U0001F469‍\U0001F680", 3},
+		{"\x7f", ": \U0001F469‍\U0001F680", 2}, // Grapheme clusters deleted as a whole.
+		{"\x1b[3~", ":", 2},
+	}
+	for _, test := range tests {
+		v.Process([]byte(test.keys))
+		if l := term.Line(9); l != test.line {
+			t.Errorf("after %q command line %q, expected %q", test.keys, l, test.line)
+		}
+		if x, y := term.Cursor(); x != test.x || y != 9 {
+			t.Errorf("after %q cursor at %d,%d, expected %d,9", test.keys, x, y, test.x)
+		}
+	}
+	// Zero width characters are shown escaped, the cursor is after the escape.
+	v.Process([]byte("\x15a\u200bb\x1b[D"))
+	if l := term.Line(9); l != ":a<U+200B>b" {
+		t.Errorf("zero width character shown as %q", l)
+	}
+	if x, _ := term.Cursor(); x != 10 {
+		t.Errorf("cursor after a zero width character at %d, expected 10", x)
+	}
+	v.Process([]byte("\x05\x15\x7f\x7f"))
+	if v.cmdMode != NavMode || term.Line(9) != "" {
+		t.Errorf("backspace on the empty line: mode %v, line %q", v.cmdMode, term.Line(9))
+	}
+	// Long lines scroll to keep the cursor visible.
+	v.Process([]byte(":0123456789012345678901234567890123456789AB"))
+	if l := term.Line(9); l != "<456789012345678901234567890123456789AB" {
+		t.Errorf("long command line %q", l)
+	}
+	if x, _ := term.Cursor(); x != 39 {
+		t.Errorf("long command line cursor at %d", x)
+	}
+	v.Process([]byte("\x1b[H"))
+	if l := term.Line(9); l != ":012345678901234567890123456789012345678" {
+		t.Errorf("long command line at start %q", l)
+	}
+	v.Process([]byte("\x1b:" + strings.Repeat("\u200b", 5)))
+	if l := term.Line(9); l != "<"+strings.Repeat("<U+200B>", 4) {
+		t.Errorf("long command line of escapes %q", l)
+	}
+	if x, _ := term.Cursor(); x != 33 {
+		t.Errorf("long command line of escapes cursor at %d", x)
+	}
+}
+
+func TestCmdLineHistory(t *testing.T) {
+	v, term := newCmdLineVi(t, "x\n")
+	v.Process([]byte(":set cul\r:set list\r:se nocul\r:set nolist\r:set list\r/x\r"))
+	if expected := []string{"set cul", "se nocul", "set nolist", "set list"}; !slices.Equal(v.cmdHistory, expected) {
+		t.Errorf(": history %q, expected %q", v.cmdHistory, expected)
+	}
+	if expected := []string{"x"}; !slices.Equal(v.searchHistory, expected) {
+		t.Errorf("/ history %q", v.searchHistory)
+	}
+	tests := []struct {
+		keys, line string
+	}{
+		{":set ", ":set"},
+		{"\x1b[A", ":set list"},
+		{"\x1b[A", ":set nolist"},
+		{"\x1b[A", ":set cul"},
+		{"\x1b[A", ":set cul"}, // No older one starting with "set ".
+		{"\x1b[B\x1b[B", ":set list"},
+		{"\x1b[B", ":set"},
+		{"\x10\x10", ":set nolist"}, // Ctrl-P: any previous one.
+		{"\x10", ":se nocul"},
+		{"\x0e\x0e\x0e", ":set"},
+		{"\x15\x1b[A", ":set list"},
+		{"\x1b/\x1b[A", "/x"},
+	}
+	for _, test := range tests {
+		v.Process([]byte(test.keys))
+		if l := term.Line(9); l != test.line {
+			t.Errorf("after %q command line %q, expected %q", test.keys, l, test.line)
+		}
+	}
+	v.Process([]byte("\x1b"))
+	for i := range historySize + 10 {
+		v.cmdHistory = addHistory(v.cmdHistory, string(rune('a'+i%26))+string(rune('0'+i/26)))
+	}
+	if len(v.cmdHistory) != historySize || v.cmdHistory[historySize-1] != "f4" {
+		t.Errorf("history of %d, last %q", len(v.cmdHistory), v.cmdHistory[len(v.cmdHistory)-1])
+	}
+}
+
+func TestCmdLineCompletion(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"one.txt", "other.go", ".hidden", "sub/x.txt"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+	v, term := newCmdLineVi(t, "x\n")
+	v.Process([]byte(":e one.txt\r:e other.go\r"))
+	tests := []struct {
+		keys, line, matches string
+	}{
+		{":tabc\t", ":tabclose", ""},
+		{"\x15tabn", ":tabn", ""},
+		{"\t", ":tabne", "tabnew  tabnext"}, // Longest common start first.
+		{"\t", ":tabnew", "tabnew  tabnext"},
+		{"\t", ":tabnext", "tabnew  tabnext"},
+		{"\t", ":tabne", "tabnew  tabnext"},
+		{"\x1b[Z", ":tabnext", "tabnew  tabnext"},
+		{" ", ":tabnext", ""},
+		{"\x15se nocu\t", ":se nocursor", "nocursorcolumn  nocursorline"},
+		{"l\t", ":se nocursorline", ""},
+		{"\x15set ic\t", ":set ic", ""},
+		{"\x15b oth\t", ":b other.go", ""},
+		{"\x15e o\t", ":e one.txt", "one.txt  other.go"},
+		{"\x15e s\t", ":e sub/", ""},
+		{"x\t", ":e sub/x.txt", ""},
+		{"\x15e .\t", ":e .hidden", ""},
+		{"\x15colo d\t", ":colo default", "default  dusk"},
+	}
+	for _, test := range tests {
+		v.Process([]byte(test.keys))
+		if l := term.Line(9); l != test.line {
+			t.Errorf("after %q command line %q, expected %q", test.keys, l, test.line)
+		}
+		if test.matches != "" && term.Line(8) != test.matches {
+			t.Errorf("after %q matches %q, expected %q", test.keys, term.Line(8), test.matches)
+		}
+	}
+	v.Process([]byte("\x15"))
+	if l := term.Line(8); l[0] != ' ' {
+		t.Errorf("status line not back after the completion: %q", l)
+	}
+}
+
+func TestSearchCommand(t *testing.T) {
+	v, term := newCmdLineVi(t, "alpha beta\ngamma alpha\n\tdelta alpha\n")
+	tests := []struct {
+		keys   string
+		cx, cy int
+	}{
+		{"/alpha\r", 6, 1},
+		{"n", 14, 2},
+		{"n", 0, 0},
+		{"/be.a\r", 6, 0},
+		{"/\r", 6, 0}, // Last pattern again, wraps around to the same match.
+	}
+	for _, test := range tests {
+		v.Process([]byte(test.keys))
+		if v.cx != test.cx || v.BufferLineNumber() != test.cy {
+			t.Errorf("after %q cursor at %d,%d, expected %d,%d", test.keys, v.cx, v.BufferLineNumber(), test.cx, test.cy)
+		}
+	}
+	v.Process([]byte("/zeta\r"))
+	if l := term.Line(9); l != "Search: pattern not found: zeta" || v.cmdMode != NavMode {
+		t.Errorf("search not found %q (mode %v)", l, v.cmdMode)
+	}
+	v.Process([]byte("/a(\r"))
+	if v.cmdMode != NavMode || v.lastSearch != "zeta" {
+		t.Errorf("invalid pattern: mode %v, last search %q", v.cmdMode, v.lastSearch)
+	}
+}
@@ -8,7 +8,7 @@ import (
 // AI written tests in this file so kinda write only.
 
 func TestCalculateCenteredPositionShortFile(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.usableHeight = 28 // Simulate large screen
 
 	// Test centering line 0 in a 3-line file with large screen
@@ -35,7 +35,7 @@ func TestCalculateCenteredPositionShortFile(t *testing.T) {
 }
 
 func TestCalculateCenteredPositionLongFile(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.usableHeight = 8 // Simulate smaller screen
 
 	// Test centering line 20 in a 50-line file
@@ -68,7 +68,7 @@ func TestCalculateCenteredPositionLongFile(t *testing.T) {
 }
 
 func TestCalculateCenteredPositionNearEndOfFile(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.usableHeight = 10 // Simulate medium screen
 
 	// Test centering line 11 (last line) in a 12-line file
@@ -95,7 +95,7 @@ func TestCalculateCenteredPositionNearEndOfFile(t *testing.T) {
 }
 
 func TestCalculateCenteredPositionEmptyFile(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.usableHeight = 20 // Simulate normal screen
 
 	// Test centering in an empty file
@@ -120,14 +120,15 @@ func TestCalculateCenteredPositionEmptyFile(t *testing.T) {
 }
 
 func TestCtrlLCenteringLongFile(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.usableHeight = 8 // Simulate smaller screen
 
 	// Create a long file with many lines
-	v.buf.lines = make([]string, 50)
+	lines := make([]string, 50)
 	for i := range 50 {
-		v.buf.lines[i] = "line " + strconv.Itoa(i)
+		lines[i] = "line " + strconv.Itoa(i)
 	}
+	v.buf.lines = newRope(lines)
 
 	// Start at line 20 (middle of file)
 	v.cy = 4
@@ -168,14 +169,15 @@ func TestCtrlLCenteringLongFile(t *testing.T) {
 }
 
 func TestCtrlLCenteringNearEndOfFile(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.usableHeight = 10 // Simulate medium screen
 
 	// Create a file with 12 lines (slightly longer than screen)
-	v.buf.lines = make([]string, 12)
+	lines := make([]string, 12)
 	for i := range 12 {
-		v.buf.lines[i] = "line " + strconv.Itoa(i)
+		lines[i] = "line " + strconv.Itoa(i)
 	}
+	v.buf.lines = newRope(lines)
 
 	// Start near the end of the file (line 11, the last line)
 	v.cy = 9
@@ -210,11 +212,11 @@ func TestCtrlLCenteringNearEndOfFile(t *testing.T) {
 }
 
 func TestCtrlLCenteringEmptyFile(t *testing.T) {
-	v := &Vi{}
+	v := &Vi{buf: &Buffer{}}
 	v.usableHeight = 20 // Simulate normal screen
 
 	// Create an empty file
-	v.buf.lines = []string{} // Empty file
+	v.buf.lines = newRope([]string{}) // Empty file
 
 	// Start at origin (should be the only valid position)
 	v.cy = 0
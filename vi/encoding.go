@@ -0,0 +1,189 @@
+package vi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encoding converts file content from and to UTF-8, which is what the buffer always holds.
+type Encoding struct {
+	Name    string
+	aliases []string
+	decode  func(data []byte) (string, error)
+	encode  func(dst []byte, s string) ([]byte, error)
+	bom     string // Byte order mark in this encoding, if there is one.
+}
+
+// EncodeError is returned when a character can't be represented in the target encoding.
+type EncodeError struct {
+	Encoding string
+	Rune     rune
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("character %q (U+%04X) cannot be represented in %s", e.Rune, e.Rune, e.Encoding)
+}
+
+// UTF8 is the default encoding, no conversion (invalid bytes are preserved).
+var UTF8 = &Encoding{
+	Name:    "utf-8",
+	aliases: []string{"utf8"},
+	bom:     utf8BOM,
+}
+
+// cp1252High maps bytes 0x80-0x9F of Windows-1252, the rest is the same as Latin-1.
+// The 5 undefined bytes map to the C1 control with the same value, so the conversion is lossless.
+var cp1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// Encodings are the supported file encodings.
+var Encodings = []*Encoding{
+	UTF8,
+	{
+		Name:    "latin1",
+		aliases: []string{"iso-8859-1", "iso8859-1", "latin-1"},
+		decode:  decode8bit(func(b byte) rune { return rune(b) }),
+		encode: encode8bit("latin1", func(r rune) (byte, bool) {
+			return byte(r), r < 0x100
+		}),
+	},
+	{
+		Name:    "cp1252",
+		aliases: []string{"windows-1252", "win1252"},
+		decode: decode8bit(func(b byte) rune {
+			if b >= 0x80 && b < 0xA0 {
+				return cp1252High[b-0x80]
+			}
+			return rune(b)
+		}),
+		encode: encode8bit("cp1252", func(r rune) (byte, bool) {
+			if r < 0x80 || (r >= 0xA0 && r < 0x100) {
+				return byte(r), true
+			}
+			for i, c := range cp1252High {
+				if c == r {
+					return byte(0x80 + i), true
+				}
+			}
+			return 0, false
+		}),
+	},
+	{
+		Name:    "utf-16le",
+		aliases: []string{"utf16le", "ucs-2le"},
+		decode:  decodeUTF16(binary.LittleEndian),
+		encode:  encodeUTF16("utf-16le", binary.LittleEndian),
+		bom:     "\xFF\xFE",
+	},
+	{
+		Name:    "utf-16be",
+		aliases: []string{"utf16be", "ucs-2be", "utf-16", "utf16"},
+		decode:  decodeUTF16(binary.BigEndian),
+		encode:  encodeUTF16("utf-16be", binary.BigEndian),
+		bom:     "\xFE\xFF",
+	},
+}
+
+// FindEncoding returns the encoding for name (case insensitive, aliases allowed).
+func FindEncoding(name string) (*Encoding, error) {
+	name = strings.ToLower(name)
+	for _, e := range Encodings {
+		if e.Name == name {
+			return e, nil
+		}
+		for _, a := range e.aliases {
+			if a == name {
+				return e, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", name)
+}
+
+// SniffEncoding returns the UTF-16 encoding if data starts with its BOM, nil otherwise.
+func SniffEncoding(data []byte) *Encoding {
+	for _, e := range Encodings {
+		if e != UTF8 && e.bom != "" && strings.HasPrefix(string(data), e.bom) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Decode converts data to UTF-8.
+func (e *Encoding) Decode(data []byte) (string, error) {
+	if e.decode == nil {
+		return string(data), nil
+	}
+	return e.decode(data)
+}
+
+// Encode appends s converted to the encoding to dst.
+func (e *Encoding) Encode(dst []byte, s string) ([]byte, error) {
+	if e.encode == nil {
+		return append(dst, s...), nil
+	}
+	return e.encode(dst, s)
+}
+
+func decode8bit(toRune func(b byte) rune) func(data []byte) (string, error) {
+	return func(data []byte) (string, error) {
+		var sb strings.Builder
+		sb.Grow(len(data))
+		for _, b := range data {
+			sb.WriteRune(toRune(b))
+		}
+		return sb.String(), nil
+	}
+}
+
+func encode8bit(name string, toByte func(r rune) (byte, bool)) func(dst []byte, s string) ([]byte, error) {
+	return func(dst []byte, s string) ([]byte, error) {
+		for _, r := range s {
+			b, ok := toByte(r)
+			if !ok {
+				return dst, &EncodeError{Encoding: name, Rune: r}
+			}
+			dst = append(dst, b)
+		}
+		return dst, nil
+	}
+}
+
+func decodeUTF16(order binary.ByteOrder) func(data []byte) (string, error) {
+	return func(data []byte) (string, error) {
+		if len(data)%2 != 0 {
+			return "", errors.New("invalid utf-16: odd number of bytes")
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	}
+}
+
+func encodeUTF16(name string, order binary.AppendByteOrder) func(dst []byte, s string) ([]byte, error) {
+	return func(dst []byte, s string) ([]byte, error) {
+		for i, r := range s {
+			if r == utf8.RuneError {
+				if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+					return dst, &EncodeError{Encoding: name, Rune: rune(s[i])}
+				}
+			}
+			if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+				dst = order.AppendUint16(dst, uint16(r1))
+				dst = order.AppendUint16(dst, uint16(r2))
+				continue
+			}
+			dst = order.AppendUint16(dst, uint16(r))
+		}
+		return dst, nil
+	}
+}
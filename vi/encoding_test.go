@@ -0,0 +1,101 @@
+package vi
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestEncodingsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		enc     string // empty for detection
+		content string
+		lines   []string
+		info    string
+	}{
+		{"latin1", "latin1", "caf\xe9\n\xff\n", []string{"café", "ÿ"}, "latin1,unix"},
+		{"cp1252", "cp1252", "\x80 \x93q\x94\x81\r\n", []string{"€ “q”\u0081"}, "cp1252,dos"},
+		{"utf-16le bom", "", "\xff\xfeh\x00i\x00\n\x00=\xd8\x00\xde\n\x00", []string{"hi", "😀"}, "utf-16le,unix,bom"},
+		{"utf-16be bom", "", "\xfe\xff\x00h\x00i", []string{"hi"}, "utf-16be,unix,noeol,bom"},
+		{"utf-16le forced", "utf-16le", "a\x00\r\x00\n\x00", []string{"a"}, "utf-16le,dos"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "f.txt")
+			if err := os.WriteFile(fname, []byte(test.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var b Buffer
+			if test.enc != "" {
+				if err := b.SetEncoding(test.enc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.Open(fname); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(allLines(&b), test.lines) {
+				t.Errorf("Lines %q, expected %q", allLines(&b), test.lines)
+			}
+			if info := b.FormatInfo(); info != test.info {
+				t.Errorf("FormatInfo %q, expected %q", info, test.info)
+			}
+			b.dirty = true
+			if err := b.Save(); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.content {
+				t.Errorf("Saved %q, expected unchanged %q", data, test.content)
+			}
+		})
+	}
+}
+
+func TestEncodingUnrepresentable(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "f.txt")
+	content := "caf\xe9\n"
+	if err := os.WriteFile(fname, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b Buffer
+	if err := b.SetEncoding("ISO-8859-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	b.InsertLine(1, "price: 5€")
+	err := b.Save()
+	var encErr *EncodeError
+	if !errors.As(err, &encErr) || encErr.Rune != '€' {
+		t.Fatalf("Expected encode error for €, got %v", err)
+	}
+	if err.Error() != "line 2: character '€' (U+20AC) cannot be represented in latin1" {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+	data, _ := os.ReadFile(fname)
+	if string(data) != content {
+		t.Errorf("File should be untouched after encoding error, got %q", data)
+	}
+	// Switching to cp1252 which has € works.
+	if err = b.SetEncoding("windows-1252"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(fname)
+	if string(data) != "caf\xe9\nprice: 5\x80\n" {
+		t.Errorf("Unexpected cp1252 content %q", data)
+	}
+	if _, err = FindEncoding("ebcdic"); err == nil {
+		t.Error("Expected error for unsupported encoding")
+	}
+}
@@ -0,0 +1,328 @@
+package vi
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"fortio.org/log"
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+var (
+	// FocusReportingOn makes the terminal send focusIn/focusOut when the window gains/loses focus.
+	FocusReportingOn  = "\033[?1004h"
+	FocusReportingOff = "\033[?1004l"
+	focusIn           = []byte("\033[I")
+	focusOut          = []byte("\033[O")
+)
+
+// recordDiskState remembers the file's inode, size and modification time, to detect
+// changes made by other programs.
+func (b *Buffer) recordDiskState() {
+	if b.name == "" {
+		return
+	}
+	fi, err := os.Stat(b.name)
+	if err != nil {
+		b.diskInfo = nil
+		return
+	}
+	b.diskInfo = fi
+}
+
+// ChangedOnDisk returns true if the file was modified, replaced or deleted since it was last read or written.
+func (b *Buffer) ChangedOnDisk() bool {
+	if b.newFile {
+		_, err := os.Stat(b.name)
+		return err == nil // Created by another program.
+	}
+	if b.name == "" || b.diskInfo == nil {
+		return false
+	}
+	fi, err := os.Stat(b.name)
+	if err != nil {
+		return true // Deleted (or no longer accessible).
+	}
+	return !os.SameFile(fi, b.diskInfo) || fi.Size() != b.diskInfo.Size() || !fi.ModTime().Equal(b.diskInfo.ModTime())
+}
+
+// KeepOurs accepts the current state of the file on disk as known, without reloading it:
+// the buffer is considered modified and will overwrite the file when saved. The journal
+// restarts from the file's new content, replaced by all our lines.
+func (b *Buffer) KeepOurs() {
+	b.openCreated()
+	b.recordDiskState()
+	b.dirty = true
+	if b.swap == nil {
+		return
+	}
+	disk, err := b.readDisk()
+	if err != nil {
+		disk = &Buffer{} // Deleted: recovering starts from an empty buffer.
+	}
+	if err = b.swap.reset(); err != nil {
+		log.Errf("Error resetting swap file: %v", err)
+		return
+	}
+	b.journal(opBase, disk.lines.Len(), disk.contentHash())
+	for range disk.lines.Len() {
+		b.journal(opDelete, 0, "")
+	}
+	i := 0
+	for line := range b.lines.All() {
+		b.journal(opInsert, i, line)
+		i++
+	}
+}
+
+// openCreated opens the file of a new file buffer once another program created it, read-only
+// like reloading: saving reopens it for writing.
+func (b *Buffer) openCreated() {
+	if !b.newFile {
+		return
+	}
+	f, err := os.Open(b.name)
+	if err != nil {
+		return // Still not there.
+	}
+	b.f, b.fileRO, b.newFile = f, true, false
+}
+
+// reopenIfReplaced reopens the file by name if it was replaced (e.g. renamed over by a
+// formatter or git checkout) or deleted so we save to the file and not the old inode.
+// forWrite (saving) also reopens a file opened read-only, for writing; otherwise (reloading)
+// it is reopened read-only.
+func (b *Buffer) reopenIfReplaced(forWrite bool) error {
+	if b.name == "" || b.f == nil {
+		return nil
+	}
+	cur, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(b.name)
+	if err == nil && os.SameFile(cur, fi) && (!forWrite || !b.fileRO) {
+		return nil
+	}
+	var f *os.File
+	if forWrite {
+		f, err = os.OpenFile(b.name, os.O_RDWR|os.O_CREATE, 0o644)
+	} else {
+		f, err = os.Open(b.name)
+	}
+	if err != nil {
+		return err
+	}
+	b.f.Close()
+	b.f, b.fileRO = f, !forWrite
+	return nil
+}
+
+// readDisk reads and decodes the current file content with the buffer's settings.
+func (b *Buffer) readDisk() (*Buffer, error) {
+	f, err := os.Open(b.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	disk := &Buffer{binary: b.binary, enc: b.enc, encSet: b.encSet}
+	return disk, disk.load(data)
+}
+
+// DiskLines returns the lines of the file as currently on disk.
+func (b *Buffer) DiskLines() ([]string, error) {
+	disk, err := b.readDisk()
+	if err != nil {
+		return nil, err
+	}
+	return disk.GetLines(0, disk.NumLines()), nil
+}
+
+// Reload discards the buffer content and changes and reads the file again.
+func (b *Buffer) Reload() error {
+	if b.name == "" {
+		return fmt.Errorf("no file name")
+	}
+	disk, err := b.readDisk()
+	if err != nil {
+		return err
+	}
+	b.openCreated()
+	if err = b.reopenIfReplaced(false); err != nil {
+		return err
+	}
+	b.lines, b.format, b.noEOL, b.bom, b.enc = disk.lines, disk.format, disk.noEOL, disk.bom, disk.enc
+	b.dirty = false
+	b.version++
+	b.resetSyntax()
+	b.recordDiskState()
+	return b.resetSwap()
+}
+
+// diffMaxCells bounds the size of the LCS table, beyond that the changed region is shown as all removed then all added.
+const diffMaxCells = 1 << 22
+
+// LineDiff returns the line differences from a to b: lines only in a prefixed by "-",
+// lines only in b prefixed by "+", each group of changes preceded by a "@@ -aLine +bLine @@"
+// header (1 based line numbers).
+func LineDiff(a, b []string) []string {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	n, m := len(ma), len(mb)
+	var res []string
+	i, j := 0, 0
+	inHunk := false
+	emit := func(line string) {
+		if !inHunk {
+			res = append(res, fmt.Sprintf("@@ -%d +%d @@", prefix+i+1, prefix+j+1))
+			inHunk = true
+		}
+		res = append(res, line)
+	}
+	if n*m > diffMaxCells {
+		for ; i < n; i++ {
+			emit("-" + ma[i])
+		}
+		for ; j < m; j++ {
+			emit("+" + mb[j])
+		}
+		return res
+	}
+	// lcs[i][j] is the length of the longest common subsequence of ma[i:] and mb[j:].
+	lcs := make([][]int32, n+1)
+	for k := range lcs {
+		lcs[k] = make([]int32, m+1)
+	}
+	for x := n - 1; x >= 0; x-- {
+		for y := m - 1; y >= 0; y-- {
+			if ma[x] == mb[y] {
+				lcs[x][y] = lcs[x+1][y+1] + 1
+			} else {
+				lcs[x][y] = max(lcs[x+1][y], lcs[x][y+1])
+			}
+		}
+	}
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && ma[i] == mb[j]:
+			inHunk = false
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			emit("-" + ma[i])
+			i++
+		default:
+			emit("+" + mb[j])
+			j++
+		}
+	}
+	return res
+}
+
+// Prompt asks a one key question on the bottom line, fn is called with the answer.
+func (v *Vi) Prompt(msg string, fn func(c byte) bool) {
+	v.cmdMode = NavMode
+	v.prompt = fn
+	v.writeAt(0, v.screen.H()-1, "%s%s%s", v.hl("WarningMsg"), msg, tcolor.Reset)
+	v.screen.ClearEndOfLine()
+	v.keepMessage = true
+}
+
+// CheckTime checks if the file was changed on disk by another program and if so
+// prompts to reload it, keep the buffer or show the differences. Returns true if it was changed.
+func (v *Vi) CheckTime() bool {
+	if !v.buf.ChangedOnDisk() {
+		return false
+	}
+	v.Prompt("The file changed on disk: [r]eload, [k]eep ours, show [d]iff?", func(c byte) bool {
+		switch c {
+		case 'r', 'R':
+			v.Reload()
+		case 'k', 'K':
+			v.buf.KeepOurs()
+			v.CmdResult("Keeping the buffer, :w will overwrite the file.")
+		case 'd', 'D':
+			v.ShowDiff()
+		default:
+			v.Beep()
+			v.CheckTime()
+		}
+		return true
+	})
+	return true
+}
+
+// Reload reads the file again from disk, discarding the changes (:e!).
+func (v *Vi) Reload() {
+	err := v.buf.Reload()
+	if err != nil {
+		v.ShowError("Error reloading file", err)
+		return
+	}
+	if v.BufferLineNumber() >= v.buf.NumLines() {
+		v.offset, v.cy = v.calculateCenteredPosition(v.buf.NumLines()-1, v.buf.NumLines())
+	}
+	v.Update()
+	v.CmdResult("Reloaded %s", v.cur.filename)
+}
+
+// ShowDiff shows the differences between the file on disk and the buffer, a screen at a time,
+// then asks again what to do.
+func (v *Vi) ShowDiff() {
+	disk, err := v.buf.DiskLines()
+	if err != nil {
+		v.ShowError("Error reading file", err)
+		return
+	}
+	diff := LineDiff(disk, v.buf.GetLines(0, v.buf.NumLines()))
+	v.showDiff(diff, len(diff))
+}
+
+// showDiff shows the diff lines that fit on the screen, with a prompt to page to the next ones,
+// total being the number of lines of the whole diff.
+func (v *Vi) showDiff(diff []string, total int) {
+	v.screen.StartSyncMode()
+	v.screen.ClearScreen()
+	v.covered = true
+	n := min(len(diff), v.screen.H()-1)
+	for i, line := range diff[:n] {
+		group := "DiffHeader"
+		switch line[0] {
+		case '-':
+			group = "DiffDelete"
+		case '+':
+			group = "DiffAdd"
+		}
+		v.writeAt(0, i, "%s%s%s", v.hl(group), v.DisplayString(line, v.screen.W()), tcolor.Reset)
+	}
+	msg := fmt.Sprintf("Disk (-) vs buffer (+): %d diff lines, ", total)
+	if n < len(diff) {
+		v.Prompt(msg+"-- More -- (q to stop)", func(c byte) bool {
+			if c == 'q' || c == 0x1b {
+				v.Update()
+				v.CheckTime()
+				return true
+			}
+			v.showDiff(diff[n:], total)
+			return true
+		})
+		return
+	}
+	v.Prompt(msg+"press any key", func(_ byte) bool {
+		v.Update()
+		v.CheckTime()
+		return true
+	})
+}
@@ -0,0 +1,256 @@
+package vi
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     []string
+		expected []string
+	}{
+		{"same", []string{"a", "b"}, []string{"a", "b"}, nil},
+		{"added", []string{"a", "c"}, []string{"a", "b", "c"}, []string{"@@ -2 +2 @@", "+b"}},
+		{"removed", []string{"a", "b", "c"}, []string{"a", "c"}, []string{"@@ -2 +2 @@", "-b"}},
+		{"changed", []string{"a", "b", "c"}, []string{"a", "x", "c"}, []string{"@@ -2 +2 @@", "-b", "+x"}},
+		{
+			"two hunks", []string{"1", "2", "3", "4", "5"}, []string{"0", "1", "2", "4", "5"},
+			[]string{"@@ -1 +1 @@", "+0", "@@ -3 +4 @@", "-3"},
+		},
+		{"all new", nil, []string{"a"}, []string{"@@ -1 +1 @@", "+a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := LineDiff(test.a, test.b)
+			if !slices.Equal(res, test.expected) {
+				t.Errorf("LineDiff(%q, %q) = %q, expected %q", test.a, test.b, res, test.expected)
+			}
+		})
+	}
+}
+
+// touch changes the modification time so changes of the same size are detected
+// even on file systems with a coarse time resolution.
+func touch(t *testing.T, fname string) {
+	t.Helper()
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fname, future, future); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangedOnDiskAndReload(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(fname, []byte("line 1\nline 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b Buffer
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	if b.ChangedOnDisk() {
+		t.Error("Should not be changed right after opening")
+	}
+	b.ReplaceLine(0, "ours")
+	if err := os.WriteFile(fname, []byte("theirs\r\nline 2\r\nline 3\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, fname)
+	if !b.ChangedOnDisk() {
+		t.Fatal("Should be changed after external write")
+	}
+	disk, err := b.DiskLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"theirs", "line 2", "line 3"}
+	if !slices.Equal(disk, expected) {
+		t.Errorf("DiskLines %q, expected %q", disk, expected)
+	}
+	if err = b.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(allLines(&b), expected) || b.IsDirty() || b.FileFormat() != FormatDos {
+		t.Errorf("Reloaded %q dirty %v format %v", allLines(&b), b.IsDirty(), b.FileFormat())
+	}
+	if b.ChangedOnDisk() {
+		t.Error("Should not be changed after reload")
+	}
+	// Deleted counts as changed, KeepOurs accepts it.
+	if err = os.Remove(fname); err != nil {
+		t.Fatal(err)
+	}
+	if !b.ChangedOnDisk() {
+		t.Error("Should be changed after delete")
+	}
+	b.KeepOurs()
+	if b.ChangedOnDisk() || !b.IsDirty() {
+		t.Errorf("After KeepOurs: changed %v dirty %v", b.ChangedOnDisk(), b.IsDirty())
+	}
+	// Saving recreates the file.
+	if err = b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil || string(data) != "theirs\r\nline 2\r\nline 3\r\n" {
+		t.Errorf("Saved %q %v", data, err)
+	}
+}
+
+func TestSaveAfterReplace(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "test.txt")
+	if err := os.WriteFile(fname, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b Buffer
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	// Like a formatter or git checkout: write a new file and rename it over ours.
+	tmp := filepath.Join(dir, "new.txt")
+	if err := os.WriteFile(tmp, []byte("replaced\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		t.Fatal(err)
+	}
+	if !b.ChangedOnDisk() {
+		t.Error("Should be changed after rename over")
+	}
+	b.ReplaceLine(0, "ours")
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil || string(data) != "ours\n" {
+		t.Errorf("Saved %q %v, expected the replacement file to be written", data, err)
+	}
+	if b.ChangedOnDisk() {
+		t.Error("Should not be changed after save")
+	}
+}
+
+func TestReloadReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "test.txt")
+	if err := os.WriteFile(fname, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	v := NewVi(NewVTerm(40, 10))
+	v.SetReadOnly(true) // -R
+	v.Open(fname)
+	tmp := filepath.Join(dir, "new.txt")
+	if err := os.WriteFile(tmp, []byte("replaced\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		t.Fatal(err)
+	}
+	v.Process([]byte("x:e!\r"))
+	if v.cmdMode != NavMode || v.buf.GetLine(0) != "replaced" || v.buf.IsDirty() {
+		t.Errorf(":e! on a read-only buffer: mode %v, %q dirty %v", v.cmdMode, v.buf.GetLine(0), v.buf.IsDirty())
+	}
+	if !v.buf.fileRO || !v.buf.ReadOnly() {
+		t.Errorf(":e! reopened the file for writing: fileRO %v, read-only %v", v.buf.fileRO, v.buf.ReadOnly())
+	}
+	// Not even when the buffer can be written: that waits for :w.
+	v.buf.SetReadOnly(false)
+	if err := os.WriteFile(tmp, []byte("again\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.buf.Reload(); err != nil || !v.buf.fileRO {
+		t.Errorf("Reload: %v, fileRO %v", err, v.buf.fileRO)
+	}
+	v.buf.ReplaceLine(0, "ours")
+	if err := v.buf.Save(); err != nil || v.buf.fileRO {
+		t.Errorf("Save: %v, fileRO %v", err, v.buf.fileRO)
+	}
+	if data, _ := os.ReadFile(fname); string(data) != "ours\n" {
+		t.Errorf("saved %q", data)
+	}
+	v.Close()
+}
+
+func TestNewFileCreatedOnDisk(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "new.txt")
+	for _, reload := range []bool{false, true} {
+		_ = os.Remove(fname)
+		var b Buffer
+		if err := b.Open(fname); err != nil || !b.IsNew() {
+			t.Fatalf("Open: %v, new file %v", err, b.IsNew())
+		}
+		b.InsertLine(0, "ours")
+		if err := os.WriteFile(fname, []byte("theirs\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if !b.ChangedOnDisk() {
+			t.Error("Should be changed once created by another program")
+		}
+		if reload {
+			if err := b.Reload(); err != nil || b.GetLine(0) != "theirs" {
+				t.Errorf("Reload: %v, %q", err, b.GetLine(0))
+			}
+		} else {
+			b.KeepOurs()
+		}
+		if b.ChangedOnDisk() || b.IsNew() || b.f == nil || b.diskInfo == nil {
+			t.Errorf("reload %v: changed %v new file %v f %v disk info %v", reload,
+				b.ChangedOnDisk(), b.IsNew(), b.f, b.diskInfo)
+		}
+		b.ReplaceLine(0, "saved")
+		if err := b.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(fname); string(data) != "saved\n" {
+			t.Errorf("reload %v: saved %q", reload, data)
+		}
+		b.f.Close()
+	}
+}
+
+func TestShowDiffPaging(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(fname, []byte("a\nb\nc\nd\ne\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	term := NewVTerm(80, 5)
+	v := NewVi(term)
+	v.Open(fname)
+	_ = v.UpdateRS()
+	if err := os.WriteFile(fname, []byte("1\n2\n3\n4\n5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, fname)
+	// 11 diff lines: the header, 5 removed and 5 added, 4 per screen.
+	pages := [][]string{{"@@ -1 +1 @@", "-1", "-2", "-3"}, {"-4", "-5", "+a", "+b"}, {"+c", "+d", "+e", ""}}
+	v.Process(append(slices.Clone(focusIn), 'd'))
+	for i, page := range pages {
+		for y, expected := range page {
+			if l := term.Line(y); l != expected {
+				t.Errorf("diff page %d line %d %q, expected %q", i, y, l, expected)
+			}
+		}
+		if l := term.Line(4); !strings.HasPrefix(l, "Disk (-) vs buffer (+): 11 diff lines") {
+			t.Errorf("diff page %d prompt %q", i, l)
+		}
+		v.Process([]byte(" "))
+	}
+	if l := term.Line(4); !strings.HasPrefix(l, "The file changed on disk") {
+		t.Errorf("not asking again after the diff: %q", l)
+	}
+	v.Process([]byte("dq"))
+	if l := term.Line(4); !strings.HasPrefix(l, "The file changed on disk") {
+		t.Errorf("not asking again after stopping the diff: %q", l)
+	}
+	v.Close()
+}
@@ -0,0 +1,93 @@
+package vi
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenTests feed keys to the editor editing test.txt (with content, if not empty) and compare the
+// buffer (or the saved file) and the screen to testdata/golden/<name>.txt.
+var goldenTests = []struct {
+	name    string
+	content string
+	keys    string
+}{
+	{"insert_delete_save", "", "ihello\x1b0x:wq\r"},
+	{"insert_newlines", "", "iab\rcd\ref\x1b"},
+	{"append_end", "one\ntwo\n", "jAs\x1b"},
+	{"open_lines", "one\ntwo\n", "oafter\x1bkOfirst\x1b"},
+	{"delete_chars", "abcdef\n", "lll3x"},
+	{"delete_count", "abcdefgh\n", "l3x$2x"},
+	{"wide_chars", "日本語\n", "lxix\x1b"},
+	{"move_end_start", "line one\nline two\nline three\n", "G$x0x"},
+	{"command_in_one_read", "a\nb\nc\nd\n", ":3\rx"},
+	{"command_escape", "abc\n", ":foo\x1bx"},
+	{"split_window", "abc\n", ":sp\r"},
+	{"tab_pages", "abc\n", ":tabnew\riother\x1bgt"},
+}
+
+func TestGolden(t *testing.T) {
+	for _, test := range goldenTests {
+		t.Run(test.name, func(t *testing.T) {
+			golden, err := filepath.Abs(filepath.Join("testdata", "golden", test.name+".txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Chdir(t.TempDir())
+			if test.content != "" {
+				if err = os.WriteFile("test.txt", []byte(test.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			term := NewVTerm(60, 10)
+			v := NewVi(term)
+			_ = v.UpdateRS()
+			v.Open("test.txt")
+			running := v.Process([]byte(test.keys))
+			got := renderGolden(v, term, running)
+			if *update {
+				if err = os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got != string(expected) {
+				t.Errorf("keys %q, got:\n%s\nexpected:\n%s", test.keys, got, expected)
+			}
+		})
+	}
+}
+
+// renderGolden returns the golden file content: the file if the editor exited, the buffer otherwise,
+// then the screen with its cursor position.
+func renderGolden(v *Vi, term *VTerm, running bool) string {
+	var sb strings.Builder
+	if running {
+		sb.WriteString("-- buffer --\n")
+		for i := range v.buf.NumLines() {
+			sb.WriteString(v.buf.GetLine(i))
+			sb.WriteByte('\n')
+		}
+	} else {
+		sb.WriteString("-- file (exited) --\n")
+		data, err := os.ReadFile("test.txt")
+		if err != nil {
+			sb.WriteString(err.Error() + "\n")
+		}
+		sb.Write(data)
+	}
+	x, y := term.Cursor()
+	fmt.Fprintf(&sb, "-- screen (cursor %d,%d) --\n", x, y)
+	sb.WriteString(term.String())
+	return sb.String()
+}
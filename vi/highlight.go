@@ -0,0 +1,493 @@
+package vi
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+// builtinColors are the color schemes shipped with the editor, colors/<name>.colors.
+//
+//go:embed colors/*.colors
+var builtinColors embed.FS
+
+const (
+	colorsExt     = ".colors"
+	defaultColors = "default"
+	trueColors    = 1 << 24 // 'colors' value of a truecolor terminal.
+	maxLinkDepth  = 10      // Links followed to resolve a group, more is a loop.
+)
+
+// highlight is the style of a highlight group (StatusLine, Comment...), as set by :hi and the
+// color schemes. Groups are case insensitive.
+type highlight struct {
+	name                             string       // Group name as first defined.
+	fg, bg                           tcolor.Color // 0 when not set.
+	bold, italic, underline, reverse bool
+	link                             string // Group it is an alias of, if set.
+}
+
+// String returns the definition of the group as :hi arguments.
+func (h *highlight) String() string {
+	if h.link != "" {
+		return "links to " + h.link
+	}
+	var res []string
+	if h.fg != 0 {
+		res = append(res, "fg="+colorName(h.fg))
+	}
+	if h.bg != 0 {
+		res = append(res, "bg="+colorName(h.bg))
+	}
+	for _, a := range []struct {
+		on   bool
+		name string
+	}{{h.bold, "bold"}, {h.italic, "italic"}, {h.underline, "underline"}, {h.reverse, "reverse"}} {
+		if a.on {
+			res = append(res, a.name)
+		}
+	}
+	if len(res) == 0 {
+		return "cleared"
+	}
+	return strings.Join(res, " ")
+}
+
+// colorName returns c as accepted by parseColor.
+func colorName(c tcolor.Color) string {
+	if t, v := c.Decode(); t == tcolor.ColorType256 {
+		return strconv.Itoa(int(v))
+	}
+	return strings.ToLower(c.String())
+}
+
+// colorAliases are vim color names missing from tcolor.
+var colorAliases = map[string]string{
+	"magenta":      "purple",
+	"grey":         "gray",
+	"darkgrey":     "darkgray",
+	"lightred":     "brightred",
+	"lightgreen":   "brightgreen",
+	"lightyellow":  "brightyellow",
+	"lightblue":    "brightblue",
+	"lightmagenta": "brightpurple",
+	"lightcyan":    "brightcyan",
+}
+
+// parseColor parses a color name (red, brightblue...), a 256 colors index (0-255 or c000-c255),
+// a RRGGBB hex value (with or without #) or hsl. "none" is no color (0).
+func parseColor(s string) (tcolor.Color, error) {
+	s = strings.ToLower(s)
+	if s == "none" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 || n > 255 {
+			return 0, fmt.Errorf("invalid color %s: 256 colors index must be 0-255", s)
+		}
+		return tcolor.Color256(n).Color(), nil
+	}
+	if alias, ok := colorAliases[s]; ok {
+		s = alias
+	}
+	c, err := tcolor.FromString(s)
+	if err != nil {
+		return 0, err
+	}
+	if b, ok := c.BasicColor(); ok && b == tcolor.None {
+		return 0, nil
+	}
+	return c, nil
+}
+
+// highlights are the highlight groups, by lowercase name.
+type highlights map[string]*highlight
+
+// group returns the group named name, creating it if needed.
+func (hl highlights) group(name string) *highlight {
+	key := strings.ToLower(name)
+	h := hl[key]
+	if h == nil {
+		h = &highlight{name: name}
+		hl[key] = h
+	}
+	return h
+}
+
+// resolve returns the group named name following the links, nil if it isn't defined.
+func (hl highlights) resolve(name string) *highlight {
+	h := hl[strings.ToLower(name)]
+	for range maxLinkDepth {
+		if h == nil || h.link == "" {
+			return h
+		}
+		h = hl[strings.ToLower(h.link)]
+	}
+	return nil // Loop.
+}
+
+// apply handles the arguments of :hi (without the listing forms): Group key=value... attributes,
+// link Group Other, clear Group.
+func (hl highlights) apply(args []string) error {
+	switch {
+	case len(args) == 0:
+		return errors.New("usage: :hi [Group [fg=color] [bg=color] [bold] [italic] [underline] [reverse] [none]]")
+	case args[0] == "link" || args[0] == "def" && len(args) > 1 && args[1] == "link":
+		if args[0] == "def" {
+			args = args[1:]
+		}
+		if len(args) != 3 {
+			return errors.New("usage: :hi link Group Other")
+		}
+		h := hl.group(args[1])
+		*h = highlight{name: h.name, link: args[2]}
+		return nil
+	case args[0] == "clear" && len(args) == 2:
+		delete(hl, strings.ToLower(args[1]))
+		return nil
+	}
+	h := hl.group(args[0])
+	// Checked on a copy, so an error leaves the group unchanged.
+	n := *h
+	n.link = ""
+	attrs := false
+	for _, arg := range args[1:] {
+		key, value, found := strings.Cut(arg, "=")
+		key = strings.ToLower(key)
+		if found {
+			c, err := parseColor(value)
+			if err != nil {
+				return err
+			}
+			switch key {
+			case "fg", "guifg", "ctermfg":
+				n.fg = c
+			case "bg", "guibg", "ctermbg":
+				n.bg = c
+			default:
+				return fmt.Errorf("unknown :hi key %s", key)
+			}
+			continue
+		}
+		if !attrs { // The attributes given replace the previous ones.
+			n.bold, n.italic, n.underline, n.reverse = false, false, false, false
+			attrs = true
+		}
+		switch key {
+		case "bold":
+			n.bold = true
+		case "italic":
+			n.italic = true
+		case "underline", "underlined":
+			n.underline = true
+		case "reverse", "inverse":
+			n.reverse = true
+		case "none":
+		default:
+			return fmt.Errorf("unknown :hi attribute %s", arg)
+		}
+	}
+	*h = n
+	return nil
+}
+
+// parseColorScheme returns the groups defined by a color scheme file: :hi commands, one per line,
+// "hi clear" removes the groups defined before. Blank lines and lines starting with " or # are
+// comments.
+func parseColorScheme(name string, data []byte) (highlights, error) {
+	hl := highlights{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '"' || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, ":"))
+		if len(fields) == 0 || fields[0] != "hi" && fields[0] != "highlight" {
+			return nil, fmt.Errorf("%s:%d: expected a :hi command", name, n)
+		}
+		if len(fields) == 2 && fields[1] == "clear" {
+			clear(hl)
+			continue
+		}
+		if err := hl.apply(fields[1:]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+	}
+	return hl, scanner.Err()
+}
+
+// builtinColorSchemes returns the names of the color schemes shipped with the editor.
+func builtinColorSchemes() []string {
+	files, _ := fs.Glob(builtinColors, "colors/*"+colorsExt)
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(f), colorsExt))
+	}
+	return names
+}
+
+// readColorScheme returns the content of the color scheme name: a file path, or a name looked up
+// in the user's config directory (~/.config/gvi/colors/name.colors) then the built-in ones.
+func readColorScheme(name string) ([]byte, error) {
+	if strings.ContainsRune(name, filepath.Separator) || strings.HasSuffix(name, colorsExt) {
+		return os.ReadFile(name)
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		if data, err := os.ReadFile(filepath.Join(dir, "gvi", "colors", name+colorsExt)); err == nil {
+			return data, nil
+		}
+	}
+	data, err := builtinColors.ReadFile("colors/" + name + colorsExt)
+	if err != nil {
+		return nil, fmt.Errorf("color scheme %s not found (built-in: %s)", name, strings.Join(builtinColorSchemes(), ", "))
+	}
+	return data, nil
+}
+
+// LoadColorScheme replaces the highlight groups with the ones of the color scheme name.
+func (v *Vi) LoadColorScheme(name string) error {
+	data, err := readColorScheme(name)
+	if err != nil {
+		return err
+	}
+	hl, err := parseColorScheme(name, data)
+	if err != nil {
+		return err
+	}
+	v.highlights, v.colorsName = hl, name
+	v.hlCache = nil
+	return nil
+}
+
+// detectColors returns the number of colors of the terminal from the environment: truecolor if
+// COLORTERM says so, 256 for the TERMs with 256color in their name, 16 otherwise.
+func detectColors() int {
+	switch ct := os.Getenv("COLORTERM"); {
+	case ct == "truecolor" || ct == "24bit":
+		return trueColors
+	case strings.Contains(os.Getenv("TERM"), "256color"):
+		return 256
+	default:
+		return 16
+	}
+}
+
+// setColors sets the number of colors of the terminal ('t_Co'): 8, 16, 256 or 16777216 (truecolor).
+func (v *Vi) setColors(n int) error {
+	if n != 8 && n != 16 && n != 256 && n != trueColors {
+		return fmt.Errorf("invalid number of colors %d (8, 16, 256 or %d)", n, trueColors)
+	}
+	v.colors = n
+	v.hlCache = nil
+	return nil
+}
+
+// hl returns the escape sequence setting the style of the highlight group (empty if it isn't
+// defined), with its colors converted to what the terminal supports.
+func (v *Vi) hl(group string) string {
+	if v.highlights == nil {
+		data, _ := builtinColors.ReadFile("colors/" + defaultColors + colorsExt)
+		hl, err := parseColorScheme(defaultColors, data)
+		if err != nil {
+			panic(err) // Checked by the tests.
+		}
+		v.highlights, v.colorsName = hl, defaultColors
+	}
+	key := strings.ToLower(group)
+	if s, ok := v.hlCache[key]; ok {
+		return s
+	}
+	var sb strings.Builder
+	if h := v.highlights.resolve(key); h != nil {
+		for _, a := range []struct {
+			on  bool
+			seq string
+		}{{h.bold, tcolor.Bold}, {h.italic, tcolor.Italic}, {h.underline, tcolor.Underlined}, {h.reverse, tcolor.Inverse}} {
+			if a.on {
+				sb.WriteString(a.seq)
+			}
+		}
+		if h.fg != 0 {
+			sb.WriteString(v.colorSeq(h.fg, false))
+		}
+		if h.bg != 0 {
+			sb.WriteString(v.colorSeq(h.bg, true))
+		}
+	}
+	if v.hlCache == nil {
+		v.hlCache = make(map[string]string)
+	}
+	v.hlCache[key] = sb.String()
+	return sb.String()
+}
+
+// hlText returns text in the style of group, drawn over the style base (an escape sequence, like
+// the status line's) which is restored after it.
+func (v *Vi) hlText(base, group, text string) string {
+	return v.hl(group) + text + tcolor.Reset + base
+}
+
+// colorSeq returns the escape sequence for the foreground (or background) color c, downgraded to
+// the nearest color the terminal has when it doesn't support c.
+func (v *Vi) colorSeq(c tcolor.Color, bg bool) string {
+	t, val := c.Decode()
+	switch {
+	case v.colors >= trueColors:
+	case v.colors >= 256:
+		if t == tcolor.ColorTypeRGB || t == tcolor.ColorTypeHSL {
+			c = tcolor.Color256(tcolor.RGBATo216(tcolor.ToRGB(t, val))).Color()
+		}
+	default:
+		if t != tcolor.ColorTypeBasic || val == tcolor.Uint30(tcolor.Orange) {
+			c = nearestBasic(colorRGB(c), max(8, min(v.colors, 16))).Color()
+		}
+	}
+	if bg {
+		return c.Background()
+	}
+	return c.Foreground()
+}
+
+// basicPalette are the (xterm default) values of the 16 basic colors, in terminal index order.
+var basicPalette = [16][3]uint8{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0}, {0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0}, {92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// cubeLevels are the component values of the 6x6x6 cube of the 256 colors.
+var cubeLevels = [6]uint8{0, 95, 135, 175, 215, 255}
+
+// paletteRGB returns the value of the basic color of terminal index i.
+func paletteRGB(i int) tcolor.RGBColor {
+	p := basicPalette[i]
+	return tcolor.RGBColor{R: p[0], G: p[1], B: p[2]}
+}
+
+// basicColor returns the BasicColor of the terminal index i (0-15).
+func basicColor(i int) tcolor.BasicColor {
+	if i < 8 {
+		return tcolor.Black + tcolor.BasicColor(i)
+	}
+	return tcolor.DarkGray + tcolor.BasicColor(i-8)
+}
+
+// colorRGB returns the RGB value of any color.
+func colorRGB(c tcolor.Color) tcolor.RGBColor {
+	t, val := c.Decode()
+	switch t {
+	case tcolor.ColorTypeBasic:
+		b := tcolor.BasicColor(val)
+		switch {
+		case b == tcolor.Orange:
+			return colorRGB(tcolor.Color256(214).Color())
+		case b >= tcolor.DarkGray:
+			return paletteRGB(int(8 + b - tcolor.DarkGray))
+		default:
+			return paletteRGB(int(b - tcolor.Black))
+		}
+	case tcolor.ColorType256:
+		i := int(val)
+		switch {
+		case i < 16:
+			return paletteRGB(i)
+		case i < 232: // 6x6x6 cube.
+			i -= 16
+			return tcolor.RGBColor{R: cubeLevels[i/36], G: cubeLevels[i/6%6], B: cubeLevels[i%6]}
+		default: // Grayscale.
+			g := uint8(8 + 10*(i-232))
+			return tcolor.RGBColor{R: g, G: g, B: g}
+		}
+	default:
+		return tcolor.ToRGB(t, val)
+	}
+}
+
+// nearestBasic returns the closest of the first n (8 or 16) basic colors to c.
+func nearestBasic(c tcolor.RGBColor, n int) tcolor.BasicColor {
+	best, bestDist := 0, -1
+	for i, p := range basicPalette[:n] {
+		dr, dg, db := int(c.R)-int(p[0]), int(c.G)-int(p[1]), int(c.B)-int(p[2])
+		if d := dr*dr + dg*dg + db*db; bestDist < 0 || d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return basicColor(best)
+}
+
+// highlightCommand handles :hi[ghlight], returns false if name isn't it.
+func (v *Vi) highlightCommand(name, arg string) bool {
+	if name != "hi" && name != "highlight" {
+		return false
+	}
+	v.hl("") // Loads the default scheme if needed.
+	fields := strings.Fields(arg)
+	switch {
+	case len(fields) == 0:
+		v.showHighlights()
+		return true
+	case len(fields) == 1 && fields[0] == "clear":
+		if err := v.LoadColorScheme(defaultColors); err != nil {
+			v.ShowError("Error", err)
+			return true
+		}
+	case len(fields) == 1:
+		h := v.highlights[strings.ToLower(fields[0])]
+		if h == nil {
+			v.ShowError("Error", fmt.Errorf("no highlight group %s", fields[0]))
+			return true
+		}
+		v.CmdResult("%s %s%s", h.name, v.hlText("", h.name, "xxx"), " "+h.String())
+		return true
+	default:
+		if err := v.highlights.apply(fields); err != nil {
+			v.ShowError("Error", err)
+			return true
+		}
+		v.hlCache = nil
+	}
+	v.cmdMode = NavMode
+	v.Update()
+	return true
+}
+
+// showHighlights lists the groups: name, sample and definition.
+func (v *Vi) showHighlights() {
+	keys := slices.Sorted(maps.Keys(v.highlights))
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		h := v.highlights[k]
+		lines = append(lines, h.name+" "+v.hlText("", h.name, "xxx")+" "+h.String())
+	}
+	v.showRendered(lines)
+}
+
+// colorschemeCommand handles :colo[rscheme] [name], returns false if name isn't it.
+func (v *Vi) colorschemeCommand(name, arg string) bool {
+	if name != "colo" && name != "colorscheme" {
+		return false
+	}
+	if arg == "" {
+		v.hl("") // Loads the default scheme if needed.
+		v.CmdResult("%s (built-in: %s)", v.colorsName, strings.Join(builtinColorSchemes(), ", "))
+		return true
+	}
+	if err := v.LoadColorScheme(arg); err != nil {
+		v.ShowError("Error", err)
+		return true
+	}
+	v.cmdMode = NavMode
+	v.Update()
+	return true
+}
@@ -0,0 +1,177 @@
+package vi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+func TestColorSchemes(t *testing.T) {
+	names := builtinColorSchemes()
+	if len(names) < 3 {
+		t.Fatalf("built-in color schemes: %v", names)
+	}
+	for _, name := range names {
+		v := &Vi{}
+		if err := v.LoadColorScheme(name); err != nil {
+			t.Errorf("color scheme %s: %v", name, err)
+			continue
+		}
+		for _, group := range []string{"StatusLine", "ModeNav", "Comment", "Keyword"} {
+			if v.highlights.resolve(group) == nil {
+				t.Errorf("color scheme %s doesn't define %s", name, group)
+			}
+		}
+	}
+	v := &Vi{}
+	if err := v.LoadColorScheme("nosuch"); err == nil || !strings.Contains(err.Error(), "default") {
+		t.Errorf("missing color scheme error: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "mine.colors")
+	if err := os.WriteFile(file, []byte("\" comment\nhi Comment fg=red\nhi Bad fg=nocolor\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.LoadColorScheme(file); err == nil || !strings.Contains(err.Error(), "mine.colors:3:") {
+		t.Errorf("invalid color scheme error: %v", err)
+	}
+	if v.colorsName != "" {
+		t.Errorf("invalid color scheme was loaded: %q", v.colorsName)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	v := &Vi{colors: trueColors}
+	if s := v.hl("comment"); s != tcolor.Cyan.Foreground() { // Default scheme, case insensitive.
+		t.Errorf("default Comment = %q", s)
+	}
+	tests := []struct {
+		args, expected string
+	}{
+		{"Comment fg=#ff8000 bold", "fg=#ff8000 bold"},
+		{"Comment bg=21 italic underline", "fg=#ff8000 bg=21 italic underline"},
+		{"Comment fg=none none", "bg=21"},
+		{"Comment fg=lightred bg=NONE reverse", "fg=brightred reverse"},
+		{"link Comment String", "links to String"},
+		{"New fg=c042", "fg=42"},
+	}
+	for _, test := range tests {
+		if err := v.highlights.apply(strings.Fields(test.args)); err != nil {
+			t.Errorf(":hi %s: %v", test.args, err)
+			continue
+		}
+		name := strings.Fields(test.args)[0]
+		if name == "link" {
+			name = "Comment"
+		}
+		if got := v.highlights[strings.ToLower(name)].String(); got != test.expected {
+			t.Errorf(":hi %s: got %q, expected %q", test.args, got, test.expected)
+		}
+	}
+	for _, args := range []string{"Comment fg=nocolor", "Comment bg=300", "Comment blink", "Comment size=3", "link Comment"} {
+		if err := v.highlights.apply(strings.Fields(args)); err == nil {
+			t.Errorf(":hi %s: no error", args)
+		}
+	}
+	if s := v.highlights["comment"].String(); s != "links to String" {
+		t.Errorf("Comment changed by errors: %s", s)
+	}
+	// Link loops resolve to nothing.
+	_ = v.highlights.apply([]string{"link", "A", "B"})
+	_ = v.highlights.apply([]string{"link", "B", "A"})
+	if h := v.highlights.resolve("A"); h != nil {
+		t.Errorf("link loop resolved to %v", h)
+	}
+}
+
+func TestColorDowngrade(t *testing.T) {
+	v := &Vi{}
+	_ = v.hl("") // Load the default scheme.
+	_ = v.highlights.apply(strings.Fields("Test fg=#ff8000 bg=250 bold"))
+	_ = v.highlights.apply(strings.Fields("Orange fg=orange"))
+	tests := []struct {
+		colors       int
+		test, orange string
+	}{
+		{trueColors, "\x1b[1m\x1b[38;2;255;128;0m\x1b[48;5;250m", "\x1b[38;5;214m"},
+		{256, "\x1b[1m\x1b[38;5;208m\x1b[48;5;250m", "\x1b[38;5;214m"},
+		{16, "\x1b[1m\x1b[33m\x1b[47m", "\x1b[33m"},
+		{8, "\x1b[1m\x1b[33m\x1b[47m", "\x1b[33m"},
+	}
+	for _, test := range tests {
+		if err := v.setColors(test.colors); err != nil {
+			t.Fatal(err)
+		}
+		if got := v.hl("Test"); got != test.test {
+			t.Errorf("%d colors: got %q, expected %q", test.colors, got, test.test)
+		}
+		if got := v.hl("Orange"); got != test.orange {
+			t.Errorf("%d colors orange: got %q, expected %q", test.colors, got, test.orange)
+		}
+	}
+	if err := v.setColors(17); err == nil {
+		t.Errorf("no error for 17 colors")
+	}
+	for _, c := range []struct {
+		rgb      tcolor.RGBColor
+		expected tcolor.BasicColor
+	}{
+		{tcolor.RGBColor{R: 10, G: 10, B: 10}, tcolor.Black},
+		{tcolor.RGBColor{R: 250, G: 250, B: 250}, tcolor.White},
+		{tcolor.RGBColor{R: 0, G: 180, B: 200}, tcolor.Cyan},
+		{tcolor.RGBColor{R: 90, G: 90, B: 250}, tcolor.BrightBlue},
+	} {
+		if got := nearestBasic(c.rgb, 16); got != c.expected {
+			t.Errorf("nearestBasic(%v) = %v, expected %v", c.rgb, got, c.expected)
+		}
+	}
+}
+
+func TestHighlightCommands(t *testing.T) {
+	term := NewVTerm(60, 10)
+	v := NewVi(term)
+	_ = v.setColors(256)
+	_ = v.UpdateRS()
+	statusRow := term.h - 2
+	if s := term.Style(0, statusRow); s != "\x1b[7m" {
+		t.Errorf("default status line style %q", s)
+	}
+	v.Process([]byte(":hi StatusLine fg=black bg=#00ff00\r"))
+	if s := term.Style(0, statusRow); s != "\x1b[7;30;48;5;46m" { // Still reverse.
+		t.Errorf("status line style after :hi %q", s)
+	}
+	v.Process([]byte(":hi StatusLine\r"))
+	if l := term.Line(term.h - 1); !strings.Contains(l, "StatusLine xxx fg=black bg=#00ff00") {
+		t.Errorf(":hi StatusLine shows %q", l)
+	}
+	v.Process([]byte(":colorscheme mono\r"))
+	if s := term.Style(0, statusRow); s != "\x1b[7m" || v.colorsName != "mono" {
+		t.Errorf("status line style with mono %q (%s)", s, v.colorsName)
+	}
+	v.Process([]byte(":colo\r"))
+	if l := term.Line(term.h - 1); !strings.HasPrefix(l, "mono (built-in: ") {
+		t.Errorf(":colo shows %q", l)
+	}
+	v.Process([]byte(":hi clear\r"))
+	if v.colorsName != defaultColors {
+		t.Errorf(":hi clear loaded %q", v.colorsName)
+	}
+	v.Process([]byte(":set t_Co=8\r"))
+	v.Process([]byte(":set tgc?\r"))
+	if l := term.Line(term.h - 1); l != "notermguicolors" || v.colors != 8 {
+		t.Errorf(":set tgc? shows %q (%d colors)", l, v.colors)
+	}
+	// The list is shown a page at a time.
+	v.Process([]byte(":hi\r"))
+	if s := term.String(); !strings.Contains(s, "Comment xxx fg=cyan") || !strings.Contains(s, "-- More --") {
+		t.Errorf(":hi shows\n%s", s)
+	}
+	for !strings.Contains(term.String(), "Title xxx fg=brightpurple bold") {
+		if !strings.Contains(term.String(), "-- More --") {
+			t.Fatalf(":hi last page\n%s", term.String())
+		}
+		v.Process([]byte(" "))
+	}
+}
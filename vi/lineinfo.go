@@ -0,0 +1,91 @@
+package vi
+
+import "sort"
+
+// lineIndexStep is the number of elements (grapheme clusters, tabs...) between two marks of a
+// line index.
+const lineIndexStep = 32
+
+// lineInfo is the cached screen layout of a buffer line: its width and a sparse index, the screen
+// position and byte offset of every lineIndexStep-th element, so finding a position in a long
+// line only scans from the closest mark. It is dropped when the line changes.
+type lineInfo struct {
+	width   int
+	marks   []lineMark
+	tabsGen int // Vi.tabsGen it was computed with: the tab stops and list mode change the width of tabs.
+}
+
+type lineMark struct {
+	col, offset int
+}
+
+// lineInfo returns the screen layout of a buffer line, computing it if it isn't cached.
+func (v *Vi) lineInfo(lineNum int) *lineInfo {
+	if info := v.buf.lineInfo(lineNum); info != nil && info.tabsGen == v.tabsGen {
+		v.lineCacheHits++
+		return info
+	}
+	v.lineCacheMisses++
+	info := &lineInfo{tabsGen: v.tabsGen}
+	n := 0
+	info.width = v.iterateGraphemes(v.buf.GetLine(lineNum), func(offset, _, prevScreenOffset, _ int) bool {
+		if n > 0 && n%lineIndexStep == 0 {
+			info.marks = append(info.marks, lineMark{col: prevScreenOffset, offset: offset})
+		}
+		n++
+		return false
+	})
+	v.buf.setLineInfo(lineNum, info)
+	return info
+}
+
+// markAtCol returns the last mark at or before the screen position x.
+func (info *lineInfo) markAtCol(x int) lineMark {
+	i := sort.Search(len(info.marks), func(i int) bool { return info.marks[i].col > x })
+	if i == 0 {
+		return lineMark{}
+	}
+	return info.marks[i-1]
+}
+
+// markAtOffset returns the last mark at or before the byte offset.
+func (info *lineInfo) markAtOffset(offset int) lineMark {
+	i := sort.Search(len(info.marks), func(i int) bool { return info.marks[i].offset > offset })
+	if i == 0 {
+		return lineMark{}
+	}
+	return info.marks[i-1]
+}
+
+// lineWidth returns the screen width of a buffer line.
+func (v *Vi) lineWidth(lineNum int) int {
+	return v.lineInfo(lineNum).width
+}
+
+// lineAtToByte is ScreenAtToRune for the buffer line lineNum, using its cached layout.
+func (v *Vi) lineAtToByte(lineNum, x int) int {
+	if x == 0 {
+		return 0
+	}
+	info := v.lineInfo(lineNum)
+	line := v.buf.GetLine(lineNum)
+	if x >= info.width {
+		return len(line) + x - info.width // At the end, or the padding needed after it.
+	}
+	m := info.markAtCol(x)
+	return v.screenAtFrom(x, line, m.offset, m.col)
+}
+
+// lineCol returns the screen position of the byte offset of the buffer line lineNum (the width of
+// what is before it), using its cached layout.
+func (v *Vi) lineCol(lineNum, offset int) int {
+	info := v.lineInfo(lineNum)
+	line := v.buf.GetLine(lineNum)
+	if offset >= len(line) {
+		return info.width
+	}
+	m := info.markAtOffset(offset)
+	return v.iterateGraphemesFrom(line[:offset], m.offset, m.col, func(_, _, _, _ int) bool {
+		return false
+	})
+}
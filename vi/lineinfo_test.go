@@ -0,0 +1,55 @@
+package vi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineInfo(t *testing.T) {
+	v := &Vi{buf: &Buffer{}}
+	// Long enough for several index marks, with tabs, wide characters, emojis and an invalid byte.
+	line := strings.Repeat("ab\t日本👩‍🚀x\xffé", 20)
+	v.buf.InsertLine(0, "before")
+	v.buf.InsertLine(1, line)
+	width := v.ScreenWidth(line)
+	if w := v.lineWidth(1); w != width {
+		t.Fatalf("lineWidth = %d, expected %d", w, width)
+	}
+	if len(v.buf.lineInfo(1).marks) == 0 {
+		t.Errorf("no index marks for a %d bytes line", len(line))
+	}
+	for x := range width + 3 {
+		if got, expected := v.lineAtToByte(1, x), v.ScreenAtToRune(x, line); got != expected {
+			t.Errorf("lineAtToByte(%d) = %d, expected %d", x, got, expected)
+		}
+	}
+	v.iterateGraphemes(line, func(offset, _, _, _ int) bool {
+		if got, expected := v.lineCol(1, offset), v.ScreenWidth(line[:offset]); got != expected {
+			t.Errorf("lineCol(%d) = %d, expected %d", offset, got, expected)
+		}
+		return false
+	})
+	if v.lineCacheMisses != 1 {
+		t.Errorf("%d misses for one line, expected 1", v.lineCacheMisses)
+	}
+	// Edits invalidate the line, inserting and deleting lines move the cached layouts along.
+	v.buf.InsertAt(1, 0, "日")
+	if w := v.lineWidth(1); w != width+2 || v.lineCacheMisses != 2 {
+		t.Errorf("lineWidth after edit = %d (%d misses), expected %d", w, v.lineCacheMisses, width+2)
+	}
+	v.buf.InsertLine(0, "new")
+	v.buf.DeleteLine(1)
+	if w := v.lineWidth(1); w != width+2 || v.lineCacheMisses != 2 {
+		t.Errorf("lineWidth after moving = %d (%d misses), expected %d", w, v.lineCacheMisses, width+2)
+	}
+	if w := v.lineWidth(0); w != 3 || v.lineCacheMisses != 3 {
+		t.Errorf("lineWidth of the new line = %d (%d misses), expected 3", w, v.lineCacheMisses)
+	}
+	// Changing the tab stops invalidates all the lines.
+	v.tabs = []int{3}
+	v.tabsGen++
+	expected := v.ScreenWidth(v.buf.GetLine(1))
+	if w := v.lineWidth(1); w != expected || v.lineCacheMisses != 4 {
+		t.Errorf("lineWidth with other tabs = %d (%d misses), expected %d", w, v.lineCacheMisses, expected)
+	}
+}
@@ -0,0 +1,112 @@
+package vi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+// defaultListChars is the default 'listchars'.
+const defaultListChars = "tab:» ,trail:·,nbsp:␣,eol:$,extends:>"
+
+// listChars are the characters showing whitespace in list mode, parsed from 'listchars'. Empty
+// ones aren't shown.
+type listChars struct {
+	tab      [3]string // First, fill and optional last characters of tabs, ^I when not set.
+	trail    string    // Trailing spaces.
+	nbsp     string    // Non-breaking spaces.
+	eol      string    // After the end of the lines.
+	extends  string    // Last column of the lines that continue past the window.
+	precedes string    // First column of the lines scrolled horizontally (lines aren't, for now).
+}
+
+// parseListChars parses a 'listchars' value: comma separated name:chars, each char one screen
+// column wide.
+func parseListChars(value string) (listChars, error) {
+	var lcs listChars
+	if value == "" {
+		return lcs, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		name, val, ok := strings.Cut(item, ":")
+		var chars []string
+		for g := uniseg.NewGraphemes(val); g.Next(); {
+			if uniseg.StringWidth(g.Str()) != 1 {
+				return listChars{}, fmt.Errorf("listchars: %q isn't one column wide in %s", g.Str(), item)
+			}
+			chars = append(chars, g.Str())
+		}
+		n := len(chars)
+		switch {
+		case !ok:
+			return listChars{}, fmt.Errorf("listchars: missing : in %q", item)
+		case name == "tab" && (n == 2 || n == 3):
+			copy(lcs.tab[:], chars)
+		case name == "tab":
+			return listChars{}, fmt.Errorf("listchars: tab needs 2 or 3 characters, got %q", val)
+		case n != 1:
+			return listChars{}, fmt.Errorf("listchars: %s needs 1 character, got %q", name, val)
+		case name == "trail":
+			lcs.trail = chars[0]
+		case name == "nbsp":
+			lcs.nbsp = chars[0]
+		case name == "eol":
+			lcs.eol = chars[0]
+		case name == "extends":
+			lcs.extends = chars[0]
+		case name == "precedes":
+			lcs.precedes = chars[0]
+		default:
+			return listChars{}, fmt.Errorf("listchars: unknown item %s", name)
+		}
+	}
+	return lcs, nil
+}
+
+// tabString returns how a tab width columns wide is shown in list mode: tab:xy as xyyy, tab:xyz
+// as xyyz (z only when it's one column).
+func (lcs *listChars) tabString(width int) string {
+	if lcs.tab[2] == "" {
+		return lcs.tab[0] + strings.Repeat(lcs.tab[1], width-1)
+	}
+	if width == 1 {
+		return lcs.tab[2]
+	}
+	return lcs.tab[0] + strings.Repeat(lcs.tab[1], width-2) + lcs.tab[2]
+}
+
+// isNbsp returns true for the non-breaking spaces shown with the nbsp of 'listchars'.
+func isNbsp(cluster string) bool {
+	return cluster == "\u00a0" || cluster == "\u202f"
+}
+
+// setList turns list mode on or off.
+func (v *Vi) setList(on bool) {
+	v.relayout(func() { v.list = on })
+}
+
+// setListChars sets the 'listchars' option.
+func (v *Vi) setListChars(value string) error {
+	lcs, err := parseListChars(value)
+	if err != nil {
+		return err
+	}
+	if !v.list {
+		v.listChars, v.lcs = value, lcs
+		return nil
+	}
+	v.relayout(func() { v.listChars, v.lcs = value, lcs })
+	return nil
+}
+
+// relayout makes a change of the width of tabs, keeping the cursor on the same character, and
+// redraws everything.
+func (v *Vi) relayout(change func()) {
+	lineNum := v.BufferLineNumber()
+	offset := v.lineAtToByte(lineNum, v.cx)
+	change()
+	v.tabsGen++
+	v.cx = min(v.lineCol(lineNum, offset), v.win.w-1)
+	v.Update()
+}
@@ -0,0 +1,104 @@
+package vi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseListChars(t *testing.T) {
+	lcs, err := parseListChars(defaultListChars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := listChars{tab: [3]string{"»", " "}, trail: "·", nbsp: "␣", eol: "$", extends: ">"}
+	if lcs != expected {
+		t.Errorf("default listchars %+v", lcs)
+	}
+	lcs, err = parseListChars("tab:<->,precedes:<")
+	if err != nil || lcs.tabString(1) != ">" || lcs.tabString(2) != "<>" || lcs.tabString(5) != "<--->" || lcs.precedes != "<" {
+		t.Errorf("tab:<-> %q %q %q (%v)", lcs.tabString(1), lcs.tabString(2), lcs.tabString(5), err)
+	}
+	for _, value := range []string{"tab:>", "tab:>--x", "eol", "eol:", "eol:$$", "trail:日", "space:.", ","} {
+		if _, err := parseListChars(value); err == nil {
+			t.Errorf("parseListChars(%q): no error", value)
+		}
+	}
+}
+
+func TestSpecialChars(t *testing.T) {
+	v := &Vi{}
+	tests := []struct {
+		str, shown string
+	}{
+		{"a\x01b", "a^Ab"},
+		{"\x1b[0m\x7f", "^[[0m^?"},
+		{"zero\u200bwidth\ufeff", "zero<U+200B>width<U+FEFF>"},
+		{"e\u0301", "e\u0301"}, // Combining characters stay with their base.
+		{"\u0085", "<U+0085>"},
+	}
+	for _, test := range tests {
+		if got := v.DisplayString(test.str, 80); got != test.shown {
+			t.Errorf("DisplayString(%q) = %q, expected %q", test.str, got, test.shown)
+		}
+		if w := v.ScreenWidth(test.str); w != len([]rune(test.shown))-strings.Count(test.shown, "\u0301") {
+			t.Errorf("ScreenWidth(%q) = %d for %q", test.str, w, test.shown)
+		}
+	}
+	if x := v.ScreenAtToRune(3, "a\u200bb"); x != 4 { // In the middle of <U+200B>: after it.
+		t.Errorf("ScreenAtToRune(3) = %d", x)
+	}
+}
+
+func TestListMode(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "list.txt")
+	content := "\tx \u00a0y  \n" + strings.Repeat("0123456789", 3) + "\nab\x02\u200bc\n"
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	term := NewVTerm(20, 8)
+	v := NewVi(term)
+	v.Open(file)
+	_ = v.UpdateRS()
+	if l := term.Line(0); l != "        x \u00a0y" {
+		t.Errorf("line without list %q", l)
+	}
+	if l := term.Line(2); l != "ab^B<U+200B>c" {
+		t.Errorf("special characters %q", l)
+	}
+	if s := term.Style(2, 2); s != "\x1b[34m" {
+		t.Errorf("SpecialKey style %q", s)
+	}
+	v.Process([]byte("$"))
+	x := v.cx
+	v.Process([]byte(":set list\r"))
+	if v.cx != x {
+		t.Errorf("cursor moved from %d to %d with the same tab width", x, v.cx)
+	}
+	lines := []string{"»       x ␣y··$", "0123456789012345678>", "ab^B<U+200B>c$"}
+	for i, expected := range lines {
+		if l := term.Line(i); l != expected {
+			t.Errorf("list line %d %q, expected %q", i, l, expected)
+		}
+	}
+	if s := term.Style(0, 0); s != "\x1b[34m" {
+		t.Errorf("Whitespace style %q", s)
+	}
+	// Without tab in 'listchars' tabs are ^I: the cursor stays on the same character.
+	v.Process([]byte(`:set lcs=eol:$,trail:-` + "\r"))
+	if l := term.Line(0); l != "^Ix \u00a0y--$" || v.cx != x-6 {
+		t.Errorf("list without tab %q, cursor at %d", l, v.cx)
+	}
+	if l := term.Line(1); l != strings.Repeat("0123456789", 2) {
+		t.Errorf("list without extends %q", l)
+	}
+	v.Process([]byte(":set lcs=tab:x\r"))
+	if l := term.Line(term.h - 1); !strings.HasSuffix(l, `got "x"`) || v.listChars != "eol:$,trail:-" {
+		t.Errorf(":set lcs=tab:x shows %q (%q)", l, v.listChars)
+	}
+	v.Process([]byte(":set nolist\r"))
+	if l := term.Line(0); l != "        x \u00a0y" || v.cx != x {
+		t.Errorf("after nolist %q, cursor at %d", l, v.cx)
+	}
+}
@@ -0,0 +1,261 @@
+package vi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// option is a setting that can be changed and queried with :set.
+// Boolean options use getBool/setBool, the others get/set.
+type option struct {
+	names   []string // Full name first, then abbreviations.
+	getBool func(v *Vi) bool
+	setBool func(v *Vi, on bool) error
+	get     func(v *Vi) string
+	set     func(v *Vi, value string) error
+}
+
+func (o *option) isBool() bool {
+	return o.getBool != nil
+}
+
+func (o *option) value(v *Vi) string {
+	if !o.isBool() {
+		return o.names[0] + "=" + o.get(v)
+	}
+	if o.getBool(v) {
+		return o.names[0]
+	}
+	return "no" + o.names[0]
+}
+
+var options = []*option{
+	{
+		names: []string{"fileformat", "ff"},
+		get:   func(v *Vi) string { return v.buf.FileFormat().String() },
+		set: func(v *Vi, value string) error {
+			ff, err := ParseFileFormat(value)
+			if err == nil {
+				v.buf.SetFileFormat(ff)
+			}
+			return err
+		},
+	},
+	{
+		names: []string{"fileencoding", "fenc"},
+		get:   func(v *Vi) string { return v.buf.Encoding() },
+		set:   func(v *Vi, value string) error { return v.buf.SetEncoding(value) },
+	},
+	{
+		names: []string{"filetype", "ft"},
+		get:   func(v *Vi) string { return v.buf.FileType() },
+		set: func(v *Vi, value string) error {
+			err := v.buf.SetFileType(value)
+			if err == nil {
+				v.drawWindow(v.win)
+			}
+			return err
+		},
+	},
+	{
+		names:   []string{"endofline", "eol"},
+		getBool: func(v *Vi) bool { return v.buf.EOL() },
+		setBool: func(v *Vi, on bool) error { v.buf.SetEOL(on); return nil },
+	},
+	{
+		names:   []string{"fixendofline", "fixeol"},
+		getBool: func(v *Vi) bool { return v.buf.FixEOL() },
+		setBool: func(v *Vi, on bool) error { v.buf.SetFixEOL(on); return nil },
+	},
+	{
+		names:   []string{"binary", "bin"},
+		getBool: func(v *Vi) bool { return v.buf.Binary() },
+		setBool: func(v *Vi, on bool) error { v.buf.SetBinary(on); return nil },
+	},
+	{
+		names:   []string{"bomb"},
+		getBool: func(v *Vi) bool { return v.buf.BOM() },
+		setBool: func(v *Vi, on bool) error { v.buf.SetBOM(on); return nil },
+	},
+	{
+		names:   []string{"readonly", "ro"},
+		getBool: func(v *Vi) bool { return v.buf.ReadOnly() },
+		setBool: func(v *Vi, on bool) error { v.buf.SetReadOnly(on); return nil },
+	},
+	{
+		names:   []string{"list"},
+		getBool: func(v *Vi) bool { return v.list },
+		setBool: func(v *Vi, on bool) error { v.setList(on); return nil },
+	},
+	{
+		names: []string{"listchars", "lcs"},
+		get:   func(v *Vi) string { return v.listChars },
+		set:   func(v *Vi, value string) error { return v.setListChars(value) },
+	},
+	{
+		names:   []string{"cursorline", "cul"},
+		getBool: func(v *Vi) bool { return v.cursorLine },
+		setBool: func(v *Vi, on bool) error { v.cursorLine = on; return nil },
+	},
+	{
+		names:   []string{"cursorcolumn", "cuc"},
+		getBool: func(v *Vi) bool { return v.cursorColumn },
+		setBool: func(v *Vi, on bool) error { v.cursorColumn = on; return nil },
+	},
+	{
+		names: []string{"colorcolumn", "cc"},
+		get:   func(v *Vi) string { return v.colorColumn },
+		set:   func(v *Vi, value string) error { return v.setColorColumn(value) },
+	},
+	{
+		names:   []string{"trailingspace", "tsp"},
+		getBool: func(v *Vi) bool { return v.trailingSpace },
+		setBool: func(v *Vi, on bool) error { v.trailingSpace = on; return nil },
+	},
+	{
+		names: []string{"statusline", "stl"},
+		get:   func(v *Vi) string { return v.statusLine },
+		set:   func(v *Vi, value string) error { return v.setStatusLine(value) },
+	},
+	{
+		names: []string{"t_Co"},
+		get:   func(v *Vi) string { return strconv.Itoa(v.colors) },
+		set: func(v *Vi, value string) error {
+			n, err := strconv.Atoi(value)
+			if err == nil {
+				err = v.setColors(n)
+			}
+			if err == nil {
+				v.Update()
+			}
+			return err
+		},
+	},
+	{
+		names:   []string{"termguicolors", "tgc"},
+		getBool: func(v *Vi) bool { return v.colors == trueColors },
+		setBool: func(v *Vi, on bool) error {
+			n := min(v.colors, 256)
+			if on {
+				n = trueColors
+			}
+			if err := v.setColors(n); err != nil {
+				return err
+			}
+			v.Update()
+			return nil
+		},
+	},
+	{
+		names:   []string{"hidden", "hid"},
+		getBool: func(v *Vi) bool { return v.hidden },
+		setBool: func(v *Vi, on bool) error { v.hidden = on; return nil },
+	},
+}
+
+// optionNames indexes the options by name and abbreviation. Built in init as options refer (through
+// the statusline evaluation) to findOption.
+var optionNames map[string]*option
+
+func init() {
+	optionNames = make(map[string]*option)
+	for _, o := range options {
+		for _, n := range o.names {
+			optionNames[n] = o
+		}
+	}
+}
+
+func findOption(name string) *option {
+	return optionNames[name]
+}
+
+// setOption handles one :set argument: name, noname, invname, name!, name?, name=value.
+// Returns the text to show (for queries) if any.
+func (v *Vi) setOption(arg string) (string, error) {
+	if name, value, found := strings.Cut(arg, "="); found {
+		o := findOption(name)
+		if o == nil {
+			return "", fmt.Errorf("unknown option: %s", name)
+		}
+		if o.isBool() {
+			return "", fmt.Errorf("invalid argument: %s", arg)
+		}
+		return "", o.set(v, value)
+	}
+	if name, found := strings.CutSuffix(arg, "?"); found {
+		o := findOption(name)
+		if o == nil {
+			return "", fmt.Errorf("unknown option: %s", name)
+		}
+		return o.value(v), nil
+	}
+	if o := findOption(arg); o != nil {
+		if !o.isBool() {
+			return o.value(v), nil
+		}
+		return "", o.setBool(v, true)
+	}
+	toggle := false
+	name, found := strings.CutPrefix(arg, "no")
+	if !found {
+		if name, found = strings.CutPrefix(arg, "inv"); !found {
+			name, found = strings.CutSuffix(arg, "!")
+		}
+		toggle = found
+	}
+	o := findOption(name)
+	if !found || o == nil {
+		return "", fmt.Errorf("unknown option: %s", arg)
+	}
+	if !o.isBool() {
+		return "", fmt.Errorf("invalid argument: %s", arg)
+	}
+	return "", o.setBool(v, toggle && !o.getBool(v))
+}
+
+// splitSetArgs splits the :set arguments on spaces, except the ones escaped with a backslash
+// (\\ is a backslash).
+func splitSetArgs(args string) []string {
+	var fields []string
+	var sb strings.Builder
+	for i := 0; i < len(args); i++ {
+		switch c := args[i]; {
+		case c == '\\' && i+1 < len(args) && (args[i+1] == ' ' || args[i+1] == '\\'):
+			i++
+			sb.WriteByte(args[i])
+		case c == ' ' || c == '\t':
+			if sb.Len() > 0 {
+				fields = append(fields, sb.String())
+				sb.Reset()
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if sb.Len() > 0 {
+		fields = append(fields, sb.String())
+	}
+	return fields
+}
+
+// Set implements :set with space separated arguments (spaces in values are escaped with a backslash).
+func (v *Vi) Set(args string) (string, error) {
+	fields := splitSetArgs(args)
+	if len(fields) == 0 {
+		return "", errors.New("usage: :set option[=value] ...")
+	}
+	var shown []string
+	for _, arg := range fields {
+		msg, err := v.setOption(arg)
+		if err != nil {
+			return strings.Join(shown, " "), err
+		}
+		if msg != "" {
+			shown = append(shown, msg)
+		}
+	}
+	return strings.Join(shown, " "), nil
+}
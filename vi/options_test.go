@@ -0,0 +1,36 @@
+package vi
+
+import "testing"
+
+func TestSetOptions(t *testing.T) {
+	v := &Vi{buf: &Buffer{}}
+	tests := []struct {
+		args     string
+		expected string
+		err      bool
+	}{
+		{"ff?", "fileformat=unix", false},
+		{"ff=dos", "", false},
+		{"fileformat", "fileformat=dos", false},
+		{"noeol eol?", "noendofline", false},
+		{"eol! eol?", "endofline", false},
+		{"invbomb bomb? nofixeol fixeol?", "bomb nofixendofline", false},
+		{"ff=foo", "", true},
+		{"nosuchoption", "", true},
+		{"ff!", "", true},
+		{"bomb=1", "", true},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		res, err := v.Set(test.args)
+		if (err != nil) != test.err {
+			t.Errorf("Set(%q) error %v, expected error %t", test.args, err, test.err)
+		}
+		if res != test.expected {
+			t.Errorf("Set(%q) = %q, expected %q", test.args, res, test.expected)
+		}
+	}
+	if info := v.buf.FormatInfo(); info != "dos,bom" {
+		t.Errorf("FormatInfo %q, expected %q", info, "dos,bom")
+	}
+}
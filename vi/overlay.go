@@ -0,0 +1,91 @@
+package vi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseColorColumn parses a 'colorcolumn' value: comma separated screen columns, 1 for the first.
+func parseColorColumn(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var cols []int
+	for _, s := range strings.Split(value, ",") {
+		c, err := strconv.Atoi(s)
+		if err != nil || c < 1 || s[0] == '+' {
+			return nil, fmt.Errorf("colorcolumn: invalid column %q", s)
+		}
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+// setColorColumn sets the 'colorcolumn' option.
+func (v *Vi) setColorColumn(value string) error {
+	cols, err := parseColorColumn(value)
+	if err != nil {
+		return err
+	}
+	v.colorColumn, v.colorColumns = value, cols
+	return nil
+}
+
+// overlays returns the highlights the renderer adds to the frame: the color columns and trailing
+// whitespace of the windows, the cursor line and column of the current one. They aren't drawn so
+// moving the cursor doesn't redraw the window, only the cells they leave and cover are sent.
+func (v *Vi) overlays() []overlay {
+	if v.covered || v.tab == nil {
+		return nil
+	}
+	var res []overlay
+	for _, w := range v.windows() {
+		offset := w.offset
+		if w == v.win {
+			offset = v.offset
+		}
+		// Offsets are never before the first line, but don't look such lines up if one was.
+		offset = max(0, offset)
+		n := max(0, min(w.h, w.e.buf.NumLines()-offset)) // Rows with text.
+		for _, c := range v.colorColumns {
+			if c <= w.w {
+				res = append(res, overlay{w.x + c - 1, w.y, w.x + c, w.y + n, v.hl("ColorColumn")})
+			}
+		}
+		if v.trailingSpace {
+			res = v.trailingOverlays(res, w, offset, n)
+		}
+	}
+	x, y := v.win.x+min(v.cx, v.win.w-1), v.win.y+v.cy
+	if v.cursorColumn {
+		n := max(1, min(v.win.h, v.buf.NumLines()-max(0, v.offset)))
+		res = append(res, overlay{x, v.win.y, x + 1, v.win.y + n, v.hl("CursorColumn")})
+	}
+	if v.cursorLine {
+		res = append(res, overlay{v.win.x, y, v.win.x + v.win.w, y + 1, v.hl("CursorLine")})
+	}
+	return res
+}
+
+// trailingOverlays adds to res the trailing whitespace of the n first rows of w, showing the lines
+// from offset. Not the cursor line's when inserting: it's where the text is typed.
+func (v *Vi) trailingOverlays(res []overlay, w *window, offset, n int) []overlay {
+	inserting := w == v.win && (v.cmdMode == InsertMode || v.cmdMode == AppendMode)
+	for i, line := range w.e.buf.GetLines(offset, n) {
+		end := len(strings.TrimRight(line, " \t"))
+		if end == len(line) || (inserting && i == v.cy) {
+			continue
+		}
+		var start, width int
+		if w == v.win {
+			start, width = v.lineCol(offset+i, end), v.lineWidth(offset+i) // Cached layout.
+		} else {
+			start, width = v.ScreenWidth(line[:end]), v.ScreenWidth(line)
+		}
+		if start < w.w {
+			res = append(res, overlay{w.x + start, w.y + i, w.x + min(width, w.w), w.y + i + 1, v.hl("ExtraWhitespace")})
+		}
+	}
+	return res
+}
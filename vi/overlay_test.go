@@ -0,0 +1,110 @@
+package vi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseColorColumn(t *testing.T) {
+	cols, err := parseColorColumn("80,120")
+	if err != nil || len(cols) != 2 || cols[0] != 80 || cols[1] != 120 {
+		t.Errorf("parseColorColumn(80,120) = %v, %v", cols, err)
+	}
+	for _, value := range []string{"0", "x", "80,", "+1"} {
+		if _, err := parseColorColumn(value); err == nil {
+			t.Errorf("parseColorColumn(%q): no error", value)
+		}
+	}
+}
+
+func TestOverlays(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "guides.txt")
+	if err := os.WriteFile(file, []byte("日本語 text  \nab\t \nlast\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	term := NewVTerm(30, 8)
+	v := NewVi(term)
+	v.Open(file)
+	_ = v.UpdateRS()
+	_ = v.setColors(16)
+	v.Process([]byte(":set cc=4,40 cul tsp\r"))
+	// The styles as the terminal merges them.
+	sgr := func(styles ...string) string {
+		t := NewVTerm(1, 1)
+		for _, s := range styles {
+			t.WriteString(s)
+		}
+		t.WriteString("x")
+		return t.Style(0, 0)
+	}
+	cc, cul, ws := v.hl("ColorColumn"), v.hl("CursorLine"), v.hl("ExtraWhitespace")
+	tests := []struct {
+		x, y  int
+		style string
+	}{
+		{2, 0, sgr(cc, cul)}, // 語 crosses column 4 (x=3): both halves.
+		{3, 0, sgr(cc, cul)},
+		{0, 0, sgr(cul)},
+		{11, 0, sgr(ws, cul)}, // Trailing spaces.
+		{20, 0, sgr(cul)},     // Past the end of the line.
+		{1, 1, ""},
+		{2, 1, sgr(ws)}, // The trailing tab from x=2 to 8, one cell per column.
+		{3, 1, sgr(cc, ws)},
+		{8, 1, sgr(ws)},
+		{3, 3, ""}, // No color column after the end of the buffer.
+	}
+	for _, test := range tests {
+		if s := term.Style(test.x, test.y); s != test.style {
+			t.Errorf("style at %d,%d %q, expected %q", test.x, test.y, s, test.style)
+		}
+	}
+	// Moving the cursor moves the overlays without redrawing.
+	refresh := v.fullRefresh
+	v.Process([]byte(":set cuc cc=\r"))
+	v.Process([]byte("jl"))
+	if v.fullRefresh != refresh {
+		t.Errorf("moving the cursor refreshed the screen")
+	}
+	cuc := v.hl("CursorColumn")
+	if s := term.Style(0, 0) + "|" + term.Style(1, 1) + "|" + term.Style(1, 2); s != sgr(cuc)+"|"+sgr(cuc, cul)+"|"+sgr(cuc) { // 日 crosses the column.
+		t.Errorf("styles after moving %q", s)
+	}
+	// Not the trailing whitespace being typed.
+	v.Process([]byte("A "))
+	if s := term.Style(9, 1); s != sgr(cul) {
+		t.Errorf("trailing space being typed style %q", s)
+	}
+	v.Process([]byte("\x1b"))
+	if s := term.Style(9, 1); s != sgr(ws, cul) {
+		t.Errorf("trailing space after insert style %q", s)
+	}
+	// Not over text shown over the windows.
+	v.Process([]byte(":hi\r"))
+	if s := term.Style(1, 1); s != "" {
+		t.Errorf("overlay shown over :hi %q", s)
+	}
+	v.Process([]byte("q"))
+	if s := term.Style(1, 1); s != sgr(cul) {
+		t.Errorf("cursor line after :hi %q", s)
+	}
+}
+
+func TestOverlaysShortBuffer(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "short.txt")
+	if err := os.WriteFile(file, []byte("a  \nb\nc \nd\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	term := NewVTerm(20, 12)
+	v := NewVi(term)
+	v.Open(file)
+	_ = v.UpdateRS()
+	v.Process([]byte(":set tsp cul cuc\r\x06")) // Ctrl-F: a page down, more than the buffer.
+	if v.offset != 0 || v.BufferLineNumber() != 3 {
+		t.Errorf("Ctrl-F on a short buffer: offset %d, line %d", v.offset, v.BufferLineNumber())
+	}
+	v.Process([]byte("\x02\x06k"))
+	if l := term.Line(0); l != "a" {
+		t.Errorf("first line %q", l)
+	}
+}
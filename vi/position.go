@@ -1,12 +1,54 @@
 package vi
 
 import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
 	"fortio.org/log"
 	"github.com/rivo/uniseg"
 )
 
+// invalidByteWidth is the screen width of an invalid UTF-8 byte, shown as <xx>.
+const invalidByteWidth = 4
+
+// invalidByte returns true if str[offset] starts an invalid UTF-8 sequence (and is thus displayed as <xx>).
+func invalidByte(str string, offset int) bool {
+	if str[offset] < utf8.RuneSelf {
+		return false
+	}
+	r, size := utf8.DecodeRuneInString(str[offset:])
+	return r == utf8.RuneError && size == 1
+}
+
+// specialString returns how a control or zero width character (grapheme cluster) is shown:
+// ^X for ASCII controls, <U+200B> for the others, each rune escaped.
+func specialString(cluster string) string {
+	var sb strings.Builder
+	for _, r := range cluster {
+		switch {
+		case r < ' ':
+			sb.WriteString("^" + string(rune('@'+r)))
+		case r == 0x7f:
+			sb.WriteString("^?")
+		default:
+			fmt.Fprintf(&sb, "<U+%04X>", r)
+		}
+	}
+	return sb.String()
+}
+
+// isSpecial returns true if the grapheme cluster is a control or zero width character, shown with
+// specialString.
+func isSpecial(cluster string) bool {
+	if c := cluster[0]; c < utf8.RuneSelf {
+		return (c < ' ' && c != '\t') || c == 0x7f
+	}
+	return uniseg.StringWidth(cluster) == 0
+}
+
 // iterateGraphemes iterates through a string, calling the provided function for each
-// grapheme cluster, tab, or control character. The callback function receives:
+// grapheme cluster, tab, control character or invalid byte. The callback function receives:
 // - offset: byte offset in the string where this element starts
 // - screenOffset: cumulative screen width up to and including this element
 // - prevScreenOffset: screen width before this element was processed
@@ -15,24 +57,43 @@ import (
 // If the callback returns true, iteration stops early and the current screenOffset is returned.
 // If iteration completes normally, returns the total screen width of the string.
 func (v *Vi) iterateGraphemes(str string, fn func(offset, screenOffset, prevScreenOffset, consumed int) bool) int {
-	screenOffset := 0
-	offset := 0
+	return v.iterateGraphemesFrom(str, 0, 0, fn)
+}
+
+// iterateGraphemesFrom is iterateGraphemes starting at the byte offset of str, which must be the
+// start of an element, at the screen position screenOffset.
+func (v *Vi) iterateGraphemesFrom(str string, offset, screenOffset int,
+	fn func(offset, screenOffset, prevScreenOffset, consumed int) bool,
+) int {
 	state := -1 // Initial state for grapheme cluster iteration
 
 	for offset < len(str) {
 		prevScreenOffset := screenOffset
 		var consumed int
 		// Handle tab characters specially (tabs need custom width calculation)
-		if str[offset] == '\t' {
+		switch {
+		case str[offset] == '\t' && v.list && v.lcs.tab[0] == "":
+			screenOffset += 2 // ^I in list mode without tab in 'listchars'.
+			consumed = 1
+			state = -1
+		case str[offset] == '\t':
 			screenOffset = v.NextTab(screenOffset)
 			width := screenOffset - prevScreenOffset
 			log.LogVf("iterateGraphemes: offset=%d, for tab, screenOffset=%d, width=%d", offset, screenOffset, width)
 			consumed = 1 // Tab is always 1 byte
 			state = -1   // Reset state after tab character
-		} else {
-			// Handle all characters (including control chars) with uniseg
+		case invalidByte(str, offset):
+			screenOffset += invalidByteWidth
+			log.LogVf("iterateGraphemes: offset=%d, invalid byte %x, screenOffset=%d", offset, str[offset], screenOffset)
+			consumed = 1
+			state = -1
+		default:
+			// Handle all characters with uniseg, control and zero width ones are shown escaped.
 			cluster, _, width, newState := uniseg.FirstGraphemeClusterInString(str[offset:], state)
 			state = newState
+			if width == 0 {
+				width = len(specialString(cluster))
+			}
 			screenOffset += width
 			log.LogVf("iterateGraphemes: offset=%d, cluster=%q, screenOffset=%d, width=%d", offset, cluster, screenOffset, width)
 			consumed = len(cluster) // Length of the grapheme cluster in bytes
@@ -58,9 +119,14 @@ func (v *Vi) ScreenAtToRune(x int, str string) int {
 	if len(str) == 0 {
 		return x // No content, return x as the offset
 	}
+	return v.screenAtFrom(x, str, 0, 0)
+}
 
+// screenAtFrom is ScreenAtToRune starting the search at the byte offset of str, at the screen
+// position screenOffset (<= x).
+func (v *Vi) screenAtFrom(x int, str string, offset, screenOffset int) int {
 	var result int
-	finalScreenOffset := v.iterateGraphemes(str, func(offset, screenOffset, prevScreenOffset, consumed int) bool {
+	finalScreenOffset := v.iterateGraphemesFrom(str, offset, screenOffset, func(offset, screenOffset, prevScreenOffset, consumed int) bool {
 		log.LogVf("ScreenAtToRune: x=%d, offset=%d, screenOffset=%d", x, offset, screenOffset)
 
 		if screenOffset > x {
@@ -111,3 +177,53 @@ func (v *Vi) ScreenWidth(str string) int {
 		return false // Never stop iteration, just calculate the full width
 	})
 }
+
+// plainText returns true if str is shown as is within maxWidth screen columns: printable ASCII
+// only, so no tabs, escapes or clusters to look at.
+func plainText(str string, maxWidth int) bool {
+	if len(str) > maxWidth {
+		return false
+	}
+	for i := range len(str) {
+		if str[i] < ' ' || str[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// DisplayString returns what to write to the terminal to show str: invalid UTF-8 bytes
+// are replaced by <xx> hex escapes, control and zero width characters by ^X or <U+XXXX>, and the
+// result is clipped to maxWidth screen columns.
+func (v *Vi) DisplayString(str string, maxWidth int) string {
+	if plainText(str, maxWidth) {
+		return str
+	}
+	var sb strings.Builder
+	sb.Grow(len(str))
+	v.iterateGraphemes(str, func(offset, screenOffset, prevScreenOffset, consumed int) bool {
+		if screenOffset > maxWidth {
+			return true // Stop, doesn't fit.
+		}
+		switch {
+		case str[offset] == '\t' && v.list && v.lcs.tab[0] == "":
+			sb.WriteString("^I")
+		case str[offset] == '\t':
+			// Write spaces so the clipping is exact (and the terminal tab stops don't matter).
+			sb.WriteString(strings.Repeat(" ", screenOffset-prevScreenOffset))
+		case consumed == 1 && invalidByte(str, offset):
+			sb.WriteString(hexEscape(str[offset]))
+		case isSpecial(str[offset : offset+consumed]):
+			sb.WriteString(specialString(str[offset : offset+consumed]))
+		default:
+			sb.WriteString(str[offset : offset+consumed])
+		}
+		return false
+	})
+	return sb.String()
+}
+
+func hexEscape(b byte) string {
+	const hex = "0123456789abcdef"
+	return string([]byte{'<', hex[b>>4], hex[b&0xf], '>'})
+}
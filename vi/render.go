@@ -0,0 +1,311 @@
+package vi
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// minScrollGain is the number of rows a scroll must fix for it to be done with a scroll region
+// instead of redrawing the rows.
+const minScrollGain = 2
+
+// renderer is the Screen the editor draws on: it draws the frame in memory, in a VTerm, and render
+// sends to the terminal (out) only what changed since the last frame, using the terminal's scroll
+// region when the frame rows moved up or down.
+type renderer struct {
+	out    Screen
+	frame  *VTerm
+	shown  [][]vcell // What the terminal shows, nil when unknown (first frame, resize).
+	bells  int       // Bells of the frame already sent.
+	cx, cy int       // Terminal cursor position after the last frame.
+	frames int       // Number of frames sent.
+	bytes  int       // Bytes sent for the last frame.
+	total  int       // Bytes sent for all the frames.
+	// Highlights added to the frame when sending it (cursor line, color columns...), so moving them
+	// only sends the cells they leave and cover.
+	overlays []overlay
+}
+
+// overlay is a style added to the cells of a rectangle of the frame, before their own.
+type overlay struct {
+	x1, y1, x2, y2 int // x2 and y2 excluded.
+	style          string
+}
+
+// setOverlays replaces the overlays, the rows they covered and cover are sent again.
+func (r *renderer) setOverlays(overlays []overlay) {
+	if slices.Equal(overlays, r.overlays) {
+		return
+	}
+	r.checkSize()
+	for _, list := range [][]overlay{r.overlays, overlays} {
+		for _, o := range list {
+			r.frame.markDirty(max(0, o.y1), min(r.frame.h, o.y2))
+		}
+	}
+	r.overlays = overlays
+}
+
+// composed returns the rows of the frame with the overlays applied: the frame's own rows when
+// not covered, copies otherwise.
+func (r *renderer) composed() [][]vcell {
+	f := r.frame
+	if len(r.overlays) == 0 {
+		return f.cells
+	}
+	rows := slices.Clone(f.cells)
+	styles := make([]string, f.w)
+	for y := range rows {
+		covered := false
+		clear(styles)
+		for _, o := range r.overlays {
+			if y < o.y1 || y >= o.y2 {
+				continue
+			}
+			covered = true
+			for x := max(0, o.x1); x < min(f.w, o.x2); x++ {
+				styles[x] += o.style
+			}
+		}
+		if !covered {
+			continue
+		}
+		row := slices.Clone(f.cells[y])
+		for x := range row {
+			style := styles[x]
+			switch {
+			case row[x].w == 2 && x+1 < f.w && styles[x+1] != style:
+				style = "" // Both halves of a wide character get the overlays of either.
+				for _, o := range r.overlays {
+					if y >= o.y1 && y < o.y2 && x+1 >= o.x1 && x < o.x2 {
+						style += o.style
+					}
+				}
+				styles[x+1] = style
+			case row[x].w == 0 && x > 0:
+				style = styles[x-1]
+			}
+			if style != "" {
+				row[x].style = style + row[x].style
+			}
+		}
+		rows[y] = row
+	}
+	return rows
+}
+
+func newRenderer(out Screen) *renderer {
+	return &renderer{out: out, frame: NewVTerm(out.W(), out.H())}
+}
+
+// checkSize resizes the frame when the terminal was resized, which redraws everything.
+func (r *renderer) checkSize() {
+	if w, h := r.out.W(), r.out.H(); w != r.frame.w || h != r.frame.h {
+		r.frame.Resize(w, h)
+		r.shown = nil
+	}
+}
+
+func (r *renderer) W() int {
+	r.checkSize()
+	return r.frame.w
+}
+
+func (r *renderer) H() int {
+	r.checkSize()
+	return r.frame.h
+}
+
+func (r *renderer) MoveCursor(x, y int)  { r.frame.MoveCursor(x, y) }
+func (r *renderer) WriteString(s string) { r.frame.WriteString(s) }
+func (r *renderer) ClearEndOfLine()      { r.frame.ClearEndOfLine() }
+func (r *renderer) ClearScreen()         { r.frame.ClearScreen() }
+
+// StartSyncMode does nothing: render starts it when there is something to send.
+func (r *renderer) StartSyncMode() {}
+
+// ReadCursorPosXY sends the frame and returns the terminal cursor position, which is the frame's:
+// use probe to check the terminal's own.
+func (r *renderer) ReadCursorPosXY() (int, int, error) {
+	r.render()
+	return r.out.ReadCursorPosXY()
+}
+
+// probe sends the frame then runs check on the terminal itself (debug checks of where it puts the
+// cursor after text or tabs). What check writes on row y (-1 for none) and the cursor position
+// are unknown afterwards: they are sent again with the next frame.
+func (r *renderer) probe(y int, check func(out Screen)) {
+	r.render()
+	check(r.out)
+	r.cx, r.cy = -1, -1
+	if y >= 0 && y < len(r.shown) {
+		clear(r.shown[y]) // Differs from every cell.
+		r.frame.markDirty(y, y+1)
+	}
+}
+
+// render sends the changes of the frame since the last one to the terminal.
+func (r *renderer) render() {
+	r.checkSize()
+	f := r.frame
+	var sb strings.Builder
+	rows := r.composed()
+	if r.shown == nil {
+		sb.WriteString("\x1b[0m\x1b[H\x1b[2J")
+		r.shown = make([][]vcell, f.h)
+		for y := range r.shown {
+			r.shown[y] = blankLine(f.w)
+		}
+		f.markDirty(0, f.h)
+	} else {
+		r.scroll(&sb, rows)
+	}
+	style := "\x00" // Unknown, the first cell written sets it.
+	for y, dirty := range f.dirty {
+		if dirty {
+			r.drawRow(&sb, rows[y], y, &style)
+		}
+	}
+	f.clearDirty()
+	for ; r.bells < f.bells; r.bells++ {
+		sb.WriteByte('\a')
+	}
+	if sb.Len() == 0 && f.x == r.cx && f.y == r.cy {
+		return
+	}
+	fmt.Fprintf(&sb, "\x1b[%d;%dH", f.y+1, f.x+1)
+	r.cx, r.cy = f.x, f.y
+	r.out.StartSyncMode()
+	r.out.WriteString(sb.String())
+	r.frames++
+	r.bytes = sb.Len()
+	r.total += sb.Len()
+}
+
+// drawRow writes the part of row (row y of the composed frame) that changed.
+func (r *renderer) drawRow(sb *strings.Builder, row []vcell, y int, style *string) {
+	old := r.shown[y]
+	first, last := -1, -1
+	for x := range row {
+		if row[x] != old[x] {
+			if first < 0 {
+				first = x
+			}
+			last = x
+		}
+	}
+	if first < 0 {
+		return
+	}
+	if row[first].w == 0 && first > 0 {
+		first-- // Start with the left half of the wide character.
+	}
+	// Trailing blanks are cleared with an erase to the end of the line.
+	blanks := len(row)
+	for blanks > first && row[blanks-1] == blankCell {
+		blanks--
+	}
+	end := last + 1
+	if blanks < end {
+		end = blanks
+	}
+	fmt.Fprintf(sb, "\x1b[%d;%dH", y+1, first+1)
+	for x := first; x < end; x++ {
+		c := row[x]
+		if c.w == 0 {
+			continue
+		}
+		if c.style != *style {
+			sb.WriteString("\x1b[0m" + c.style)
+			*style = c.style
+		}
+		sb.WriteString(c.s)
+	}
+	if end <= last {
+		if *style != "" {
+			sb.WriteString("\x1b[0m")
+			*style = ""
+		}
+		sb.WriteString("\x1b[K")
+	}
+	copy(old, row)
+}
+
+// rowKey returns a string identifying the content of row.
+func rowKey(row []vcell) string {
+	var sb strings.Builder
+	for _, c := range row {
+		sb.WriteString(c.style)
+		sb.WriteString(c.s)
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// scroll finds rows of the frame that are rows of the terminal moved up or down, and when it saves
+// redrawing enough of them, moves them with a scroll region. rows are the composed frame rows.
+func (r *renderer) scroll(sb *strings.Builder, rows [][]vcell) {
+	f := r.frame
+	n := 0
+	for _, dirty := range f.dirty {
+		if dirty {
+			n++
+		}
+	}
+	if n < minScrollGain+1 {
+		return
+	}
+	frameKeys, shownKeys := make([]string, f.h), make([]string, f.h)
+	for y := range f.h {
+		frameKeys[y], shownKeys[y] = rowKey(rows[y]), rowKey(r.shown[y])
+	}
+	// Longest run of rows y (from start to end excluded) with frame[y] == shown[y+k].
+	bestGain, bestK, bestStart, bestEnd := 0, 0, 0, 0
+	for k := 1 - f.h; k < f.h; k++ {
+		if k == 0 {
+			continue
+		}
+		gain, start := 0, -1
+		for y := max(0, -k); y <= min(f.h, f.h-k); y++ {
+			if y < min(f.h, f.h-k) && frameKeys[y] == shownKeys[y+k] {
+				if start < 0 {
+					start, gain = y, 0
+				}
+				if frameKeys[y] != shownKeys[y] {
+					gain++
+				}
+				continue
+			}
+			if start >= 0 && gain > bestGain {
+				bestGain, bestK, bestStart, bestEnd = gain, k, start, y
+			}
+			start = -1
+		}
+	}
+	if bestGain < minScrollGain {
+		return
+	}
+	// Region of the rows moving, up (k > 0) from start+k..end+k to start..end, down (k < 0)
+	// from start+k..end+k too.
+	top, bottom := min(bestStart, bestStart+bestK), max(bestEnd, bestEnd+bestK)
+	if bestK > 0 {
+		fmt.Fprintf(sb, "\x1b[0m\x1b[%d;%dr\x1b[%dS\x1b[r", top+1, bottom, bestK)
+	} else {
+		fmt.Fprintf(sb, "\x1b[0m\x1b[%d;%dr\x1b[%dT\x1b[r", top+1, bottom, -bestK)
+	}
+	moved := r.shown[top:bottom]
+	k := max(bestK, -bestK)
+	if bestK > 0 {
+		copy(moved, moved[k:])
+		for y := len(moved) - k; y < len(moved); y++ {
+			moved[y] = blankLine(f.w)
+		}
+	} else {
+		copy(moved[k:], moved)
+		for y := range k {
+			moved[y] = blankLine(f.w)
+		}
+	}
+	f.markDirty(top, bottom)
+}
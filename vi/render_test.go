@@ -0,0 +1,181 @@
+package vi
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// recordingTerm is a VTerm remembering what was written to it since the last reset.
+type recordingTerm struct {
+	*VTerm
+	written strings.Builder
+}
+
+func (t *recordingTerm) WriteString(s string) {
+	t.written.WriteString(s)
+	t.VTerm.WriteString(s)
+}
+
+// drawLines draws the lines from first on the top rows of the frame and a fixed bottom row.
+func drawLines(r *renderer, first, n int) {
+	r.ClearScreen()
+	for i := range n {
+		r.MoveCursor(0, i)
+		r.WriteString(fmt.Sprintf("line %d \x1b[1mbold\x1b[0m 日本", first+i))
+	}
+	r.MoveCursor(0, r.H()-1)
+	r.WriteString("\x1b[7mstatus\x1b[0m")
+}
+
+func TestRender(t *testing.T) {
+	out := &recordingTerm{VTerm: NewVTerm(30, 12)}
+	r := newRenderer(out)
+	check := func(what string) {
+		t.Helper()
+		if out.String() != r.frame.String() {
+			t.Errorf("%s: terminal\n%s\nframe\n%s", what, out.String(), r.frame.String())
+		}
+		for y := range r.frame.h {
+			for x := range r.frame.w {
+				if out.Style(x, y) != r.frame.Style(x, y) {
+					t.Errorf("%s: style at %d,%d is %q, expected %q", what, x, y, out.Style(x, y), r.frame.Style(x, y))
+					return
+				}
+			}
+		}
+		if x, y := out.Cursor(); x != r.frame.x || y != r.frame.y {
+			t.Errorf("%s: cursor at %d,%d, expected %d,%d", what, x, y, r.frame.x, r.frame.y)
+		}
+		out.written.Reset()
+	}
+	drawLines(r, 1, 10)
+	r.render()
+	check("first frame")
+	full := r.bytes
+	// Nothing changed: nothing sent.
+	drawLines(r, 1, 10)
+	r.render()
+	if out.written.Len() != 0 || r.frames != 1 {
+		t.Errorf("unchanged frame sent %q", out.written.String())
+	}
+	// One character changed: only it is sent.
+	r.MoveCursor(5, 3)
+	r.WriteString("X")
+	r.render()
+	if w := out.written.String(); w != "\x1b[4;6H\x1b[0mX\x1b[4;7H" {
+		t.Errorf("one change sent %q", w)
+	}
+	check("one change")
+	// Scroll up by 2 and down by 1: the rows are moved with a scroll region, not redrawn.
+	for _, test := range []struct {
+		first  int
+		scroll string
+	}{{3, "\x1b[2S"}, {2, "\x1b[1T"}} {
+		first := test.first
+		drawLines(r, first, 10)
+		r.render()
+		w := out.written.String()
+		if !strings.Contains(w, test.scroll) || r.bytes > full/2 {
+			t.Errorf("scroll to line %d sent %d bytes (full %d): %q", first, r.bytes, full, w)
+		}
+		check(fmt.Sprintf("scroll to line %d", first))
+	}
+	// Trailing blanks are erased.
+	r.MoveCursor(4, 0)
+	r.ClearEndOfLine()
+	r.render()
+	if w := out.written.String(); !strings.HasSuffix(w, "\x1b[K\x1b[1;5H") {
+		t.Errorf("clear end of line sent %q", w)
+	}
+	check("clear end of line")
+	// Bells are sent, resizing redraws everything.
+	r.WriteString("\a")
+	out.Resize(20, 5)
+	drawLines(r, 1, 3)
+	r.render()
+	if w := out.written.String(); !strings.HasPrefix(w, "\x1b[0m\x1b[H\x1b[2J") || out.Bells() != 1 {
+		t.Errorf("after resize sent %q, %d bells", w, out.Bells())
+	}
+	check("resize")
+}
+
+func TestRenderOverlays(t *testing.T) {
+	out := &recordingTerm{VTerm: NewVTerm(30, 12)}
+	r := newRenderer(out)
+	drawLines(r, 1, 10)
+	r.render()
+	under, red := "\x1b[4m", "\x1b[41m"
+	// A column crossing 日 (columns 12-13 of "line 1 bold 日本") and a line.
+	r.setOverlays([]overlay{{13, 0, 14, 10, red}, {0, 2, 30, 3, under}})
+	r.render()
+	if s := out.Style(12, 0); s != "\x1b[41m" {
+		t.Errorf("wide character in the column style %q", s)
+	}
+	if s := out.Style(7, 0); s != "\x1b[1m" {
+		t.Errorf("bold style outside the overlays %q", s)
+	}
+	if s := out.Style(7, 2); s != "\x1b[4;1m" {
+		t.Errorf("bold in the line overlay style %q", s)
+	}
+	if s := out.Style(25, 2); s != "\x1b[4m" {
+		t.Errorf("blank in the line overlay style %q", s)
+	}
+	if s := out.Style(13, 2); s != "\x1b[41;4m" {
+		t.Errorf("line and column style %q", s)
+	}
+	if out.String() != r.frame.String() {
+		t.Errorf("text changed by the overlays\n%s", out.String())
+	}
+	// Moving the line only sends the two rows, the frame isn't drawn again.
+	out.written.Reset()
+	r.setOverlays([]overlay{{13, 0, 14, 10, red}, {0, 3, 30, 4, under}})
+	r.render()
+	if s := out.Style(7, 2) + "|" + out.Style(7, 3); s != "\x1b[1m|\x1b[4;1m" {
+		t.Errorf("styles after moving the line %q", s)
+	}
+	if n := out.written.Len(); n > 200 {
+		t.Errorf("moving the line sent %d bytes: %q", n, out.written.String())
+	}
+	out.written.Reset()
+	r.setOverlays([]overlay{{13, 0, 14, 10, red}, {0, 3, 30, 4, under}})
+	r.render()
+	if out.written.Len() != 0 {
+		t.Errorf("same overlays sent %q", out.written.String())
+	}
+	r.setOverlays(nil)
+	r.render()
+	for y := range r.frame.h {
+		for x := range r.frame.w {
+			if out.Style(x, y) != r.frame.Style(x, y) {
+				t.Fatalf("style at %d,%d is %q without overlays, expected %q", x, y, out.Style(x, y), r.frame.Style(x, y))
+			}
+		}
+	}
+}
+
+func TestProbeTerminal(t *testing.T) {
+	out := NewVTerm(20, 4)
+	out.WriteString("\x1b[3g\x1b[1;5H\x1bH\x1b[1;13H\x1bH") // Tab stops at 4 and 12 only.
+	v := NewVi(out)
+	_ = v.UpdateRS()
+	tabs, err := v.readTabs()
+	if err != nil || !slices.Equal(tabs, []int{4, 12}) {
+		t.Errorf("terminal tab stops %v (%v), expected the terminal's [4 12], not the frame's %v", tabs, err, v.tabs)
+	}
+	// What the checks write on the terminal is replaced by the frame with the next render.
+	v.checkCursor(0, 0, "probe")
+	if l := out.Line(0); !strings.HasPrefix(l, "probe") {
+		t.Errorf("check not written to the terminal: %q", l)
+	}
+	v.Render()
+	for y := range 4 {
+		if l, expected := out.Line(y), v.renderer.frame.Line(y); l != expected {
+			t.Errorf("line %d after the checks %q, expected %q", y, l, expected)
+		}
+	}
+	if x, y := out.Cursor(); x != v.renderer.frame.x || y != v.renderer.frame.y {
+		t.Errorf("cursor at %d,%d after the checks, expected %d,%d", x, y, v.renderer.frame.x, v.renderer.frame.y)
+	}
+}
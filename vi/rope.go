@@ -0,0 +1,317 @@
+package vi
+
+import (
+	"bytes"
+	"iter"
+	"slices"
+)
+
+// ropeLeafMax is the maximum number of lines in a leaf before it gets split.
+const ropeLeafMax = 256
+
+// rope is the line storage of a Buffer: a balanced (AVL) tree whose leaves hold chunks of lines.
+// Access, insertion and deletion of a line by number are O(log n).
+// Leaves created when loading a file keep the raw bytes (of the whole file, read and decoded
+// beforehand) and are only split into lines when first accessed: no strings are allocated for the
+// lines not looked at.
+type rope struct {
+	root *ropeNode
+	eol  []byte // Line separator of the raw leaves.
+}
+
+type ropeNode struct {
+	left, right *ropeNode   // Both nil for leaves.
+	count       int         // Number of lines in this subtree.
+	height      int         // 0 for leaves.
+	lines       []string    // Lines of a leaf, once split.
+	infos       []*lineInfo // Cached screen layout of the lines of a leaf, nil until one is set.
+	raw         []byte      // Not yet split content of a leaf: count lines separated by the rope's eol.
+}
+
+func (n *ropeNode) isLeaf() bool {
+	return n.left == nil
+}
+
+func (n *ropeNode) update() {
+	n.count = n.left.count + n.right.count
+	n.height = 1 + max(n.left.height, n.right.height)
+}
+
+func height(n *ropeNode) int {
+	if n == nil {
+		return -1
+	}
+	return n.height
+}
+
+// newRope returns a rope holding a copy of lines.
+func newRope(lines []string) rope {
+	var leaves []*ropeNode
+	for chunk := range slices.Chunk(lines, ropeLeafMax/2) {
+		leaves = append(leaves, &ropeNode{count: len(chunk), lines: slices.Clone(chunk)})
+	}
+	return rope{root: buildBalanced(leaves)}
+}
+
+// newRopeFromData returns a rope of the lines of data separated by eol (an empty data is one empty line).
+// The leaves are created unsplit (lazy).
+func newRopeFromData(data, eol []byte) rope {
+	var leaves []*ropeNode
+	for {
+		// Find the start of the last line of a chunk of up to ropeLeafMax/2 lines.
+		start, count := 0, 1
+		for count < ropeLeafMax/2 {
+			idx := bytes.Index(data[start:], eol)
+			if idx < 0 {
+				break
+			}
+			start += idx + len(eol)
+			count++
+		}
+		idx := bytes.Index(data[start:], eol)
+		if idx < 0 {
+			leaves = append(leaves, newRawLeaf(count, data))
+			break
+		}
+		leaves = append(leaves, newRawLeaf(count, data[:start+idx]))
+		data = data[start+idx+len(eol):]
+	}
+	return rope{root: buildBalanced(leaves), eol: eol}
+}
+
+func newRawLeaf(count int, raw []byte) *ropeNode {
+	if len(raw) == 0 {
+		return &ropeNode{count: 1, lines: []string{""}}
+	}
+	return &ropeNode{count: count, raw: raw}
+}
+
+func buildBalanced(leaves []*ropeNode) *ropeNode {
+	switch len(leaves) {
+	case 0:
+		return nil
+	case 1:
+		return leaves[0]
+	}
+	mid := len(leaves) / 2
+	n := &ropeNode{left: buildBalanced(leaves[:mid]), right: buildBalanced(leaves[mid:])}
+	n.update()
+	return n
+}
+
+// split materializes the lines of a lazy leaf.
+func (r *rope) split(n *ropeNode) {
+	if n.raw == nil {
+		return
+	}
+	n.lines = make([]string, 0, n.count)
+	for line := range bytes.SplitSeq(n.raw, r.eol) {
+		n.lines = append(n.lines, string(line))
+	}
+	n.raw = nil
+}
+
+// Len returns the number of lines.
+func (r *rope) Len() int {
+	if r.root == nil {
+		return 0
+	}
+	return r.root.count
+}
+
+// leaf returns the leaf containing line i (which must be valid) and the index in that leaf.
+func (r *rope) leaf(i int) (*ropeNode, int) {
+	n := r.root
+	for !n.isLeaf() {
+		if i < n.left.count {
+			n = n.left
+		} else {
+			i -= n.left.count
+			n = n.right
+		}
+	}
+	r.split(n)
+	return n, i
+}
+
+// Get returns line i.
+func (r *rope) Get(i int) string {
+	n, i := r.leaf(i)
+	return n.lines[i]
+}
+
+// Set replaces line i.
+func (r *rope) Set(i int, s string) {
+	n, i := r.leaf(i)
+	n.lines[i] = s
+	if n.infos != nil {
+		n.infos[i] = nil
+	}
+}
+
+// Info returns the cached screen layout of line i, nil if there is none.
+func (r *rope) Info(i int) *lineInfo {
+	n, i := r.leaf(i)
+	if n.infos == nil {
+		return nil
+	}
+	return n.infos[i]
+}
+
+// SetInfo caches the screen layout of line i, until the line changes.
+func (r *rope) SetInfo(i int, info *lineInfo) {
+	n, i := r.leaf(i)
+	if n.infos == nil {
+		n.infos = make([]*lineInfo, len(n.lines))
+	}
+	n.infos[i] = info
+}
+
+// Insert inserts s as line i, 0 <= i <= Len().
+func (r *rope) Insert(i int, s string) {
+	if r.root == nil {
+		r.root = &ropeNode{count: 1, lines: []string{s}}
+		return
+	}
+	r.root = r.insert(r.root, i, s)
+}
+
+func (r *rope) insert(n *ropeNode, i int, s string) *ropeNode {
+	if n.isLeaf() {
+		r.split(n)
+		n.lines = slices.Insert(n.lines, i, s)
+		if n.infos != nil {
+			n.infos = slices.Insert(n.infos, i, nil)
+		}
+		n.count++
+		if n.count <= ropeLeafMax {
+			return n
+		}
+		half := n.count / 2
+		left := &ropeNode{count: half, lines: slices.Clone(n.lines[:half])}
+		right := &ropeNode{count: n.count - half, lines: slices.Clone(n.lines[half:])}
+		if n.infos != nil {
+			left.infos, right.infos = slices.Clone(n.infos[:half]), slices.Clone(n.infos[half:])
+		}
+		return &ropeNode{left: left, right: right, count: n.count, height: 1}
+	}
+	if i <= n.left.count {
+		n.left = r.insert(n.left, i, s)
+	} else {
+		n.right = r.insert(n.right, i-n.left.count, s)
+	}
+	return rebalance(n)
+}
+
+// Delete removes line i.
+func (r *rope) Delete(i int) {
+	r.root = r.delete(r.root, i)
+}
+
+func (r *rope) delete(n *ropeNode, i int) *ropeNode {
+	if n.isLeaf() {
+		r.split(n)
+		n.lines = slices.Delete(n.lines, i, i+1)
+		if n.infos != nil {
+			n.infos = slices.Delete(n.infos, i, i+1)
+		}
+		n.count--
+		if n.count == 0 {
+			return nil
+		}
+		return n
+	}
+	if i < n.left.count {
+		n.left = r.delete(n.left, i)
+	} else {
+		n.right = r.delete(n.right, i-n.left.count)
+	}
+	switch {
+	case n.left == nil:
+		return n.right
+	case n.right == nil:
+		return n.left
+	}
+	return rebalance(n)
+}
+
+func rotateRight(n *ropeNode) *ropeNode {
+	l := n.left
+	n.left = l.right
+	n.update()
+	l.right = n
+	l.update()
+	return l
+}
+
+func rotateLeft(n *ropeNode) *ropeNode {
+	r := n.right
+	n.right = r.left
+	n.update()
+	r.left = n
+	r.update()
+	return r
+}
+
+// rebalance restores the AVL invariant at n after one of its children changed.
+func rebalance(n *ropeNode) *ropeNode {
+	n.update()
+	switch balance := height(n.left) - height(n.right); {
+	case balance > 1:
+		if height(n.left.left) < height(n.left.right) {
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	case balance < -1:
+		if height(n.right.right) < height(n.right.left) {
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
+
+// Slice returns up to num lines starting at start.
+func (r *rope) Slice(start, num int) []string {
+	end := min(start+num, r.Len())
+	if start >= end {
+		return nil
+	}
+	res := make([]string, 0, end-start)
+	for i := start; i < end; {
+		n, idx := r.leaf(i)
+		take := min(n.count-idx, end-i)
+		res = append(res, n.lines[idx:idx+take]...)
+		i += take
+	}
+	return res
+}
+
+// All iterates over all the lines, without splitting the lazy leaves.
+func (r *rope) All() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		r.walk(r.root, yield)
+	}
+}
+
+func (r *rope) walk(n *ropeNode, yield func(string) bool) bool {
+	switch {
+	case n == nil:
+		return true
+	case !n.isLeaf():
+		return r.walk(n.left, yield) && r.walk(n.right, yield)
+	case n.raw != nil:
+		for line := range bytes.SplitSeq(n.raw, r.eol) {
+			if !yield(string(line)) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, line := range n.lines {
+		if !yield(line) {
+			return false
+		}
+	}
+	return true
+}
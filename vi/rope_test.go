@@ -0,0 +1,149 @@
+package vi
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// checkRope verifies the counts, heights and AVL balance of the tree.
+func checkRope(t *testing.T, n *ropeNode) int {
+	t.Helper()
+	if n == nil {
+		return -1
+	}
+	if n.isLeaf() {
+		if n.count == 0 || n.count > ropeLeafMax || (n.raw == nil && len(n.lines) != n.count) {
+			t.Fatalf("Invalid leaf count %d (%d lines)", n.count, len(n.lines))
+		}
+		return 0
+	}
+	hl, hr := checkRope(t, n.left), checkRope(t, n.right)
+	if n.count != n.left.count+n.right.count || n.height != 1+max(hl, hr) || hl-hr > 1 || hr-hl > 1 {
+		t.Fatalf("Invalid node count %d height %d (children %d %d)", n.count, n.height, hl, hr)
+	}
+	return n.height
+}
+
+func TestRopeRandomOps(t *testing.T) {
+	rng := rand.New(rand.NewPCG(42, 1))
+	var r rope
+	var model []string
+	for i := range 20_000 {
+		s := strconv.Itoa(i)
+		switch op := rng.IntN(10); {
+		case op < 5 || len(model) == 0:
+			at := rng.IntN(len(model) + 1)
+			r.Insert(at, s)
+			model = slices.Insert(model, at, s)
+		case op < 8:
+			at := rng.IntN(len(model))
+			r.Delete(at)
+			model = slices.Delete(model, at, at+1)
+		default:
+			at := rng.IntN(len(model))
+			r.Set(at, s)
+			model[at] = s
+		}
+	}
+	checkRope(t, r.root)
+	if r.Len() != len(model) {
+		t.Fatalf("Len %d, expected %d", r.Len(), len(model))
+	}
+	if !slices.Equal(r.Slice(0, r.Len()), model) {
+		t.Error("Slice doesn't match model")
+	}
+	if !slices.Equal(slices.Collect(r.All()), model) {
+		t.Error("All doesn't match model")
+	}
+	for i := range model {
+		if r.Get(i) != model[i] {
+			t.Fatalf("Get(%d) = %q, expected %q", i, r.Get(i), model[i])
+		}
+	}
+	for len(model) > 0 {
+		r.Delete(0)
+		model = model[1:]
+	}
+	if r.root != nil || r.Len() != 0 {
+		t.Error("Expected empty rope")
+	}
+}
+
+func TestRopeFromData(t *testing.T) {
+	for _, n := range []int{1, 2, ropeLeafMax/2 - 1, ropeLeafMax / 2, ropeLeafMax/2 + 1, 1000} {
+		for _, eol := range []string{"\n", "\r\n"} {
+			lines := make([]string, n)
+			for i := range lines {
+				lines[i] = fmt.Sprintf("line %d", i)
+			}
+			lines[n-1] = "" // Also check empty last line.
+			data := bytes.Join(toBytes(lines), []byte(eol))
+			r := newRopeFromData(data, []byte(eol))
+			checkRope(t, r.root)
+			if !slices.Equal(slices.Collect(r.All()), lines) {
+				t.Errorf("%d %q: All doesn't match", n, eol)
+			}
+			if !slices.Equal(r.Slice(0, n), lines) {
+				t.Errorf("%d %q: Slice doesn't match", n, eol)
+			}
+			r.Insert(n/2, "inserted")
+			if r.Get(n/2) != "inserted" || r.Len() != n+1 {
+				t.Errorf("%d %q: insert in lazy rope failed", n, eol)
+			}
+			checkRope(t, r.root)
+		}
+	}
+}
+
+func toBytes(lines []string) [][]byte {
+	res := make([][]byte, len(lines))
+	for i, l := range lines {
+		res[i] = []byte(l)
+	}
+	return res
+}
+
+func benchmarkLines(n int) []byte {
+	var buf bytes.Buffer
+	for i := range n {
+		fmt.Fprintf(&buf, "2025-10-18T12:00:00Z info some log line number %d\n", i)
+	}
+	return buf.Bytes()
+}
+
+// Compare results for the different sizes: the per op time should only grow logarithmically.
+func BenchmarkInsertDeleteLineTop(b *testing.B) {
+	for _, n := range []int{10_000, 100_000, 2_000_000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			var buf Buffer
+			if err := buf.load(benchmarkLines(n)); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := range b.N {
+				buf.InsertLine(i%100, "new line")
+				buf.DeleteLine(i%100 + 1)
+			}
+		})
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	for _, n := range []int{10_000, 2_000_000} {
+		data := benchmarkLines(n)
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				var buf Buffer
+				if err := buf.load(data); err != nil {
+					b.Fatal(err)
+				}
+				_ = buf.GetLines(n/2, 50) // Show a screen in the middle.
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package vi
+
+import (
+	"fmt"
+	"strings"
+
+	"fortio.org/terminal/ansipixels"
+	"github.com/rivo/uniseg"
+)
+
+// Screen is what the editor draws on: a terminal (NewAnsiScreen) or an in-memory one (NewVTerm).
+// Coordinates are 0 based, the output can be buffered until the caller flushes it.
+type Screen interface {
+	W() int
+	H() int
+	MoveCursor(x, y int)
+	WriteString(s string)
+	ClearEndOfLine()
+	ClearScreen()
+	// StartSyncMode starts a synchronized update: the terminal shows it all at once when flushed.
+	StartSyncMode()
+	// ReadCursorPosXY returns the position of the cursor, after what was written so far.
+	ReadCursorPosXY() (x, y int, err error)
+}
+
+// ansiScreen is the Screen of a real terminal.
+type ansiScreen struct {
+	ap *ansipixels.AnsiPixels
+}
+
+// NewAnsiScreen returns the Screen drawing on the ansipixels terminal ap.
+func NewAnsiScreen(ap *ansipixels.AnsiPixels) Screen {
+	return &ansiScreen{ap: ap}
+}
+
+func (s *ansiScreen) W() int                 { return s.ap.W }
+func (s *ansiScreen) H() int                 { return s.ap.H }
+func (s *ansiScreen) MoveCursor(x, y int)    { s.ap.MoveCursor(x, y) }
+func (s *ansiScreen) WriteString(str string) { s.ap.WriteString(str) }
+func (s *ansiScreen) ClearEndOfLine()        { s.ap.ClearEndOfLine() }
+func (s *ansiScreen) ClearScreen()           { s.ap.ClearScreen() }
+func (s *ansiScreen) StartSyncMode()         { s.ap.StartSyncMode() }
+
+func (s *ansiScreen) ReadCursorPosXY() (int, int, error) {
+	return s.ap.ReadCursorPosXY()
+}
+
+// ansiWidth returns the screen width of s, ignoring its ANSI escape sequences.
+func ansiWidth(s string) int {
+	b, _ := ansipixels.AnsiClean([]byte(s))
+	return uniseg.StringWidth(string(b))
+}
+
+// writeAt writes the formatted message at x, y.
+func (v *Vi) writeAt(x, y int, msg string, args ...any) {
+	v.screen.MoveCursor(x, y)
+	v.screen.WriteString(fmt.Sprintf(msg, args...))
+}
+
+// writeBoxed writes the lines of msg centered in a box starting at row y, and leaves the cursor
+// at the end of the last line.
+func (v *Vi) writeBoxed(y int, msg string) {
+	lines := strings.Split(msg, "\n")
+	maxw := 0
+	widths := make([]int, len(lines))
+	for i, l := range lines {
+		widths[i] = ansiWidth(l)
+		maxw = max(maxw, widths[i])
+	}
+	left := (v.screen.W() - maxw) / 2
+	v.writeAt(left-1, y-1, "%s", "╭"+strings.Repeat("─", maxw)+"╮")
+	cx, cy := left, y
+	for i, l := range lines {
+		pad := maxw - widths[i]
+		v.writeAt(left-1, y+i, "%s", "│"+strings.Repeat(" ", pad/2)+l+strings.Repeat(" ", pad-pad/2)+"│")
+		cx, cy = left+pad/2+widths[i], y+i
+	}
+	v.writeAt(left-1, y+len(lines), "%s", "╰"+strings.Repeat("─", maxw)+"╯")
+	v.screen.MoveCursor(cx, cy)
+}
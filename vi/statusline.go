@@ -0,0 +1,240 @@
+package vi
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"fortio.org/terminal/ansipixels/tcolor"
+	"github.com/rivo/uniseg"
+)
+
+// stlItem is an element of a parsed 'statusline': literal text, or the % item kind with its
+// argument (the group of %#Group#, the name of %{name}).
+type stlItem struct {
+	kind byte // 0 for literal text.
+	text string
+}
+
+// parseStatusLine parses a 'statusline' format:
+//
+//	%f file name   %t its last element  %m [+] if modified  %r [RO] if read-only  %y [filetype]
+//	%l line        %L number of lines   %c byte column      %v screen column      %p percentage
+//	%{option}      the value of an option (or mode, the current mode)
+//	%=             alignment point, the space left is shared between them
+//	%<             where to truncate when too long (start by default)
+//	%#Group#       highlight what follows with Group, %* back to StatusLine
+//	%%             a %
+func parseStatusLine(format string) ([]stlItem, error) {
+	var items []stlItem
+	var lit strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			lit.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return nil, fmt.Errorf("statusline: %% at the end of %q", format)
+		}
+		c := format[i]
+		if c == '%' {
+			lit.WriteByte(c)
+			continue
+		}
+		if lit.Len() > 0 {
+			items = append(items, stlItem{text: lit.String()})
+			lit.Reset()
+		}
+		item := stlItem{kind: c}
+		switch c {
+		case 'f', 't', 'm', 'r', 'y', 'l', 'L', 'c', 'v', 'p', '=', '<', '*':
+		case '{', '#':
+			end := byte('}')
+			if c == '#' {
+				end = '#'
+			}
+			j := strings.IndexByte(format[i+1:], end)
+			if j <= 0 {
+				return nil, fmt.Errorf("statusline: unterminated %%%c in %q", c, format)
+			}
+			item.text = format[i+1 : i+1+j]
+			if c == '{' && item.text != "mode" && findOption(item.text) == nil {
+				return nil, fmt.Errorf("statusline: unknown option %s", item.text)
+			}
+			i += j + 1
+		default:
+			return nil, fmt.Errorf("statusline: unknown item %%%c", c)
+		}
+		items = append(items, item)
+	}
+	if lit.Len() > 0 {
+		items = append(items, stlItem{text: lit.String()})
+	}
+	return items, nil
+}
+
+// setStatusLine sets the 'statusline' option, empty for the built-in status line.
+func (v *Vi) setStatusLine(format string) error {
+	items, err := parseStatusLine(format)
+	if err != nil {
+		return err
+	}
+	v.statusLine, v.statusItems = format, items
+	v.Update()
+	return nil
+}
+
+// stlPart is an evaluated piece of the status line.
+type stlPart struct {
+	text  string
+	style string // Escape sequence of its highlight group.
+	fill  bool   // %=: gets a share of the space left.
+}
+
+// windowCursor returns the buffer line and the screen column of the cursor of w.
+func (v *Vi) windowCursor(w *window) (int, int) {
+	if w == v.win {
+		return v.offset + v.cy, v.cx
+	}
+	return w.offset + w.cy, w.cx
+}
+
+// stlValue returns the text of a status line item for w.
+func (v *Vi) stlValue(w *window, item stlItem) string {
+	b := w.e.buf
+	lineNum, x := v.windowCursor(w)
+	switch item.kind {
+	case 0:
+		return item.text
+	case 'f':
+		return w.e.name()
+	case 't':
+		return filepath.Base(w.e.name())
+	case 'm':
+		if b.IsDirty() {
+			return "[+]"
+		}
+	case 'r':
+		if b.ReadOnly() {
+			return "[RO]"
+		}
+	case 'y':
+		if ft := b.FileType(); ft != "" {
+			return "[" + ft + "]"
+		}
+	case 'l':
+		return strconv.Itoa(lineNum + 1)
+	case 'L':
+		return strconv.Itoa(b.NumLines())
+	case 'c':
+		line := b.GetLine(lineNum)
+		if w == v.win {
+			return strconv.Itoa(min(v.lineAtToByte(lineNum, x), len(line)) + 1) // Cached layout.
+		}
+		return strconv.Itoa(min(v.ScreenAtToRune(x, line), len(line)) + 1)
+	case 'v':
+		return strconv.Itoa(x + 1)
+	case 'p':
+		return strconv.Itoa((lineNum + 1) * 100 / max(1, b.NumLines()))
+	case '{':
+		if item.text == "mode" {
+			if w == v.win {
+				return v.cmdMode.String()
+			}
+			return ""
+		}
+		// Options are for the current buffer, evaluated with w's.
+		cur := v.buf
+		v.buf = b
+		defer func() { v.buf = cur }()
+		o := findOption(item.text)
+		if o.isBool() {
+			return strconv.FormatBool(o.getBool(v))
+		}
+		return o.get(v)
+	}
+	return ""
+}
+
+// evalStatusLine returns the 'statusline' of w, fitted to its width: base is the escape sequence of
+// the StatusLine group, the parts after %<, or the start, are truncated when it is too long.
+func (v *Vi) evalStatusLine(w *window, base string) string {
+	var parts []stlPart
+	style, trunc, width, fills := base, 0, 0, 0
+	for _, item := range v.statusItems {
+		switch item.kind {
+		case '#':
+			style = v.hl(item.text)
+		case '*':
+			style = base
+		case '<':
+			trunc = len(parts)
+		case '=':
+			parts = append(parts, stlPart{style: style, fill: true})
+			fills++
+		default:
+			text := v.stlValue(w, item)
+			if text != "" {
+				parts = append(parts, stlPart{text: text, style: style})
+				width += uniseg.StringWidth(text)
+			}
+		}
+	}
+	if width > w.w {
+		parts = truncateParts(parts, trunc, width-w.w+1)
+		width = w.w
+	}
+	if fills == 0 {
+		parts = append(parts, stlPart{style: style, fill: true})
+		fills = 1
+	}
+	space := w.w - width
+	var sb strings.Builder
+	sb.WriteString(base)
+	cur := base
+	for _, p := range parts {
+		if p.style != cur {
+			sb.WriteString(tcolor.Reset + p.style)
+			cur = p.style
+		}
+		if p.fill {
+			n := space / fills
+			if space%fills != 0 {
+				n++
+			}
+			sb.WriteString(strings.Repeat(" ", n))
+			space -= n
+			fills--
+			continue
+		}
+		sb.WriteString(p.text)
+	}
+	if cur != base {
+		sb.WriteString(tcolor.Reset + base)
+	}
+	return fitWidth(sb.String(), w.w) // In case truncating didn't remove enough.
+}
+
+// truncateParts removes n screen columns of text from the parts starting at index at, replaced
+// by a "<" marking the truncation.
+func truncateParts(parts []stlPart, at, n int) []stlPart {
+	if at >= len(parts) {
+		at = 0
+	}
+	marker := stlPart{text: "<", style: parts[at].style}
+	for i := at; i < len(parts) && n > 0; i++ {
+		s := parts[i].text
+		for n > 0 && s != "" {
+			_, rest, w, _ := uniseg.FirstGraphemeClusterInString(s, -1)
+			s = rest
+			if w > n {
+				s = " " + s // Removing a wide character frees one column too many.
+			}
+			n -= w
+		}
+		parts[i].text = s
+	}
+	return append(parts[:at], append([]stlPart{marker}, parts[at:]...)...)
+}
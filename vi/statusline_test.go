@@ -0,0 +1,89 @@
+package vi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseStatusLine(t *testing.T) {
+	items, err := parseStatusLine("%f%% %#Search#%{ff}%*%=%l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, it := range items {
+		if it.kind == 0 {
+			kinds = append(kinds, it.text)
+		} else {
+			kinds = append(kinds, "%"+string(it.kind)+it.text)
+		}
+	}
+	if got := strings.Join(kinds, "|"); got != "%f|% |%#Search|%{ff|%*|%=|%l" {
+		t.Errorf("parsed %q", got)
+	}
+	for _, format := range []string{"abc%", "%q", "%{ff", "%#Search", "%{nosuch}", "%{}"} {
+		if _, err := parseStatusLine(format); err == nil {
+			t.Errorf("parseStatusLine(%q): no error", format)
+		}
+	}
+}
+
+func TestStatusLine(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "notes.go")
+	if err := os.WriteFile(file, []byte("package x\n\nfunc f() {\n\treturn\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	term := NewVTerm(40, 8)
+	v := NewVi(term)
+	v.Open(file)
+	_ = v.UpdateRS()
+	statusRow := term.h - 2
+	v.Process([]byte(`:set stl=%t%m\ %y%=%l/%L,%c-%v\ %p%%` + "\r"))
+	if l := term.Line(statusRow); l != "notes.go [go]                1/5,1-1 20%" {
+		t.Errorf("status line %q", l)
+	}
+	v.Process([]byte("jjjix\x1b"))
+	if l := term.Line(statusRow); l != "notes.go[+] [go]             4/5,2-2 80%" {
+		t.Errorf("status line after editing %q", l)
+	}
+	v.Process([]byte(`:set stl=%{mode}%=%{ff}%=%{ro}` + "\r"))
+	if l := term.Line(statusRow); l != "Navigation           unix          false" {
+		t.Errorf("status line with options %q", l)
+	}
+	v.Process([]byte(":set stl?\r"))
+	if l := term.Line(term.h - 1); l != "statusline=%{mode}%=%{ff}%=%{ro}" {
+		t.Errorf(":set stl? shows %q", l)
+	}
+	// Evaluated for each window, the mode only shown in the current one.
+	v.Process([]byte(":set stl=%{mode}%l%=%#Search#%t\r:vs\r"))
+	left, right, _ := strings.Cut(term.Line(statusRow), "│")
+	if left != "Navigation4notes.go" || right != "4           notes.go" {
+		t.Errorf("split status lines %q %q", left, right)
+	}
+	if s := term.Style(0, statusRow); s != "\x1b[7m" {
+		t.Errorf("status line style %q", s)
+	}
+	if s := term.Style(39, statusRow); s == "\x1b[7m" || s == "" {
+		t.Errorf("%%#Search# style %q", s)
+	}
+	v.Process([]byte(":only\r"))
+	// Too long: truncated at %< or at the start, without wrapping.
+	v.Process([]byte(":set stl=" + strings.Repeat("a", 30) + "%<" + strings.Repeat("日", 10) + "%=%l\r"))
+	if l := term.Line(statusRow); l != strings.Repeat("a", 30)+"<日日日日4" {
+		t.Errorf("truncated status line %q", l)
+	}
+	v.Process([]byte(":set stl=" + strings.Repeat("x", 50) + "END\r"))
+	if l := term.Line(statusRow); l != "<"+strings.Repeat("x", 36)+"END" || term.Line(statusRow+1) != ":" {
+		t.Errorf("truncated status line %q", l)
+	}
+	v.Process([]byte(":set stl=%z\r"))
+	if l := term.Line(term.h - 1); !strings.Contains(l, "unknown item %z") {
+		t.Errorf(":set stl=%%z shows %q", l)
+	}
+	v.Process([]byte(":set stl=\r"))
+	if l := term.Line(statusRow); !strings.Contains(l, "File: "+filepath.Dir(file)[:20]) {
+		t.Errorf("built-in status line %q", l)
+	}
+}
@@ -0,0 +1,359 @@
+package vi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"fortio.org/log"
+)
+
+// SwapFlushInterval is how often pending journal entries are written (and synced) to the swap file.
+var SwapFlushInterval = 2 * time.Second
+
+// swapFlushSize is the amount of pending journal bytes that triggers a flush without waiting for the interval.
+const swapFlushSize = 4096
+
+const swapMagic = "gvi swap v1"
+
+// Journal operations.
+const (
+	opInsert  = 'I' // Insert a new line.
+	opReplace = 'R' // Replace the content of an existing line.
+	opDelete  = 'D' // Delete a line.
+	opBase    = 'B' // First entry: number of lines and hash of the content the journal applies to.
+)
+
+// swapFile is the on disk journal of the changes made to a buffer since it was last loaded or saved.
+// Replaying the journal on top of the file content rebuilds the unsaved buffer.
+type swapFile struct {
+	name      string
+	f         *os.File
+	headerLen int64
+	pending   bytes.Buffer // Journal entries not yet written to f.
+	lastFlush time.Time
+}
+
+// SwapInfo describes an existing swap file (typically left behind by a crash).
+type SwapInfo struct {
+	Name  string // Swap file path.
+	PID   int    // Process id of the editor that created it.
+	Host  string // Hostname of that editor.
+	File  string // File being edited.
+	Alive bool   // Whether that process still seems to be running.
+}
+
+func (si *SwapInfo) String() string {
+	state := "not running"
+	if si.Alive {
+		state = "still running"
+	}
+	return fmt.Sprintf("swap file %s exists (pid %d on %s, %s)", si.Name, si.PID, si.Host, state)
+}
+
+// SwapName returns the swap file name for filename: .name.gvi.swp in the same directory.
+func SwapName(filename string) string {
+	dir, base := filepath.Split(filename)
+	return filepath.Join(dir, "."+base+".gvi.swp")
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return h
+}
+
+// processAlive checks if pid is a running process (on this host).
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// ReadSwapInfo reads the header of an existing swap file.
+func ReadSwapInfo(swapName string) (*SwapInfo, error) {
+	f, err := os.Open(swapName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid swap file header: %w", swapName, err)
+	}
+	return parseSwapHeader(swapName, header)
+}
+
+func parseSwapHeader(swapName, header string) (*SwapInfo, error) {
+	rest, found := strings.CutPrefix(strings.TrimSuffix(header, "\n"), swapMagic+" ")
+	if !found {
+		return nil, fmt.Errorf("%s: not a gvi swap file", swapName)
+	}
+	parts := strings.SplitN(rest, " ", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%s: invalid swap file header %q", swapName, header)
+	}
+	pid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid pid in swap file header: %w", swapName, err)
+	}
+	file, err := strconv.Unquote(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid filename in swap file header: %w", swapName, err)
+	}
+	si := &SwapInfo{Name: swapName, PID: pid, Host: parts[1], File: file}
+	si.Alive = si.Host == hostname() && processAlive(pid)
+	return si, nil
+}
+
+// createSwap creates a new swap file, failing if one already exists.
+func createSwap(filename string) (*swapFile, error) {
+	name := SwapName(filename)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("%s %d %s %s\n", swapMagic, os.Getpid(), hostname(), strconv.Quote(filename))
+	if _, err = f.WriteString(header); err != nil {
+		f.Close()
+		_ = os.Remove(name)
+		return nil, err
+	}
+	return &swapFile{name: name, f: f, headerLen: int64(len(header)), lastFlush: time.Now()}, nil
+}
+
+func (s *swapFile) record(op byte, lineNum int, text string) {
+	s.pending.WriteByte(op)
+	s.pending.WriteByte(' ')
+	s.pending.WriteString(strconv.Itoa(lineNum))
+	s.pending.WriteByte(' ')
+	s.pending.WriteString(strconv.Quote(text))
+	s.pending.WriteByte('\n')
+}
+
+// flush writes the pending journal entries to disk.
+func (s *swapFile) flush() error {
+	if s == nil {
+		return nil
+	}
+	s.lastFlush = time.Now()
+	if s.pending.Len() == 0 {
+		return nil
+	}
+	_, err := s.f.Write(s.pending.Bytes())
+	s.pending.Reset()
+	if err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// due returns true when the pending entries should be flushed.
+func (s *swapFile) due() bool {
+	if s == nil || s.pending.Len() == 0 {
+		return false
+	}
+	return s.pending.Len() >= swapFlushSize || time.Since(s.lastFlush) >= SwapFlushInterval
+}
+
+// reset drops the journal, keeping only the header (after a save).
+func (s *swapFile) reset() error {
+	if s == nil {
+		return nil
+	}
+	s.pending.Reset()
+	if err := s.f.Truncate(s.headerLen); err != nil {
+		return err
+	}
+	_, err := s.f.Seek(s.headerLen, io.SeekStart)
+	return err
+}
+
+func (s *swapFile) remove() error {
+	if s == nil {
+		return nil
+	}
+	s.f.Close()
+	return os.Remove(s.name)
+}
+
+// journal records a change in the swap file if there is one.
+func (b *Buffer) journal(op byte, lineNum int, text string) {
+	if b.swap != nil {
+		b.swap.record(op, lineNum, text)
+	}
+}
+
+// StartSwap starts journaling changes to the swap file for filename.
+// If a swap file already exists (from another editor or a crash) it is left untouched,
+// its information is returned and changes are not journaled.
+func (b *Buffer) StartSwap(filename string) (*SwapInfo, error) {
+	_ = b.swap.remove()
+	b.swap = nil
+	s, err := createSwap(filename)
+	if err == nil {
+		b.swap = s
+		b.journalBase()
+		return nil, nil
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	return ReadSwapInfo(SwapName(filename))
+}
+
+// FlushSwap writes pending journal entries to the swap file, if force is set or if they are due.
+func (b *Buffer) FlushSwap(force bool) error {
+	if !force && !b.swap.due() {
+		return nil
+	}
+	return b.swap.flush()
+}
+
+// resetSwap drops the journal after the buffer was saved or reloaded: it now applies to the
+// content of the file.
+func (b *Buffer) resetSwap() error {
+	if b.swap == nil {
+		return nil
+	}
+	if err := b.swap.reset(); err != nil {
+		return err
+	}
+	b.journalBase()
+	return nil
+}
+
+// contentHash returns a hash of the lines of the buffer, to check a journal applies to them.
+func (b *Buffer) contentHash() string {
+	h := fnv.New64a()
+	for line := range b.lines.All() {
+		_, _ = io.WriteString(h, line)
+		_, _ = h.Write([]byte{'\n'})
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// journalBase records what the journal applies to: the current content of the buffer.
+func (b *Buffer) journalBase() {
+	b.journal(opBase, b.lines.Len(), b.contentHash())
+}
+
+// checkBase returns an error if the journal doesn't apply to the buffer's content (the file
+// changed since the swap file was written).
+func (b *Buffer) checkBase(journal []byte) error {
+	first, _, _ := bytes.Cut(journal, []byte{'\n'})
+	parts := strings.SplitN(string(first), " ", 3)
+	if len(parts) != 3 || parts[0] != string(opBase) {
+		return nil // Empty journal, nothing to apply.
+	}
+	hash, err := strconv.Unquote(parts[2])
+	if err != nil || parts[1] != strconv.Itoa(b.lines.Len()) || hash != b.contentHash() {
+		return errors.New("the file changed since the swap file was written, its changes don't apply")
+	}
+	return nil
+}
+
+// RemoveSwap deletes the swap file (on clean exit).
+func (b *Buffer) RemoveSwap() error {
+	err := b.swap.remove()
+	b.swap = nil
+	return err
+}
+
+// replay applies the journal entries in r to the buffer, returning the number of changes applied.
+func (b *Buffer) replay(r io.Reader) (int, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<30) // Lines can be long and are quoted.
+	n := 0
+	for s.Scan() {
+		entry := s.Text()
+		parts := strings.SplitN(entry, " ", 3)
+		var lineNum int
+		var text string
+		var err error
+		if len(parts) == 3 && len(parts[0]) == 1 {
+			lineNum, err = strconv.Atoi(parts[1])
+			if err == nil {
+				text, err = strconv.Unquote(parts[2])
+			}
+		} else {
+			err = errors.New("wrong number of fields")
+		}
+		if err != nil || lineNum < 0 {
+			// Likely a partially written last entry, keep what we have.
+			log.Warnf("Stopping recovery at invalid journal entry %q: %v", entry, err)
+			break
+		}
+		switch parts[0][0] {
+		case opInsert:
+			if lineNum > b.lines.Len() {
+				return n, fmt.Errorf("journal insert past end of buffer %q", entry)
+			}
+			b.InsertLine(lineNum, text)
+		case opReplace:
+			b.ReplaceLine(lineNum, text)
+		case opDelete:
+			b.DeleteLine(lineNum)
+		case opBase:
+			continue // Checked before replaying, not a change.
+		default:
+			return n, fmt.Errorf("unknown journal operation %q", entry)
+		}
+		n++
+	}
+	return n, s.Err()
+}
+
+// Recover replays the journal of the existing swap file of filename on top of the current
+// buffer content (normally just loaded from filename) and takes the swap file over.
+// Refused when the editor that wrote it is still running, or when the journal doesn't apply
+// to the content. Returns the number of changes recovered.
+func (b *Buffer) Recover(filename string) (int, error) {
+	name := SwapName(filename)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	header, journal, found := bytes.Cut(data, []byte{'\n'})
+	if !found {
+		return 0, fmt.Errorf("%s: truncated swap file", name)
+	}
+	info, err := parseSwapHeader(name, string(header))
+	if err != nil {
+		return 0, err
+	}
+	if info.Alive {
+		return 0, fmt.Errorf("%s is in use by the editor with pid %d", name, info.PID)
+	}
+	if err = b.checkBase(journal); err != nil {
+		return 0, err
+	}
+	// Take over: new swap file with our pid, replayed (valid) entries get journaled again into it.
+	_ = b.swap.remove()
+	if err = os.Remove(name); err != nil {
+		return 0, err
+	}
+	if b.swap, err = createSwap(filename); err != nil {
+		return 0, err
+	}
+	b.journalBase()
+	n, err := b.replay(bytes.NewReader(journal))
+	if err != nil {
+		return n, err
+	}
+	return n, b.swap.flush()
+}
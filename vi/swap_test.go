@@ -0,0 +1,196 @@
+package vi
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// crash makes the swap file of fname look left behind by an editor that is no longer running,
+// by moving it to another host.
+func crash(t *testing.T, fname string) {
+	t.Helper()
+	data, err := os.ReadFile(SwapName(fname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), " "+hostname()+" ", " elsewhere ", 1))
+	if err = os.WriteFile(SwapName(fname), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSwapRecover(t *testing.T) {
+	v := &Vi{}
+	fname := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(fname, []byte("line 1\nline 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b Buffer
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	info, err := b.StartSwap(fname)
+	if err != nil || info != nil {
+		t.Fatalf("StartSwap: unexpected %v %v", info, err)
+	}
+	b.InsertChars(v, 0, 6, " changed")
+	b.InsertLine(1, "new line")
+	b.AppendToLine(4, "past the end")
+	expected := allLines(&b)
+	if err = b.FlushSwap(true); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash: the swap file is left behind and a new editor opens the file.
+	var b2 Buffer
+	if err = b2.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	info, err = b2.StartSwap(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil {
+		t.Fatal("Expected existing swap file info")
+	}
+	if info.PID != os.Getpid() || !info.Alive || info.File != fname || info.Name != SwapName(fname) {
+		t.Errorf("Unexpected swap info %+v", info)
+	}
+	if _, err = b2.Recover(fname); err == nil {
+		t.Error("Recovering from the swap file of a running editor should be refused")
+	}
+	crash(t, fname)
+	n, err := b2.Recover(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 { // 1 replace, 1 insert, 2 padding inserts, 1 replace.
+		t.Errorf("Expected 5 recovered changes, got %d", n)
+	}
+	if !slices.Equal(allLines(&b2), expected) {
+		t.Errorf("Recovered %q, expected %q", allLines(&b2), expected)
+	}
+	if !b2.IsDirty() {
+		t.Error("Recovered buffer should be dirty")
+	}
+	// Saving resets the journal, recovering again on the saved file is a no-op.
+	if err = b2.Save(); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, fname)
+	var b3 Buffer
+	if err = b3.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	n, err = b3.Recover(fname)
+	if err != nil || n != 0 {
+		t.Errorf("Expected nothing to recover after save, got %d %v", n, err)
+	}
+	if !slices.Equal(allLines(&b3), expected) {
+		t.Errorf("Saved %q, expected %q", allLines(&b3), expected)
+	}
+	if err = b3.RemoveSwap(); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(SwapName(fname)); !os.IsNotExist(err) {
+		t.Errorf("Swap file should be removed, got %v", err)
+	}
+}
+
+func TestSwapFlushHidden(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	for _, f := range []string{a, b} {
+		if err := os.WriteFile(f, []byte("abc\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v := NewVi(NewVTerm(40, 10))
+	v.Open(a)
+	v.Process([]byte("x:set hidden\r:e " + b + "\r"))
+	if v.cur.filename != b {
+		t.Fatalf("expected to edit %s, got %s", b, v.cur.filename)
+	}
+	v.FlushSwap() // Like on a terminal read error: the hidden buffer's change is written too.
+	crash(t, a)
+	var recovered Buffer
+	if err := recovered.Open(a); err != nil {
+		t.Fatal(err)
+	}
+	n, err := recovered.Recover(a)
+	if err != nil || n != 1 || recovered.GetLine(0) != "bc" {
+		t.Errorf("recovered %d changes (%v): %q", n, err, recovered.GetLine(0))
+	}
+	v.Close()
+}
+
+func TestSwapRecoverChangedFile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(fname, []byte("line 1\nline 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b Buffer
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.StartSwap(fname); err != nil {
+		t.Fatal(err)
+	}
+	b.DeleteLine(0)
+	if err := b.FlushSwap(true); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, fname)
+	// The file changed after the crash: the journal doesn't apply to it anymore.
+	if err := os.WriteFile(fname, []byte("other\nline 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b2 Buffer
+	if err := b2.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b2.Recover(fname); err == nil || n != 0 || b2.GetLine(0) != "other" {
+		t.Errorf("Recovered %d changes (%v) onto a changed file: %q", n, err, allLines(&b2))
+	}
+	if _, err := os.Stat(SwapName(fname)); err != nil {
+		t.Errorf("Swap file should be kept when not recovered: %v", err)
+	}
+}
+
+func TestSwapKeepOurs(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(fname, []byte("line 1\nline 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b Buffer
+	if err := b.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.StartSwap(fname); err != nil {
+		t.Fatal(err)
+	}
+	b.ReplaceLine(0, "ours")
+	if err := os.WriteFile(fname, []byte("theirs\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, fname)
+	b.KeepOurs()
+	if err := b.FlushSwap(true); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, fname)
+	// Recovering on top of the new disk content gives back our lines.
+	var b2 Buffer
+	if err := b2.Open(fname); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b2.Recover(fname); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"ours", "line 2"}; !slices.Equal(allLines(&b2), expected) {
+		t.Errorf("Recovered %q, expected %q", allLines(&b2), expected)
+	}
+	_ = b2.RemoveSwap()
+}
@@ -0,0 +1,334 @@
+package vi
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+// syntaxRule is a token of a language: when re matches at the current position of the line, the
+// match (only its first submatch if re has one) is highlighted with group and the lexer goes to
+// the state next (-1 to stay in the same).
+type syntaxRule struct {
+	re        *regexp.Regexp
+	lineStart bool // Only matches at the start of the line.
+	group     string
+	next      int
+}
+
+// rule returns a syntaxRule for the regular expression re, which only matches at the start
+// of the line if it starts with ^.
+func rule(re, group string, next int) syntaxRule {
+	lineStart := strings.HasPrefix(re, "^")
+	return syntaxRule{
+		re:        regexp.MustCompile(`^(?:` + strings.TrimPrefix(re, "^") + `)`),
+		lineStart: lineStart,
+		group:     group,
+		next:      next,
+	}
+}
+
+// language is a syntax definition: the rules of each state of its lexer, tried in order (the state
+// is 0 at the start of the file, the others are for constructs spanning lines like block
+// comments), and how to recognize its files.
+type language struct {
+	name     string
+	exts     []string // File extensions.
+	names    []string // File base name patterns.
+	shebangs []string // Interpreters of a #! first line.
+	states   [][]syntaxRule
+}
+
+// syntaxSpan is a highlighted part of a line, from the byte offset start to end (excluded).
+type syntaxSpan struct {
+	start, end int
+	group      string
+}
+
+// lex returns the highlighted parts of line, starting in the state start, and the state at its end.
+func (l *language) lex(line string, start int) ([]syntaxSpan, int) {
+	var spans []syntaxSpan
+	state := start
+	for p := 0; p < len(line); {
+		matched := false
+		for _, r := range l.states[state] {
+			if r.lineStart && p > 0 {
+				continue
+			}
+			loc := r.re.FindStringSubmatchIndex(line[p:])
+			if loc == nil || loc[1] == 0 {
+				continue
+			}
+			from, to := p+loc[0], p+loc[1]
+			if len(loc) > 2 && loc[2] >= 0 {
+				from, to = p+loc[2], p+loc[3]
+			}
+			if r.group != "" && to > from {
+				if n := len(spans); n > 0 && spans[n-1].end == from && spans[n-1].group == r.group {
+					spans[n-1].end = to
+				} else {
+					spans = append(spans, syntaxSpan{from, to, r.group})
+				}
+			}
+			p += loc[1]
+			if r.next >= 0 {
+				state = r.next
+			}
+			matched = true
+			break
+		}
+		if !matched {
+			_, size := utf8.DecodeRuneInString(line[p:])
+			p += size
+		}
+	}
+	return spans, state
+}
+
+// findLanguage returns the language named name (as in :set filetype), nil if there is none.
+func findLanguage(name string) *language {
+	for _, l := range languages {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// detectLanguage returns the language of the file filename, from its name or its first line
+// (#! interpreter), nil if it isn't known.
+func detectLanguage(filename, firstLine string) *language {
+	base := filepath.Base(filename)
+	ext := strings.ToLower(filepath.Ext(base))
+	for _, l := range languages {
+		for _, pattern := range l.names {
+			if ok, _ := filepath.Match(pattern, base); ok {
+				return l
+			}
+		}
+		if ext != "" && slices.Contains(l.exts, ext) {
+			return l
+		}
+	}
+	interp, found := strings.CutPrefix(firstLine, "#!")
+	if !found {
+		return nil
+	}
+	fields := strings.Fields(interp)
+	if len(fields) > 0 && filepath.Base(fields[0]) == "env" {
+		fields = slices.DeleteFunc(fields[1:], func(f string) bool { return strings.HasPrefix(f, "-") })
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	interp = filepath.Base(fields[0])
+	for _, l := range languages {
+		if slices.Contains(l.shebangs, interp) {
+			return l
+		}
+	}
+	return nil
+}
+
+// FileType returns the name of the language of the buffer, empty if there is none.
+func (b *Buffer) FileType() string {
+	if b.lang == nil {
+		return ""
+	}
+	return b.lang.name
+}
+
+// SetFileType sets the language of the buffer (:set filetype), none when name is empty.
+func (b *Buffer) SetFileType(name string) error {
+	l := findLanguage(name)
+	if l == nil && name != "" {
+		names := make([]string, len(languages))
+		for i, l := range languages {
+			names[i] = l.name
+		}
+		return fmt.Errorf("unknown filetype %q (%s)", name, strings.Join(names, ", "))
+	}
+	b.lang = l
+	b.resetSyntax()
+	b.version++ // Redraw the windows showing it.
+	return nil
+}
+
+// detectSyntax sets the language of the buffer from its file name and first line.
+func (b *Buffer) detectSyntax() {
+	b.lang = detectLanguage(b.name, b.GetLine(0))
+	b.resetSyntax()
+}
+
+// resetSyntax forgets the lexer states of the lines.
+func (b *Buffer) resetSyntax() {
+	b.synStates = b.synStates[:0]
+	b.synValid = 0
+}
+
+// invalidateSyntax is called when line lineNum changed, was inserted or deleted: the lexer states
+// at the start of the lines after it must be computed again. The previous ones are kept (until
+// another edit) for syntaxChanged.
+func (b *Buffer) invalidateSyntax(lineNum int) {
+	if b.synValid <= lineNum+1 {
+		b.synStates = b.synStates[:min(len(b.synStates), b.synValid)]
+		return
+	}
+	b.synValid = max(0, lineNum+1)
+}
+
+// startState returns the lexer state at the start of line lineNum, lexing the lines from the
+// last one known.
+func (b *Buffer) startState(lineNum int) int {
+	if b.lang == nil || len(b.lang.states) == 1 {
+		return 0
+	}
+	if b.synValid == 0 {
+		b.synStates = append(b.synStates[:0], 0)
+		b.synValid = 1
+	}
+	for i := b.synValid - 1; i < lineNum; i++ {
+		_, end := b.lang.lex(b.GetLine(i), b.synStates[i])
+		if i+1 < len(b.synStates) {
+			b.synStates[i+1] = end
+		} else {
+			b.synStates = append(b.synStates, end)
+		}
+		b.synValid = i + 2
+	}
+	return b.synStates[lineNum]
+}
+
+// syntaxChanged returns true if the edit of line lineNum changed the lexer state at the start of
+// the next line (like opening a block comment), so the lines below need to be drawn again.
+func (b *Buffer) syntaxChanged(lineNum int) bool {
+	if b.lang == nil || len(b.lang.states) == 1 {
+		return false
+	}
+	old := -1
+	if lineNum+1 < len(b.synStates) {
+		old = b.synStates[lineNum+1]
+	}
+	return b.startState(lineNum+1) != old
+}
+
+// highlighted returns true if the lines of b are shown with syntax highlighting.
+func (v *Vi) highlighted(b *Buffer) bool {
+	return !v.syntaxOff && b.lang != nil
+}
+
+// decorated returns true if the lines of b are drawn with more than their text: highlighted or in
+// list mode.
+func (v *Vi) decorated(b *Buffer) bool {
+	return v.highlighted(b) || v.list
+}
+
+// highlightString is DisplayString for line lineNum of b, with the colors of its syntax, escaped
+// characters in SpecialKey and, in list mode, whitespace shown with 'listchars'.
+func (v *Vi) highlightString(b *Buffer, lineNum int, str string, maxWidth int) string {
+	inBuffer := lineNum >= 0 && lineNum < b.NumLines()
+	var spans []syntaxSpan
+	if v.highlighted(b) && inBuffer {
+		spans, _ = b.lang.lex(str, b.startState(lineNum))
+	}
+	list := v.list && inBuffer
+	if len(spans) == 0 && !list && plainText(str, maxWidth) {
+		return str
+	}
+	trail := len(str)
+	if list && v.lcs.trail != "" {
+		trail = len(strings.TrimRight(str, " "))
+	}
+	var sb strings.Builder
+	sb.Grow(len(str) + 8*len(spans))
+	color, span := "", 0
+	width, clipped := 0, false
+	fit, fitCol := 0, 0 // Output that fits before the last column, for the extends of 'listchars'.
+	v.iterateGraphemes(str, func(offset, screenOffset, prevScreenOffset, consumed int) bool {
+		if screenOffset > maxWidth {
+			clipped = true
+			return true // Stop, doesn't fit.
+		}
+		for span < len(spans) && spans[span].end <= offset {
+			span++
+		}
+		group := ""
+		if span < len(spans) && spans[span].start <= offset {
+			group = spans[span].group
+		}
+		cluster := str[offset : offset+consumed]
+		var text string
+		switch {
+		case cluster == "\t" && list && v.lcs.tab[0] != "":
+			text, group = v.lcs.tabString(screenOffset-prevScreenOffset), "Whitespace"
+		case cluster == "\t" && list:
+			text, group = "^I", "SpecialKey"
+		case cluster == "\t":
+			text = strings.Repeat(" ", screenOffset-prevScreenOffset)
+		case consumed == 1 && invalidByte(str, offset):
+			text, group = hexEscape(str[offset]), "SpecialKey"
+		case isSpecial(cluster):
+			text, group = specialString(cluster), "SpecialKey"
+		case list && v.lcs.nbsp != "" && isNbsp(cluster):
+			text, group = v.lcs.nbsp, "Whitespace"
+		case list && offset >= trail:
+			text, group = v.lcs.trail, "Whitespace"
+		default:
+			text = cluster
+		}
+		if want := v.hl(group); want != color {
+			sb.WriteString(tcolor.Reset + want)
+			color = want
+		}
+		sb.WriteString(text)
+		width = screenOffset
+		if screenOffset < maxWidth {
+			fit, fitCol = sb.Len(), screenOffset
+		}
+		return false
+	})
+	if color != "" {
+		sb.WriteString(tcolor.Reset)
+	}
+	res := sb.String()
+	switch {
+	case !list:
+	case clipped && v.lcs.extends != "":
+		res = res[:fit] + tcolor.Reset + strings.Repeat(" ", maxWidth-1-fitCol) + v.hlText("", "NonText", v.lcs.extends)
+	case !clipped && v.lcs.eol != "" && width < maxWidth:
+		res += v.hlText("", "NonText", v.lcs.eol)
+	}
+	return res
+}
+
+// syntaxCommand handles :syntax [on|off], returns false if name isn't it.
+func (v *Vi) syntaxCommand(name, arg string) bool {
+	if name != "sy" && name != "syn" && name != "syntax" {
+		return false
+	}
+	switch arg {
+	case "on", "enable":
+		v.syntaxOff = false
+	case "off", "clear":
+		v.syntaxOff = true
+	case "":
+		state := "on"
+		if v.syntaxOff {
+			state = "off"
+		}
+		v.CmdResult("syntax %s, filetype=%s", state, v.buf.FileType())
+		return true
+	default:
+		v.ShowError("Error", errors.New("usage: :syntax on|off"))
+		return true
+	}
+	v.cmdMode = NavMode
+	v.Update()
+	return true
+}
@@ -0,0 +1,152 @@
+package vi
+
+// Built-in syntax definitions. The rules of a state are tried in order at each position of the
+// line, so words are consumed whole by a last rule (without highlight) and keywords don't match
+// in the middle of identifiers.
+
+const (
+	goString     = `"(?:[^"\\]|\\.)*"?`
+	singleQuoted = `'[^']*'?`
+)
+
+var goLang = &language{
+	name: "go",
+	exts: []string{".go"},
+	states: [][]syntaxRule{
+		{
+			rule(`//.*`, "Comment", -1),
+			rule(`/\*`, "Comment", 1),
+			rule("`", "String", 2),
+			rule(goString, "String", -1),
+			rule(`'(?:[^'\\]|\\.)*'?`, "String", -1),
+			rule(`(?:break|case|chan|const|continue|default|defer|else|fallthrough|for|func|go|goto|if|`+
+				`import|interface|map|package|range|return|select|struct|switch|type|var)\b`, "Keyword", -1),
+			rule(`(?:any|bool|byte|comparable|complex64|complex128|error|float32|float64|int|int8|int16|`+
+				`int32|int64|rune|string|uint|uint8|uint16|uint32|uint64|uintptr)\b`, "Type", -1),
+			rule(`(?:true|false|iota|nil)\b`, "Constant", -1),
+			rule(`(?:append|cap|clear|close|complex|copy|delete|imag|len|make|max|min|new|panic|print|`+
+				`println|real|recover)\b`, "Function", -1),
+			rule(`0[xX][0-9a-fA-F_]+|0[bB][01_]+|0[oO][0-7_]+|[0-9][0-9_]*(?:\.[0-9_]*)?(?:[eE][-+]?[0-9]+)?i?|`+
+				`\.[0-9][0-9_]*(?:[eE][-+]?[0-9]+)?i?`, "Number", -1),
+			rule(`[\pL_][\pL\pN_]*`, "", -1),
+		},
+		{ // Block comment.
+			rule(`.*?\*/`, "Comment", 0),
+			rule(`.+`, "Comment", -1),
+		},
+		{ // Raw string.
+			rule("[^`]*`", "String", 0),
+			rule(`.+`, "String", -1),
+		},
+	},
+}
+
+var markdownLang = &language{
+	name: "markdown",
+	exts: []string{".md", ".markdown", ".mdown", ".mkd"},
+	states: [][]syntaxRule{
+		{
+			rule(`^#{1,6}(?:\s.*)?$`, "Title", -1),
+			rule("^ {0,3}(?:```|~~~).*", "Special", 1),
+			rule(`^ {0,3}(?:[-*_][ \t]*){3,}$`, "Special", -1),
+			rule(`^\s*([-*+]|[0-9]+[.)])\s`, "Special", -1),
+			rule(`^ {0,3}>+`, "Comment", -1),
+			rule("`[^`]+`", "String", -1),
+			rule(`\*\*[^*]+\*\*|__[^_]+__`, "Bold", -1),
+			rule(`\*[^*\s][^*]*\*|_[^_\s][^_]*_`, "Italic", -1),
+			rule(`!?\[[^\]]*\]\([^)]*\)|<https?://[^>]*>`, "Underlined", -1),
+			rule(`<!--.*?-->`, "Comment", -1),
+			rule(`<!--`, "Comment", 2),
+			rule(`[\pL\pN_]+`, "", -1),
+		},
+		{ // Fenced code block.
+			rule("^ {0,3}(?:```|~~~)\\s*$", "Special", 0),
+			rule(`.+`, "String", -1),
+		},
+		{ // HTML comment.
+			rule(`.*?-->`, "Comment", 0),
+			rule(`.+`, "Comment", -1),
+		},
+	},
+}
+
+var yamlLang = &language{
+	name: "yaml",
+	exts: []string{".yaml", ".yml"},
+	states: [][]syntaxRule{
+		{
+			rule(`^(?:---|\.\.\.)\s*$`, "PreProc", -1),
+			rule(`#.*`, "Comment", -1),
+			rule(`("(?:[^"\\]|\\.)*"|'[^']*'|[^\s#'"{}\[\],&*!|>-][^#:]*?|-[^\s#:][^#:]*?)\s*:(?:\s|$)`, "Identifier", -1),
+			rule(goString, "String", -1),
+			rule(`'(?:[^']|'')*'?`, "String", -1),
+			rule(`[&*][^\s,\[\]{}]+`, "Special", -1),
+			rule(`![^\s,\[\]{}]*`, "Type", -1),
+			rule(`(?:true|false|True|False|TRUE|FALSE|null|Null|NULL)\b|~`, "Constant", -1),
+			rule(`([-+]?(?:0x[0-9a-fA-F]+|0o[0-7]+|[0-9][0-9_]*(?:\.[0-9]*)?(?:[eE][-+]?[0-9]+)?|\.inf|\.nan))(?:\s|$)`,
+				"Number", -1),
+			rule(`\S+`, "", -1),
+		},
+	},
+}
+
+var jsonLang = &language{
+	name: "json",
+	exts: []string{".json"},
+	states: [][]syntaxRule{
+		{
+			rule(`("(?:[^"\\]|\\.)*")\s*:`, "Identifier", -1),
+			rule(goString, "String", -1),
+			rule(`-?(?:0|[1-9][0-9]*)(?:\.[0-9]+)?(?:[eE][-+]?[0-9]+)?`, "Number", -1),
+			rule(`(?:true|false|null)\b`, "Constant", -1),
+			rule(`\w+`, "", -1),
+		},
+	},
+}
+
+// shellVariable matches $name, ${...} and the special parameters.
+const shellVariable = `\$(?:\{[^}]*\}?|[A-Za-z_][A-Za-z0-9_]*|[@*#?$!0-9-])`
+
+var shellLang = &language{
+	name:     "sh",
+	exts:     []string{".sh", ".bash", ".zsh", ".ksh"},
+	names:    []string{".bashrc", ".bash_profile", ".bash_aliases", ".bash_logout", ".profile", ".zshrc"},
+	shebangs: []string{"sh", "bash", "zsh", "ksh", "dash", "ash"},
+	states: [][]syntaxRule{
+		{
+			rule(`^#!.*`, "PreProc", -1),
+			rule(`#.*`, "Comment", -1),
+			rule(singleQuoted, "String", -1),
+			rule(goString, "String", -1),
+			rule(shellVariable, "Identifier", -1),
+			rule(`\\.`, "Special", -1),
+			rule(`([A-Za-z_][A-Za-z0-9_]*)=`, "Identifier", -1),
+			rule(`(?:if|then|else|elif|fi|for|while|until|do|done|case|esac|in|function|select|return|`+
+				`break|continue|local|export|readonly|declare|unset|shift|exit|source|eval|exec|trap)\b`, "Keyword", -1),
+			rule(`[0-9]+\b`, "Number", -1),
+			rule("[^\\s'\"$\\\\;|&()<>`]+", "", -1),
+		},
+	},
+}
+
+var dockerfileLang = &language{
+	name:  "dockerfile",
+	exts:  []string{".dockerfile"},
+	names: []string{"Dockerfile", "Dockerfile.*", "*.Dockerfile", "Containerfile", "Containerfile.*"},
+	states: [][]syntaxRule{
+		{
+			rule(`^\s*#.*`, "Comment", -1),
+			rule(`^(?i)\s*(FROM|RUN|CMD|LABEL|MAINTAINER|EXPOSE|ENV|ADD|COPY|ENTRYPOINT|VOLUME|USER|`+
+				`WORKDIR|ARG|ONBUILD|STOPSIGNAL|HEALTHCHECK|SHELL)\b`, "Keyword", -1),
+			rule(`--[A-Za-z][\w-]*(?:=\S*)?`, "Special", -1),
+			rule(shellVariable, "Identifier", -1),
+			rule(singleQuoted, "String", -1),
+			rule(goString, "String", -1),
+			rule(`\\$`, "Special", -1),
+			rule(`[^\s'"$\\]+`, "", -1),
+		},
+	},
+}
+
+// languages are the built-in syntax definitions.
+var languages = []*language{goLang, markdownLang, yamlLang, jsonLang, shellLang, dockerfileLang}
@@ -0,0 +1,158 @@
+package vi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+// spansString shows the highlighted parts of line as group:text.
+func spansString(line string, spans []syntaxSpan) string {
+	res := make([]string, 0, len(spans))
+	for _, s := range spans {
+		res = append(res, s.group+":"+line[s.start:s.end])
+	}
+	return strings.Join(res, " ")
+}
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		lang     *language
+		line     string
+		state    int
+		expected string
+		end      int
+	}{
+		{goLang, `func f(s string) int { return len(s) + 0x1F } // done`, 0,
+			`Keyword:func Type:string Type:int Keyword:return Function:len Number:0x1F Comment:// done`, 0},
+		{goLang, `x := "a \" b" + 'c' + iota2 + nil`, 0, `String:"a \" b" String:'c' Constant:nil`, 0},
+		{goLang, `a /* start`, 0, `Comment:/* start`, 1},
+		{goLang, `end */ if`, 1, `Comment:end */ Keyword:if`, 0},
+		{goLang, "s := `raw", 0, "String:`raw", 2},
+		{goLang, "still` 1.5", 2, "String:still` Number:1.5", 0},
+		{markdownLang, `## Title *x*`, 0, `Title:## Title *x*`, 0},
+		{markdownLang, "- item `code` **b** _i_ snake_case [l](u)", 0,
+			"Special:- String:`code` Bold:**b** Italic:_i_ Underlined:[l](u)", 0},
+		{markdownLang, "```go", 0, "Special:```go", 1},
+		{markdownLang, "# not a title", 1, "String:# not a title", 1},
+		{markdownLang, "```", 1, "Special:```", 0},
+		{yamlLang, `key: "v" # c`, 0, `Identifier:key String:"v" Comment:# c`, 0},
+		{yamlLang, `- name: &a true`, 0, `Identifier:name Special:&a Constant:true`, 0},
+		{yamlLang, `port: 8080`, 0, `Identifier:port Number:8080`, 0},
+		{yamlLang, `url: http://x/#y`, 0, `Identifier:url`, 0},
+		{jsonLang, `{"k": "v", "n": -1.5e3, "b": null}`, 0,
+			`Identifier:"k" String:"v" Identifier:"n" Number:-1.5e3 Identifier:"b" Constant:null`, 0},
+		{shellLang, `if [ "$x" = 1 ]; then echo ${y} $1 # c`, 0,
+			`Keyword:if String:"$x" Number:1 Keyword:then Identifier:${y} Identifier:$1 Comment:# c`, 0},
+		{shellLang, `A=b iffy a#b`, 0, `Identifier:A`, 0},
+		{dockerfileLang, `from golang AS build`, 0, `Keyword:from`, 0},
+		{dockerfileLang, `COPY --from=build $HOME/x "y" \`, 0,
+			`Keyword:COPY Special:--from=build Identifier:$HOME String:"y" Special:\`, 0},
+	}
+	for _, test := range tests {
+		spans, end := test.lang.lex(test.line, test.state)
+		if got := spansString(test.line, spans); got != test.expected || end != test.end {
+			t.Errorf("%s %q: got %q (state %d), expected %q (state %d)",
+				test.lang.name, test.line, got, end, test.expected, test.end)
+		}
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name, firstLine, expected string
+	}{
+		{"main.go", "", "go"},
+		{"/a/README.md", "", "markdown"},
+		{"x.YML", "", "yaml"},
+		{"package.json", "", "json"},
+		{"build.sh", "", "sh"},
+		{".bashrc", "", "sh"},
+		{"Dockerfile", "", "dockerfile"},
+		{"Dockerfile.dev", "", "dockerfile"},
+		{"app.dockerfile", "", "dockerfile"},
+		{"script", "#!/bin/bash -e", "sh"},
+		{"script", "#!/usr/bin/env -S zsh", "sh"},
+		{"script", "#!/usr/bin/env python3", ""},
+		{"notes.txt", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if l := detectLanguage(test.name, test.firstLine); l != nil {
+			got = l.name
+		}
+		if got != test.expected {
+			t.Errorf("detectLanguage(%q, %q) = %q, expected %q", test.name, test.firstLine, got, test.expected)
+		}
+	}
+}
+
+func TestSyntaxStates(t *testing.T) {
+	b := &Buffer{}
+	for i := range 100 {
+		b.InsertLine(i, fmt.Sprintf("x := %d", i))
+	}
+	if err := b.SetFileType("go"); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.startState(50); s != 0 || b.synValid != 51 {
+		t.Errorf("startState(50) = %d, %d valid, expected 0, 51", s, b.synValid)
+	}
+	// Opening a comment changes the state of the lines after it, only those are lexed again.
+	b.setLine(10, "/* x")
+	if b.synValid != 11 {
+		t.Errorf("%d valid after changing line 10, expected 11", b.synValid)
+	}
+	if !b.syntaxChanged(10) {
+		t.Errorf("opening a comment didn't change the next line")
+	}
+	if s := b.startState(50); s != 1 {
+		t.Errorf("startState(50) in the comment = %d, expected 1", s)
+	}
+	b.setLine(20, "*/")
+	if !b.syntaxChanged(20) || b.startState(21) != 0 || b.startState(20) != 1 {
+		t.Errorf("closing the comment: states %d %d", b.startState(20), b.startState(21))
+	}
+	b.startState(50) // Drawn again.
+	b.setLine(30, "y := 1")
+	if b.syntaxChanged(30) {
+		t.Errorf("changing a line outside of comments changed the next line")
+	}
+	b.DeleteLine(10)
+	if s := b.startState(15); s != 0 {
+		t.Errorf("startState(15) after deleting the comment start = %d, expected 0", s)
+	}
+	if err := b.SetFileType("cobol"); err == nil || b.FileType() != "go" {
+		t.Errorf("unknown filetype: %v, %q", err, b.FileType())
+	}
+	if err := b.SetFileType(""); err != nil || b.FileType() != "" || b.startState(15) != 0 {
+		t.Errorf("no filetype: %v, %q", err, b.FileType())
+	}
+}
+
+func TestHighlightString(t *testing.T) {
+	v := &Vi{buf: &Buffer{}, tabs: []int{8, 16, 24}}
+	v.buf.InsertLine(0, "if\tx // 日本")
+	line := v.buf.GetLine(0)
+	if got := v.highlightString(v.buf, 0, line, 80); got != v.DisplayString(line, 80) {
+		t.Errorf("without filetype got %q", got)
+	}
+	_ = v.buf.SetFileType("go")
+	yellow, cyan := tcolor.Yellow.Foreground(), tcolor.Cyan.Foreground()
+	expected := tcolor.Reset + yellow + "if" + tcolor.Reset + "      x " + tcolor.Reset + cyan + "// 日本" + tcolor.Reset
+	if got := v.highlightString(v.buf, 0, line, 80); got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+	// Clipped in the middle of the comment, the second wide character doesn't fit.
+	expected = tcolor.Reset + yellow + "if" + tcolor.Reset + "      x " + tcolor.Reset + cyan + "// 日" + tcolor.Reset
+	if got := v.highlightString(v.buf, 0, line, 15); got != expected {
+		t.Errorf("clipped got %q, expected %q", got, expected)
+	}
+	v.syntaxOff = true
+	if got := v.highlightString(v.buf, 0, line, 80); got != v.DisplayString(line, 80) {
+		t.Errorf("with syntax off got %q", got)
+	}
+}
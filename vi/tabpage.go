@@ -0,0 +1,269 @@
+package vi
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+// tabPage is a tab page: a window layout, with the current window in it. The current window
+// of the current tab page is the Vi win field, saved here when switching to another tab page.
+type tabPage struct {
+	layout *layout
+	win    *window
+}
+
+// allWindows returns the windows of all the tab pages.
+func (v *Vi) allWindows() []*window {
+	var res []*window
+	for _, t := range v.tabPages {
+		res = t.layout.windows(res)
+	}
+	return res
+}
+
+// tabLineHeight is the number of rows taken by the tab line: 1 when there is more than one tab page.
+func (v *Vi) tabLineHeight() int {
+	if len(v.tabPages) > 1 {
+		return 1
+	}
+	return 0
+}
+
+// shows returns the number of windows of the tab page showing e.
+func (t *tabPage) shows(e *bufEntry) int {
+	n := 0
+	for _, w := range t.layout.windows(nil) {
+		if w.e == e {
+			n++
+		}
+	}
+	return n
+}
+
+// enterTab makes t the current tab page.
+func (v *Vi) enterTab(t *tabPage) {
+	v.saveWindow()
+	v.tab.win = v.win
+	v.tab = t
+	v.enterWindow(t.win)
+	v.arrange()
+	v.cmdMode = NavMode
+	v.Update()
+}
+
+// NewTab opens a new tab page after the current one, editing filename or a new empty buffer.
+func (v *Vi) NewTab(filename string) {
+	var e *bufEntry
+	if filename != "" {
+		e = v.findFile(filename)
+	}
+	if e == nil {
+		e = v.newBufEntry(filename)
+	}
+	old := v.cur
+	v.saveWindow()
+	v.tab.win = v.win
+	w := &window{e: e}
+	t := &tabPage{layout: &layout{win: w}, win: w}
+	v.tabPages = slices.Insert(v.tabPages, slices.Index(v.tabPages, v.tab)+1, t)
+	v.tab, v.win = t, w
+	v.arrange() // Before enter, which restores the cursor within the window's height.
+	v.enter(e, "")
+	if old != e && old.listed {
+		v.alt = old
+	}
+}
+
+// CloseTab closes the tab page t (:tabclose, or closing the last window of a tab page).
+// The buffers of its windows become hidden if they have unsaved changes (which requires
+// force or the hidden option) or are unloaded.
+func (v *Vi) CloseTab(t *tabPage, force bool) {
+	if len(v.tabPages) == 1 {
+		v.ShowError("Error", errors.New("cannot close last tab page"))
+		return
+	}
+	wins := t.layout.windows(nil)
+	if !force && !v.hidden {
+		for _, w := range wins {
+			if w.e.buf.IsDirty() && v.shown(w.e, nil) == t.shows(w.e) {
+				v.ShowError("Error", fmt.Errorf("no write since last change for buffer %d (add ! to override)", w.e.num))
+				return
+			}
+		}
+	}
+	i := slices.Index(v.tabPages, t)
+	v.tabPages = slices.Delete(v.tabPages, i, i+1)
+	for _, w := range wins {
+		v.release(w.e)
+	}
+	if t == v.tab {
+		v.enterTab(v.tabPages[min(i, len(v.tabPages)-1)])
+		return
+	}
+	v.arrange()
+	v.cmdMode = NavMode
+	v.Update()
+}
+
+// TabOnly closes all the tab pages but the current one (:tabonly).
+func (v *Vi) TabOnly(force bool) {
+	for _, t := range v.tabPages {
+		if t == v.tab || force || v.hidden {
+			continue
+		}
+		for _, w := range t.layout.windows(nil) {
+			if w.e.buf.IsDirty() && v.tab.shows(w.e) == 0 {
+				v.ShowError("Error", fmt.Errorf("no write since last change for buffer %d (add ! to override)", w.e.num))
+				return
+			}
+		}
+	}
+	others := v.allWindows()
+	v.tabPages = []*tabPage{v.tab}
+	for _, w := range others {
+		v.release(w.e)
+	}
+	v.arrange()
+	v.cmdMode = NavMode
+	v.Update()
+}
+
+// closeTabWindows closes the windows showing e in the other tab pages (for :bd), and the tab
+// pages left without window. Returns true if any was closed.
+func (v *Vi) closeTabWindows(e *bufEntry) bool {
+	closed := false
+	for _, t := range slices.Clone(v.tabPages) {
+		if t == v.tab {
+			continue
+		}
+		for _, w := range t.layout.windows(nil) {
+			if w.e != e {
+				continue
+			}
+			closed = true
+			if t.layout.win != nil {
+				v.tabPages = slices.DeleteFunc(v.tabPages, func(o *tabPage) bool { return o == t })
+				break
+			}
+			if next := t.removeWindow(w); t.win == w {
+				t.win = next
+			}
+		}
+	}
+	return closed
+}
+
+// gotoTab goes to the tab page number idx (from 0).
+func (v *Vi) gotoTab(idx int) {
+	if idx < 0 || idx >= len(v.tabPages) {
+		v.Beep()
+		return
+	}
+	if t := v.tabPages[idx]; t != v.tab {
+		v.enterTab(t)
+	}
+}
+
+// nextTab goes to the tab page delta positions away from the current one, wrapping around (gt, gT).
+func (v *Vi) nextTab(delta int) {
+	n := len(v.tabPages)
+	v.gotoTab(((slices.Index(v.tabPages, v.tab)+delta)%n + n) % n)
+}
+
+// gCommand handles the key after g.
+func (v *Vi) gCommand(c byte, count int) {
+	switch c {
+	case 't':
+		if count > 0 {
+			v.gotoTab(count - 1)
+		} else {
+			v.nextTab(1)
+		}
+	case 'T':
+		v.nextTab(-max(1, count))
+	case 0x1b:
+	default:
+		v.Beep()
+	}
+}
+
+// tabCommand handles the tab page ex commands, returns false if name isn't one of them.
+func (v *Vi) tabCommand(name string, force bool, arg string) bool {
+	switch name {
+	case "tabnew", "tabe", "tabedit":
+		v.NewTab(arg)
+	case "tabc", "tabclose":
+		t := v.tab
+		if arg != "" {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > len(v.tabPages) {
+				v.ShowError("Error", fmt.Errorf("invalid tab page number %s", arg))
+				break
+			}
+			t = v.tabPages[n-1]
+		}
+		v.CloseTab(t, force)
+	case "tabo", "tabonly":
+		v.TabOnly(force)
+	case "tabn", "tabnext":
+		if n, err := strconv.Atoi(arg); err == nil {
+			v.gotoTab(n - 1)
+		} else {
+			v.nextTab(1)
+		}
+	case "tabp", "tabprevious", "tabN", "tabNext":
+		v.nextTab(-1)
+	default:
+		return false
+	}
+	return true
+}
+
+// tabLabel returns the tab line label of the tab page number i: its number, the number of windows
+// if more than one, + if a buffer is modified, and the name of the buffer in its current window.
+func (v *Vi) tabLabel(i int, t *tabPage) string {
+	cur := t.win
+	if t == v.tab {
+		cur = v.win
+	}
+	wins := t.layout.windows(nil)
+	flags := ""
+	if len(wins) > 1 {
+		flags = strconv.Itoa(len(wins))
+	}
+	for _, w := range wins {
+		if w.e.buf != nil && w.e.buf.IsDirty() {
+			flags += "+"
+			break
+		}
+	}
+	if flags != "" {
+		flags += " "
+	}
+	return fmt.Sprintf(" %d %s%s ", i+1, flags, filepath.Base(cur.e.name()))
+}
+
+// drawTabLine draws the tab line on the top row, when there is more than one tab page.
+func (v *Vi) drawTabLine() {
+	if v.tabLineHeight() == 0 {
+		return
+	}
+	var sb strings.Builder
+	for i, t := range v.tabPages {
+		if t == v.tab {
+			sb.WriteString(v.hl("TabLineSel"))
+		} else {
+			sb.WriteString(v.hl("TabLine"))
+		}
+		sb.WriteString(v.tabLabel(i, t))
+		sb.WriteString(tcolor.Reset)
+	}
+	v.screen.MoveCursor(0, 0)
+	v.screen.WriteString(fitWidth(sb.String()+v.hl("TabLineFill"), v.screen.W()) + tcolor.Reset)
+}
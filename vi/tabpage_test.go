@@ -0,0 +1,46 @@
+package vi
+
+import "testing"
+
+func TestTabPages(t *testing.T) {
+	v := &Vi{}
+	a, b := v.newBufEntry("dir/a.txt"), v.newBufEntry("b.txt")
+	a.buf, b.buf = &Buffer{}, &Buffer{}
+	b.buf.dirty = true
+	// Tab 1: a only, tab 2: a above b, tab 3: b only.
+	w1 := &window{e: a}
+	t1 := &tabPage{layout: &layout{win: w1}, win: w1}
+	w2a, w2b := &window{e: a}, &window{e: b}
+	l2 := &layout{}
+	l2.children = []*layout{{win: w2a, parent: l2, size: 5}, {win: w2b, parent: l2, size: 5}}
+	t2 := &tabPage{layout: l2, win: w2b}
+	w3 := &window{e: b}
+	t3 := &tabPage{layout: &layout{win: w3}, win: w3}
+	v.tabPages = []*tabPage{t1, t2, t3}
+	v.tab, v.win = t1, w1
+	if v.tabLineHeight() != 1 {
+		t.Errorf("tabLineHeight() = %d, expected 1", v.tabLineHeight())
+	}
+	if n := v.shown(b, nil); n != 2 {
+		t.Errorf("shown(b) = %d, expected 2", n)
+	}
+	if n := t2.shows(a); n != 1 {
+		t.Errorf("t2.shows(a) = %d, expected 1", n)
+	}
+	labels := []string{" 1 a.txt ", " 2 2+ b.txt ", " 3 + b.txt "}
+	for i, tp := range v.tabPages {
+		if l := v.tabLabel(i, tp); l != labels[i] {
+			t.Errorf("tabLabel(%d) = %q, expected %q", i, l, labels[i])
+		}
+	}
+	// :bd b closes its window in tab 2 and tab 3 which is left without window.
+	if !v.closeTabWindows(b) {
+		t.Errorf("closeTabWindows(b) should have closed windows")
+	}
+	if len(v.tabPages) != 2 || t2.layout.win != w2a || t2.win != w2a {
+		t.Errorf("after closeTabWindows(b): %d tabs, tab 2 %+v", len(v.tabPages), t2)
+	}
+	if n := v.shown(b, nil); n != 0 {
+		t.Errorf("shown(b) = %d after closeTabWindows, expected 0", n)
+	}
+}
@@ -1,22 +1,86 @@
 package vi
 
-import "fortio.org/log"
+import (
+	"slices"
 
+	"fortio.org/log"
+)
+
+// UpdateTabs sets the tab stops to the terminal default of every 8 columns. In debug mode they are
+// checked against the terminal's, which costs a round trip per tab stop.
 func (v *Vi) UpdateTabs() {
-	v.ap.WriteString("\r\t")
-	v.tabs = v.tabs[:0]
+	var tabs []int
+	for x := 8; x < v.screen.W()-1; x += 8 {
+		tabs = append(tabs, x)
+	}
+	if !slices.Equal(tabs, v.tabs) {
+		v.tabs = tabs
+		v.tabsGen++
+	}
+	if !v.Debug {
+		return
+	}
+	tabs, err := v.readTabs()
+	if err != nil {
+		log.Errf("Error reading cursor position: %v", err)
+		return
+	}
+	if !slices.Equal(tabs, v.tabs) {
+		log.Warnf("Terminal tab stops %v differ from the default %v", tabs, v.tabs)
+	}
+}
+
+// probe runs check on the terminal, not the renderer's frame, so it sees what the terminal does
+// with the text and tabs written (and y, the row written on, if any, is drawn again).
+func (v *Vi) probe(y int, check func(s Screen)) {
+	if v.renderer == nil {
+		check(v.screen)
+		return
+	}
+	v.renderer.probe(y, check)
+}
+
+// readTabs returns the tab stops of the terminal, found by writing tabs and reading the cursor position.
+func (v *Vi) readTabs() (tabs []int, err error) {
+	v.probe(-1, func(s Screen) {
+		tabs, err = readTabStops(s)
+	})
+	return tabs, err
+}
+
+// readTabStops writes tabs on the current line of s and returns where each put the cursor.
+func readTabStops(s Screen) ([]int, error) {
+	s.WriteString("\r\t")
+	var tabs []int
 	prevX := 0
 	for {
-		x, _, err := v.ap.ReadCursorPosXY()
+		x, _, err := s.ReadCursorPosXY()
 		if err != nil {
-			log.Errf("Error reading cursor position: %v", err)
-			return
+			return nil, err
 		}
-		if x == prevX || x == v.ap.W-1 {
+		if x == prevX || x == s.W()-1 {
 			break
 		}
-		v.tabs = append(v.tabs, x)
-		v.ap.WriteString("\t")
+		tabs = append(tabs, x)
+		s.WriteString("\t")
 		prevX = x
 	}
+	return tabs, nil
+}
+
+// checkCursor logs when the terminal cursor isn't where the editor computed it is after writing
+// str at x0, y0, for instance when the terminal and uniseg disagree on the width of an emoji.
+func (v *Vi) checkCursor(x0, y0 int, str string) {
+	v.probe(y0, func(s Screen) {
+		s.MoveCursor(x0, y0)
+		s.WriteString(str)
+		x, y, err := s.ReadCursorPosXY()
+		if err != nil {
+			log.Errf("Error reading cursor position: %v", err)
+			return
+		}
+		if x != v.win.x+v.cx || y != v.win.y+v.cy {
+			log.Warnf("Cursor at %d,%d after writing %q, computed %d,%d", x, y, str, v.win.x+v.cx, v.win.y+v.cy)
+		}
+	})
 }
@@ -2,10 +2,12 @@ package vi // import "fortio.org/gvi/vi"
 
 import (
 	"bytes"
-	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
-	"fortio.org/terminal/ansipixels"
+	"fortio.org/log"
 	"fortio.org/terminal/ansipixels/tcolor"
 )
 
@@ -21,93 +23,153 @@ const (
 func (m Mode) String() string {
 	switch m {
 	case NavMode:
-		return tcolor.Cyan.Foreground() + "Navigation" + tcolor.White.Foreground()
+		return "Navigation"
 	case CommandMode:
-		return tcolor.Yellow.Foreground() + "Command" + tcolor.White.Foreground()
+		return "Command"
 	case InsertMode:
-		return tcolor.Green.Foreground() + "Insert" + tcolor.White.Foreground()
+		return "Insert"
 	case AppendMode:
-		return tcolor.Green.Foreground() + "Append" + tcolor.White.Foreground()
+		return "Append"
 	default:
 		return "Unknown"
 	}
 }
 
+// group returns the highlight group of the mode name in the status line.
+func (m Mode) group() string {
+	switch m {
+	case NavMode:
+		return "ModeNav"
+	case CommandMode:
+		return "ModeCommand"
+	case InsertMode:
+		return "ModeInsert"
+	default:
+		return "ModeAppend"
+	}
+}
+
 type Vi struct {
-	cmdMode        Mode
-	ap             *ansipixels.AnsiPixels
-	filename       string // Not used in this example, but could be used to track the file being edited
-	cx, cy         int    // Cursor position
-	inputBuf       []byte // Buffer for partial input
-	buf            Buffer
-	splash         bool // Show splash screen on first refresh.
-	offset         int  // Offset in lines for scrolling.
-	usableHeight   int  // v.ap.H - 2
-	keepMessage    bool // Clear command/message line after processing input or not.
-	tabs           []int
-	Debug          bool // Debug mode flag
-	fullRefresh    int  // Counter for full screen refreshes
-	screenWidthCnt int  // Counter for ScreenWidth calls
-	screenAtCnt    int  // Counter for ScreenAtToRune calls
-}
-
-func NewVi(ap *ansipixels.AnsiPixels) *Vi {
-	return &Vi{
-		cmdMode:      NavMode,
-		ap:           ap,
-		filename:     "...", // no filename case.
-		splash:       true,  // Show splash screen on first refresh.
-		usableHeight: ap.H - 2,
+	cmdMode         Mode
+	screen          Screen      // What to draw on: the renderer's frame (or a Screen used directly in tests).
+	renderer        *renderer   // Sends the changes of the frame to the terminal.
+	cx, cy          int         // Cursor position
+	inputBuf        []byte      // Buffer for partial input
+	buf             *Buffer     // Current buffer (cur.buf).
+	cur             *bufEntry   // Current entry in the buffer list.
+	alt             *bufEntry   // Alternate buffer, for :e#, :b# and Ctrl-^.
+	bufs            []*bufEntry // Buffer list.
+	lastBufNum      int
+	splash          bool              // Show splash screen on first refresh.
+	offset          int               // Offset in lines for scrolling.
+	usableHeight    int               // Text height of the current window.
+	win             *window           // Current window.
+	tab             *tabPage          // Current tab page.
+	tabPages        []*tabPage        // All the tab pages, in order.
+	pending         byte              // First key of a 2 keys command (Ctrl-W, g) waiting for the second.
+	count           int               // Count typed before a command.
+	keepMessage     bool              // Clear command/message line after processing input or not.
+	cmdline         cmdLine           // Line being edited in CommandMode.
+	cmdHistory      []string          // Lines run with :, oldest first.
+	searchHistory   []string          // Patterns searched with /.
+	lastSearch      string            // Pattern searched again by n.
+	prompt          func(c byte) bool // When set, the next key answers a question, returns false to exit.
+	tabs            []int
+	tabsGen         int               // Incremented when the tab stops or list mode change, invalidating the cached line layouts.
+	args            []string          // Argument list (files from the command line).
+	startPos        string            // +N, + or +/pattern position to go to in the first file opened.
+	argIdx          int               // Index of the current file in args.
+	hidden          bool              // Option to keep modified buffers loaded when switching files.
+	binary          bool              // Binary mode for the files opened.
+	readOnly        bool              // Open the files read-only (-R, view).
+	encoding        string            // Encoding for the files opened, empty to detect.
+	syntaxOff       bool              // Syntax highlighting disabled (:syntax off).
+	highlights      highlights        // Highlight groups, nil until the default color scheme is loaded.
+	colorsName      string            // Name of the color scheme loaded.
+	hlCache         map[string]string // Escape sequences of the highlight groups, for the current colors.
+	colors          int               // Number of colors of the terminal ('t_Co'), trueColors for 24 bits.
+	statusLine      string            // 'statusline' format, empty for the built-in status line.
+	statusItems     []stlItem         // Parsed statusLine.
+	list            bool              // List mode: whitespace shown with listChars.
+	listChars       string            // 'listchars' option.
+	lcs             listChars         // Parsed listChars.
+	cursorLine      bool              // Highlight the cursor line ('cursorline').
+	cursorColumn    bool              // Highlight the cursor column ('cursorcolumn').
+	colorColumn     string            // 'colorcolumn' option.
+	colorColumns    []int             // Parsed colorColumn.
+	trailingSpace   bool              // Highlight trailing whitespace ('trailingspace').
+	covered         bool              // Text shown over the windows (:hi, diff...): no overlays until the next Update.
+	Debug           bool              // Debug mode flag
+	fullRefresh     int               // Counter for full screen refreshes
+	screenWidthCnt  int               // Counter for ScreenWidth calls
+	screenAtCnt     int               // Counter for ScreenAtToRune calls
+	lineCacheHits   int               // Counter for line layouts found in the cache
+	lineCacheMisses int               // Counter for line layouts computed
+}
+
+// NewVi returns an editor drawing on screen (see NewAnsiScreen for a terminal, NewVTerm for memory).
+// The screen only gets what changed when Render is called.
+func NewVi(screen Screen) *Vi {
+	v := &Vi{
+		cmdMode:  NavMode,
+		renderer: newRenderer(screen),
+		splash:   true, // Show splash screen on first refresh.
+		colors:   detectColors(),
 	}
+	v.screen = v.renderer
+	v.cur = v.newBufEntry("") // no filename case.
+	v.buf = v.newBuffer("")
+	v.cur.buf = v.buf
+	v.win = &window{e: v.cur}
+	v.tab = &tabPage{layout: &layout{win: v.win}, win: v.win}
+	v.tabPages = []*tabPage{v.tab}
+	_ = v.setListChars(defaultListChars) // Checked by the tests.
+	v.arrange()
+	return v
 }
 
 func (v *Vi) UpdateRS() error {
-	v.usableHeight = v.ap.H - 2
+	v.arrange()
 	v.UpdateTabs()
 	v.Update()
+	v.Render()
 	return nil
 }
 
+// Render sends to the screen what changed since the last call. Process and UpdateRS call it.
+func (v *Vi) Render() {
+	if v.renderer != nil {
+		v.renderer.setOverlays(v.overlays())
+		v.renderer.render()
+	}
+}
+
 func (v *Vi) Update() {
 	v.fullRefresh++ // Increment full refresh counter
-	v.ap.StartSyncMode()
-	v.ap.ClearScreen()
-	lines := v.buf.GetLines(v.offset, v.usableHeight) // Get the lines from the buffer and display them
-	for i, line := range lines {
-		v.ap.WriteAtStr(0, i, line)
+	v.screen.StartSyncMode()
+	v.screen.ClearScreen()
+	v.covered = v.splash
+	v.drawTabLine()
+	for _, w := range v.windows() {
+		v.drawWindow(w)
 	}
+	v.drawSeparators(v.tab.layout)
 	v.UpdateStatus()
 	if v.splash {
-		v.ap.WriteBoxed(v.ap.H/2-4, "Welcome to gvi (vi in go)!\n'ESC:q' to quit\nhjkl to move\nEsc, i, : to switch mode\ntry resize\n")
+		v.writeBoxed(v.screen.H()/2-4, "Welcome to gvi (vi in go)!\n'ESC:q' to quit\nhjkl to move\nEsc, i, : to switch mode\ntry resize\n")
 	}
 }
 
-func (v *Vi) CommandStatus() {
-	v.ap.WriteAt(0, v.ap.H-1, ":%s", string(v.inputBuf))
-	v.ap.ClearEndOfLine()
-}
-
 func (v *Vi) UpdateStatus() {
-	dirty := ""
-	if v.buf.IsDirty() {
-		dirty = tcolor.Purple.Foreground() + "*" + tcolor.White.Foreground()
-	}
-	debugInfo := ""
-	if v.Debug {
-		debugInfo = fmt.Sprintf(" F:%d SW:%d SA:%d", v.fullRefresh, v.screenWidthCnt, v.screenAtCnt)
-	}
-	v.ap.WriteAt(0, v.usableHeight, "%s %sFile: %s (%d/%d lines) - %s - @%d,%d [%dx%d]%s %s",
-		tcolor.Inverse, dirty, v.filename, v.cy+1+v.offset, v.buf.NumLines(),
-		v.cmdMode.String(), v.cx+1, v.cy+1, v.ap.W, v.ap.H, debugInfo, tcolor.Reset)
-	v.ap.ClearEndOfLine()
+	v.drawStatus(v.win)
 	if v.cmdMode == CommandMode {
 		v.CommandStatus()
 	} else {
 		if !v.keepMessage {
-			v.ap.MoveCursor(0, v.ap.H-1)
-			v.ap.ClearEndOfLine()
+			v.screen.MoveCursor(0, v.screen.H()-1)
+			v.screen.ClearEndOfLine()
 		}
-		v.ap.MoveCursor(v.cx, v.cy)
+		v.moveCursor()
 		v.keepMessage = false // Clear status line only if not in command mode
 	}
 }
@@ -122,10 +184,13 @@ func (v *Vi) VScrollWithoutUpdate(delta int) bool {
 		v.cy = 0
 		scrolled = true
 	} else if v.cy >= v.usableHeight {
-		v.offset = min(v.buf.NumLines()-v.usableHeight, v.offset+v.cy-v.usableHeight+1)
+		// Not past the start when the buffer is shorter than the window.
+		v.offset = max(0, min(v.buf.NumLines()-v.usableHeight, v.offset+v.cy-v.usableHeight+1))
 		v.cy = v.usableHeight - 1 // Keep cursor within bounds
 		scrolled = true
 	}
+	// Nor past the last line.
+	v.cy = max(0, min(v.cy, v.buf.NumLines()-1-v.offset))
 	return scrolled // Return true if scrolling occurred
 }
 
@@ -140,7 +205,7 @@ func (v *Vi) BufferLineNumber() int {
 }
 
 func (v *Vi) Beep() {
-	v.ap.WriteRune('\a') // Beep for unrecognized command or error
+	v.screen.WriteString("\a") // Beep for unrecognized command or error
 }
 
 // calculateCenteredPosition returns the offset and cy values needed to center currentLine
@@ -156,19 +221,51 @@ func (v *Vi) calculateCenteredPosition(currentLine, numLines int) (offset, cy in
 }
 
 func (v *Vi) AppendModeOn() {
+	v.warnReadOnly()
 	v.cmdMode = AppendMode
 }
 
 func (v *Vi) InsertModeOn() {
+	v.warnReadOnly()
 	v.cmdMode = InsertMode
 }
 
+// warnReadOnly warns, before the first change, that the buffer is read-only.
+func (v *Vi) warnReadOnly() {
+	if v.buf.ReadOnly() && !v.buf.IsDirty() {
+		v.writeAt(0, v.screen.H()-1, "%sWarning: changing a read-only file%s", v.hl("WarningMsg"), tcolor.Reset)
+		v.screen.ClearEndOfLine()
+		v.keepMessage = true
+	}
+}
+
 // Append() returns true if we are in optimized append mode (vs regular insert mode).
 func (v *Vi) Append() bool {
 	return v.cmdMode == AppendMode
 }
 
 func (v *Vi) navigate(b byte) {
+	if v.pending != 0 {
+		// Second key of Ctrl-W x or g x.
+		count, pending := v.count, v.pending
+		v.pending, v.count = 0, 0
+		if pending == 'g' {
+			v.gCommand(b, count)
+		} else {
+			v.windowCommand(b, count)
+		}
+		return
+	}
+	if b >= '1' && b <= '9' || b == '0' && v.count > 0 {
+		v.count = 10*v.count + int(b-'0')
+		return
+	}
+	if b == 0x17 || b == 'g' { // Ctrl-W or g prefix
+		v.pending = b
+		return
+	}
+	count := max(1, v.count)
+	v.count = 0
 	// scroll instead when reading edges
 	switch b {
 	case 'j':
@@ -190,7 +287,7 @@ func (v *Vi) navigate(b byte) {
 	case 'h', 0x7f: // Backspace or 'h'
 		v.cx = max(0, v.cx-1) // Move cursor left
 	case 'l':
-		v.cx = min(v.ap.W-1, v.cx+1) // Move cursor right
+		v.cx = min(v.win.w-1, v.cx+1) // Move cursor right
 	case 'i':
 		if v.cx == 0 && v.EmptyLine() {
 			v.AppendModeOn() // really append (eg initial empty line and hit 'i')
@@ -206,7 +303,7 @@ func (v *Vi) navigate(b byte) {
 		v.handleNewlineInsertion()
 	case '$':
 		// Move to end of line
-		v.cx = max(0, v.ScreenWidth(v.buf.GetLine(v.BufferLineNumber()))-1) // Move cursor to end of line
+		v.cx = max(0, v.lineWidth(v.BufferLineNumber())-1) // Move cursor to end of line
 	case '0':
 		// Move to start of line
 		v.cx = 0 // Move cursor to start of line
@@ -216,16 +313,18 @@ func (v *Vi) navigate(b byte) {
 		v.VScroll(v.buf.NumLines() - 1 - v.BufferLineNumber())
 	case 'A':
 		// Append at end of line
-		currentLine := v.buf.GetLine(v.BufferLineNumber())
-		v.cx = v.ScreenWidth(currentLine) // Move cursor to end of line
-		v.AppendModeOn()                  // We're now in append mode
+		v.cx = v.lineWidth(v.BufferLineNumber()) // Move cursor to end of line
+		v.AppendModeOn()                         // We're now in append mode
 	case 'x':
-		// Delete character under cursor
-		v.deleteCharUnderCursor()
-	case ':':
-		v.cmdMode = CommandMode
-		v.ap.WriteAtStr(0, v.ap.H-1, ":")
-		v.ap.ClearEndOfLine() // Clear the command line
+		// Delete count characters under and after the cursor
+		v.deleteCharUnderCursor(count)
+	case ':', '/':
+		v.startCmdLine(b)
+	case 'n':
+		// Next match of the last search
+		v.search("")
+	case 0x1e: // Ctrl-^
+		v.EditCommand("#", false)
 	case 0x1b: // Escape key
 		// nothing to do, it's ok
 	default:
@@ -239,42 +338,84 @@ func (v *Vi) EmptyLine() bool {
 	return v.buf.GetLine(v.cy+v.offset) == ""
 }
 
-// deleteCharUnderCursor deletes the character at the current cursor position.
-func (v *Vi) deleteCharUnderCursor() {
+// deleteCharUnderCursor deletes count characters from the current cursor position, fewer when
+// the line ends before (x).
+func (v *Vi) deleteCharUnderCursor(count int) {
 	lineNum := v.BufferLineNumber()
 	currentLine := v.buf.GetLine(lineNum)
-	currentLineWidth := v.ScreenWidth(currentLine)
+	currentLineWidth := v.lineWidth(lineNum)
 
 	if len(currentLine) == 0 || v.cx >= currentLineWidth {
 		v.Beep()
 		return
 	}
 
-	// Check if we're deleting at the end of the line (like append mode)
-	deletingAtEnd := v.cx >= currentLineWidth-1
-
-	v.buf.DeleteChar(v, lineNum, v.cx)
+	v.warnReadOnly()
+	offset := v.lineAtToByte(lineNum, v.cx)
+	for range count {
+		if offset >= len(v.buf.GetLine(lineNum)) {
+			break
+		}
+		v.buf.DeleteAt(lineNum, offset)
+	}
 
+	// Check if we deleted up to the end of the line (like append mode)
+	deletingAtEnd := offset >= len(v.buf.GetLine(lineNum))
+	oldCx := v.cx
 	if deletingAtEnd {
-		// Deleting at end - just clear from cursor to end of line and adjust cursor
-		if currentLineWidth > 1 {
-			v.cx = currentLineWidth - 2 // Move cursor back when deleting last character
-		}
-		v.ap.ClearEndOfLine()
-		v.UpdateStatus()
-	} else {
-		// Deleting in middle - redraw the full line
-		newLine := v.buf.GetLine(lineNum)
-		v.ap.MoveHorizontally(0) // Move cursor to the start of the line
-		v.ap.ClearEndOfLine()
-		v.ap.WriteString(newLine)   // Write the updated line
-		v.ap.MoveCursor(v.cx, v.cy) // Move cursor back to original position
-		v.UpdateStatus()
+		v.cx = max(0, v.lineWidth(lineNum)-1) // Move cursor back when deleting the last character
 	}
+	switch {
+	case v.highlighted(v.buf) && v.buf.syntaxChanged(lineNum):
+		v.drawWindow(v.win) // The highlighting of the lines below changed too.
+	case deletingAtEnd && !v.decorated(v.buf):
+		// Deleting at end - just clear from cursor to end of line
+		v.clearEOL(oldCx)
+	default:
+		// Deleting in middle (or changing the highlighting of the line) - redraw the full line
+		v.drawLine(v.win, v.cy, v.buf.GetLine(lineNum))
+	}
+	v.moveCursor() // Move cursor back to original position
+	v.UpdateStatus()
 }
 
 func (v *Vi) WriteBottom(msg string, args ...any) {
-	v.ap.WriteAt(0, v.ap.H-1, msg, args...)
+	v.writeAt(0, v.screen.H()-1, msg, args...)
+}
+
+// ShowLines shows lines above the status line, over the text, until a key is pressed.
+func (v *Vi) ShowLines(lines []string) {
+	shown := make([]string, len(lines))
+	for i, line := range lines {
+		shown[i] = v.DisplayString(line, v.screen.W())
+	}
+	v.showRendered(shown)
+}
+
+// showRendered is ShowLines for lines ready to be written (which can contain escape sequences).
+// When they don't fit, they are shown a screen at a time, q stops.
+func (v *Vi) showRendered(lines []string) {
+	v.covered = true
+	n := min(len(lines), v.screen.H()-1)
+	for i, line := range lines[:n] {
+		v.writeAt(0, v.screen.H()-1-n+i, "%s", line)
+		v.screen.ClearEndOfLine()
+	}
+	if n < len(lines) {
+		v.Prompt("-- More -- (q to stop)", func(c byte) bool {
+			if c == 'q' || c == 0x1b {
+				v.Update()
+				return true
+			}
+			v.showRendered(lines[n:])
+			return true
+		})
+		return
+	}
+	v.Prompt("Press any key to continue", func(_ byte) bool {
+		v.Update()
+		return true
+	})
 }
 
 func (v *Vi) CmdResult(msg string, args ...any) {
@@ -285,30 +426,47 @@ func (v *Vi) CmdResult(msg string, args ...any) {
 }
 
 func (v *Vi) command(data []byte) bool {
-	cmd := string(data)
+	cmd, mkdirs := cutMkdirs(string(data))
 	cont := true
 	overwrite := true
 	msg := "Error overwriting file"
 	switch {
-	case cmd == "q!":
-		v.ap.WriteAt(0, v.ap.H-1, "Exiting without saving...\r\n")
-		cont = false // Exit the editor
-	case cmd == "q":
-		if v.buf.IsDirty() {
-			v.WriteBottom("Use :wq to save and exit. :q! to exit without saving.")
-		} else {
-			cont = false
-			v.WriteBottom("Exiting...\r\n")
+	case cmd == "q!" || cmd == "q":
+		cont = v.quitWindow(cmd == "q!")
+	case cmd == "wq" || cmd == "wq!" || cmd == "w" || cmd == "w!":
+		quit, force := strings.HasPrefix(cmd, "wq"), strings.HasSuffix(cmd, "!")
+		if mkdirs && !v.createDirs(v.cur.filename) {
+			break
 		}
-	case cmd == "wq":
-		cont = false
-		fallthrough
-	case cmd == "w":
-		if !v.buf.IsDirty() {
+		if !v.buf.IsDirty() && !v.buf.IsNew() {
 			v.WriteBottom("No changes to save.")
+			if quit {
+				cont = v.quitWindow(false)
+			}
 		} else {
-			cont = v.Save()
+			cont = v.Save(quit, force)
 		}
+	case isLineNumber(cmd):
+		n, _ := strconv.Atoi(cmd)
+		v.gotoLine(n)
+		v.cmdMode = NavMode
+		v.Update()
+	case cmd == "checktime":
+		if !v.CheckTime() {
+			v.CmdResult("File unchanged on disk.")
+		}
+	case cmd == "e!":
+		v.Reload()
+	case cmd == "rec" || cmd == "recover":
+		v.RecoverSwap()
+	case cmd == "set" || strings.HasPrefix(cmd, "set ") || strings.HasPrefix(cmd, "se "):
+		_, args, _ := strings.Cut(cmd, " ")
+		res, err := v.Set(args)
+		if err != nil {
+			v.ShowError("Error", err)
+			break
+		}
+		v.CmdResult("%s", res)
 	case cmd == "tabs":
 		// v.UpdateTabs() // done on resize already.
 		v.CmdResult("Tabs: %v", v.tabs)
@@ -318,39 +476,82 @@ func (v *Vi) command(data []byte) bool {
 		fallthrough
 	case strings.HasPrefix(cmd, "w! "):
 		fname := cmd[strings.IndexByte(cmd, ' ')+1:] // Get the filename after "w " or "w! "
+		if mkdirs && !v.createDirs(fname) {
+			break
+		}
 		err := v.buf.OpenNewFile(fname, overwrite)
 		if err != nil {
 			v.ShowError(msg, err)
 			break
 		}
-		v.filename = fname // Update the filename in the editor
-		_ = v.Save()
+		v.cur.filename = fname // Update the filename in the editor
+		v.cur.noSwap = false
+		v.startSwap()
+		_ = v.Save(false, true)
 	default:
-		v.WriteBottom("Unknown command: %q (:q to quit)", cmd)
+		if !v.fileCommand(cmd) {
+			v.WriteBottom("Unknown command: %q (:q to quit)", cmd)
+		}
 	}
 	return cont // Exit or Continue processing
 }
 
-func (v *Vi) Save() (cont bool) {
-	err := v.buf.Save() // Save the buffer to the file
-	if err != nil {
-		v.ShowError("Error saving file", err)
-		cont = true // Stay in command mode
-	} else {
-		// TODO: in common with tabs etc... make a function to display result yet switch back to nav mode
-		v.CmdResult("File saved successfully.")
+// createDirs creates the missing parent directories of filename, returns false (and shows
+// the error) if it failed.
+func (v *Vi) createDirs(filename string) bool {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		v.ShowError("Error creating directories", err)
+		return false
 	}
-	return
+	return true
+}
+
+// isLineNumber returns true for the :N (go to line N) commands.
+func isLineNumber(cmd string) bool {
+	return cmd != "" && strings.Trim(cmd, "0123456789") == ""
 }
 
-func (v *Vi) HasEsc() int {
-	// Check if the buffer contains an escape character
-	return bytes.IndexByte(v.inputBuf, '\x1b')
+// Save saves the buffer, after asking for confirmation if the file was changed on disk by
+// another program (unless force is set). Then closes the window if quit is set, returns
+// false if the editor should exit (quit requested in the last window and the file was saved).
+// A read-only buffer is only saved with force, and is no longer read-only after that.
+func (v *Vi) Save(quit, force bool) bool {
+	if v.buf.ReadOnly() {
+		if !force {
+			v.ShowError("Error", errReadOnly)
+			return true
+		}
+		v.buf.SetReadOnly(false)
+	}
+	if !force && v.buf.ChangedOnDisk() {
+		v.Prompt("WARNING: the file changed on disk since it was read! Write anyway (y/n)?", func(c byte) bool {
+			if c == 'y' || c == 'Y' {
+				return v.save(quit)
+			}
+			v.CmdResult("Not saved.")
+			return true
+		})
+		return true
+	}
+	return v.save(quit)
 }
 
-func (v *Vi) hasBackspace() int {
-	// Check if the buffer contains a backspace character
-	return bytes.IndexByte(v.inputBuf, '\x7f')
+func (v *Vi) save(quit bool) bool {
+	err := v.buf.Save() // Save the buffer to the file
+	if err != nil {
+		v.ShowError("Error saving file", err)
+		return true // Stay in command mode
+	}
+	if v.cur.noSwap {
+		v.cur.noSwap = false
+		v.startSwap()
+	}
+	// TODO: in common with tabs etc... make a function to display result yet switch back to nav mode
+	v.CmdResult("File saved successfully.")
+	if quit {
+		return v.quitWindow(false)
+	}
+	return true
 }
 
 func FilterSpecialChars(str string) string {
@@ -378,30 +579,52 @@ func FilterSpecialChars(str string) string {
 	return string(runes)
 }
 
-func (v *Vi) Process() bool {
+// Process handles the input data read from the terminal, returns false when the editor should exit.
+func (v *Vi) Process(data []byte) bool {
 	// Process the input buffer and update the state
 	cont := true
-	if len(v.ap.Data) == 0 {
+	if len(data) == 0 {
 		return cont // No input, continue
 	}
 	if v.splash {
 		v.splash = false // No splash screen after first input
 		v.Update()
 	}
-	v.inputBuf = append(v.inputBuf, v.ap.Data...) // Append new data to buffer
+	if bytes.Contains(data, focusIn) {
+		// Terminal (focus reporting mode) tells us we got focus back: check if the file was changed.
+		data = bytes.ReplaceAll(data, focusIn, nil)
+		if v.prompt == nil {
+			v.CheckTime()
+		}
+	}
+	data = bytes.ReplaceAll(data, focusOut, nil)
+	v.inputBuf = append(v.inputBuf, data...) // Append new data to buffer
 	for len(v.inputBuf) > 0 {
+		n, mode := len(v.inputBuf), v.cmdMode
 		cont = v.ProcessOne()
-		// command mode does leave currently typed so far input in the inputBuf but other modes
-		// need to consume all input (like a large paste in insert mode)
-		if !cont || v.cmdMode == CommandMode {
+		// command mode does leave currently typed so far input in the inputBuf, until return:
+		// keep going as long as input is consumed (like a large paste or ":cmd\r" in one read).
+		if !cont || len(v.inputBuf) == n && v.cmdMode == mode {
 			break
 		}
 	}
+	if cont {
+		v.refreshWindows()
+	}
+	v.Idle()
+	v.Render()
 	return cont // Continue processing or not if command was 'q'
 }
 
 func (v *Vi) ProcessOne() bool {
 	cont := true
+	if v.prompt != nil {
+		c := v.inputBuf[0]
+		v.inputBuf = v.inputBuf[1:]
+		answer := v.prompt
+		v.prompt = nil
+		return answer(c)
+	}
 	switch v.cmdMode {
 	case NavMode:
 		c := v.inputBuf[0]
@@ -409,67 +632,36 @@ func (v *Vi) ProcessOne() bool {
 		v.navigate(c)
 		v.UpdateStatus()
 	case CommandMode:
-		v.inputBuf = bytes.TrimPrefix(v.inputBuf, []byte{':'}) // Remove extra leading ':', useful after error.
-		hasBackspace := v.hasBackspace()
-		if hasBackspace == 0 {
-			v.cmdMode = NavMode // Switch back to navigation mode if backspace is pressed in command mode
-			v.ap.MoveCursor(v.cx, v.cy)
-			v.inputBuf = nil
-			v.UpdateStatus()
-			return true // Continue processing
-		}
-		if hasBackspace > 0 {
-			// erase character before the backspace and the backspace itself
-			v.inputBuf = append(v.inputBuf[:hasBackspace-1], v.inputBuf[hasBackspace+1:]...)
-		}
-		v.UpdateStatus()
-		hasEsc := v.HasEsc()
-		if hasEsc >= 0 {
-			v.cmdMode = NavMode                // Switch back to navigation mode on escape
-			v.inputBuf = v.inputBuf[hasEsc+1:] // Remove the escape sequence
-			v.ap.MoveCursor(0, v.ap.H-1)       // Move cursor to the command line
-			v.ap.ClearEndOfLine()
-			break
-		}
-		ret := bytes.IndexByte(v.inputBuf, '\r')
-		if ret >= 0 {
-			data := v.inputBuf[:ret]        // Get the command input up to the carriage return
-			v.inputBuf = v.inputBuf[ret+1:] // Remove the command input from
-			cont = v.command(data)
-		}
+		cont = v.cmdLineKey()
 	case InsertMode, AppendMode:
-		// Handle insert mode input (e.g., add to buffer)
-		str := string(v.inputBuf)
-		hasEsc := v.HasEsc()
-		if hasEsc >= 0 {
-			v.cmdMode = NavMode                // Switch back to navigation mode on escape
-			str = str[:hasEsc]                 // Get the string up to the escape character
-			v.inputBuf = v.inputBuf[hasEsc+1:] // Remove the escape sequence
-			if len(v.inputBuf) == 0 {
-				v.UpdateStatus()
-				break // No input left before escape
-			}
-		} else {
-			v.inputBuf = nil
+		// Handle insert mode input (e.g., add to buffer) up to the first escape or carriage return,
+		// what follows is handled by the next calls.
+		end := len(v.inputBuf)
+		if i := bytes.IndexAny(v.inputBuf, "\x1b\r"); i >= 0 {
+			end = i
 		}
-		// split by line (\r)
-		retPos := strings.IndexByte(str, '\r')
-		if retPos >= 0 {
-			v.inputBuf = []byte(str[retPos+1:]) // Keep the rest of the input after the carriage return
-			str = str[:retPos]                  // Remove everything after the first carriage return
+		str := string(v.inputBuf[:end])
+		var stop byte
+		if end < len(v.inputBuf) {
+			stop = v.inputBuf[end]
+			end++
 		}
+		v.inputBuf = v.inputBuf[end:]
 
 		// Insert any text content first
 		if len(str) > 0 {
 			v.Insert(FilterSpecialChars(str))
 		}
 
-		// Handle newline if present
-		if retPos >= 0 {
+		switch stop {
+		case '\r':
 			v.handleNewlineInsertion()
 			// After newline, we're at the beginning of a new line at the end of file
 			// So we can stay in append mode if we were already in it
-		} else {
+		case 0x1b:
+			v.cmdMode = NavMode // Switch back to navigation mode on escape
+			v.UpdateStatus()
+		default:
 			v.UpdateStatus() // Just update status if no newline
 		}
 	}
@@ -483,19 +675,34 @@ func (v *Vi) Insert(str string) {
 	}
 	lineNum := v.BufferLineNumber()
 	var line string
+	var end int // Byte offset of the end of the inserted text.
 	if v.Append() {
 		v.buf.AppendToLine(lineNum, str)
+		end = len(v.buf.GetLine(lineNum))
 	} else {
-		line = v.buf.InsertChars(v, lineNum, v.cx, str) // Insert the string at the current cursor position
+		at := v.lineAtToByte(lineNum, v.cx)
+		line = v.buf.InsertAt(lineNum, at, str) // Insert the string at the current cursor position
+		end = at + len(str)
+	}
+	x0, y0 := v.win.x+v.cx, v.win.y+v.cy
+	v.screen.MoveCursor(x0, y0)
+	v.screen.WriteString(str)
+	// The terminal leaves the cursor on the last column when writing up to or past it.
+	v.cx = min(v.lineCol(lineNum, end), v.screen.W()-1-v.win.x)
+	if v.Debug {
+		v.checkCursor(x0, y0, str)
 	}
-	v.ap.WriteAtStr(v.cx, v.cy, str)
-	v.cx, v.cy, _ = v.ap.ReadCursorPosXY()
 	if line == "" {
 		v.AppendModeOn() // If we inserted at the end of the line, switch to cheaper append mode
-	} else {
-		v.ap.MoveHorizontally(0) // Move cursor to the start of the line
-		v.ap.ClearEndOfLine()
-		v.ap.WriteString(line) // Write the full line.
+	}
+	switch {
+	case v.highlighted(v.buf) && v.buf.syntaxChanged(lineNum):
+		v.drawWindow(v.win) // The highlighting of the lines below changed too.
+	case line != "" || v.decorated(v.buf):
+		v.drawLine(v.win, v.cy, v.buf.GetLine(lineNum)) // Write the full line.
+	}
+	if v.cx >= v.win.w && v.win.x+v.win.w < v.screen.W() {
+		v.Update() // Wrote over the window on the right.
 	}
 }
 
@@ -506,7 +713,7 @@ func (v *Vi) InsertNewline() {
 	currentLine := v.buf.GetLine(currentLineNum)
 
 	// Convert screen position to rune offset for proper Unicode handling
-	runeOffset := v.ScreenAtToRune(v.cx, currentLine)
+	runeOffset := v.lineAtToByte(currentLineNum, v.cx)
 
 	v.InsertNewlineAtOffset(runeOffset, currentLineNum, currentLine)
 }
@@ -550,7 +757,7 @@ func (v *Vi) handleNewlineInsertion() {
 		runeOffset = len(currentLine)
 	} else {
 		// Only calculate screen position if we're not in append mode
-		runeOffset = v.ScreenAtToRune(v.cx, currentLine)
+		runeOffset = v.lineAtToByte(currentLineNum, v.cx)
 		// Check if we can do a fast update (no full screen redraw needed)
 		canFastUpdate = (runeOffset >= len(currentLine)) // At or past end of line
 	}
@@ -569,11 +776,11 @@ func (v *Vi) handleNewlineInsertion() {
 }
 
 func (v *Vi) ShowError(msg string, err error) {
-	v.ap.WriteAt(0, v.ap.H-1, "%s%s: %v%s", tcolor.Red.Foreground(), msg, err, tcolor.Reset)
+	v.writeAt(0, v.screen.H()-1, "%s%s: %v%s", v.hl("ErrorMsg"), msg, err, tcolor.Reset)
 }
 
 func (v *Vi) Open(filename string) {
-	v.filename = filename
+	v.cur.filename = filename
 	v.splash = false // No splash screen when opening a file
 	v.UpdateStatus()
 	err := v.buf.Open(filename)
@@ -581,6 +788,128 @@ func (v *Vi) Open(filename string) {
 		v.ShowError("Error opening file", err)
 		return
 	}
+	v.restoreCursor()
+	posErr := v.applyStartPosition()
 	v.Update()
-	v.ap.WriteAt(0, v.ap.H-1, "%sOpened file: %s%s", tcolor.Green.Foreground(), filename, tcolor.Reset)
+	info := ""
+	if v.buf.IsNew() {
+		info = " [New File]"
+	}
+	_, dirErr := os.Stat(filepath.Dir(filename))
+	switch {
+	case v.buf.ReadOnly():
+		// No swap file: nothing to recover until changed and saved with :w!
+		info += " [RO]"
+		v.cur.noSwap = true
+	case dirErr != nil:
+		// No swap file until the directory is created by :w ++p.
+		v.cur.noSwap = true
+	case !v.startSwap():
+		return
+	}
+	if posErr != nil {
+		v.ShowError("Error", posErr)
+		return
+	}
+	v.writeAt(0, v.screen.H()-1, "%sOpened file: %s%s%s", v.hl("OkMsg"), filename, info, tcolor.Reset)
+}
+
+// OpenStdin sets the content of the current buffer to data read from stdin (gvi -).
+// The buffer has no file name until written with :w name, and isn't modified.
+func (v *Vi) OpenStdin(data []byte) {
+	v.splash = false
+	if err := v.buf.load(data); err != nil {
+		v.ShowError("Error reading stdin", err)
+		return
+	}
+	v.restoreCursor()
+	posErr := v.applyStartPosition()
+	v.Update()
+	if posErr != nil {
+		v.ShowError("Error", posErr)
+		return
+	}
+	v.writeAt(0, v.screen.H()-1, "%sRead %d lines from stdin%s", v.hl("OkMsg"), v.buf.NumLines(), tcolor.Reset)
+}
+
+// startSwap starts journaling to the swap file of the current file, returns false
+// if a message (warning about an existing swap file or error) was shown.
+func (v *Vi) startSwap() bool {
+	info, err := v.buf.StartSwap(v.cur.filename)
+	if err != nil {
+		v.ShowError("Error creating swap file", err)
+		return false
+	}
+	if info != nil {
+		v.writeAt(0, v.screen.H()-1, "%sWarning: %s - use :recover (or -r) to recover%s",
+			v.hl("WarningMsg"), info, tcolor.Reset)
+		v.keepMessage = true
+		return false
+	}
+	return true
+}
+
+// SetBinary sets binary mode: files are read and written as is, without
+// line ending conversion, BOM handling or fixing of the final newline.
+// Applies to the files opened afterwards too.
+func (v *Vi) SetBinary(on bool) {
+	v.binary = on
+	v.buf.SetBinary(on)
+}
+
+// SetReadOnly sets read-only mode (-R): the files are opened read-only and are only written with :w!.
+// Applies to the files opened afterwards too.
+func (v *Vi) SetReadOnly(on bool) {
+	v.readOnly = on
+	v.buf.SetReadOnly(on)
+}
+
+// SetEncoding sets the encoding used to read (if called before Open) and write the file,
+// and the files opened afterwards.
+func (v *Vi) SetEncoding(name string) error {
+	if err := v.buf.SetEncoding(name); err != nil {
+		return err
+	}
+	v.encoding = name
+	return nil
+}
+
+// RecoverSwap rebuilds the buffer from the journal left in the swap file of the current file.
+func (v *Vi) RecoverSwap() {
+	n, err := v.buf.Recover(v.cur.filename)
+	v.Update()
+	if err != nil {
+		v.ShowError("Error recovering from swap file", err)
+		return
+	}
+	v.CmdResult("%sRecovered %d changes from %s%s", v.hl("OkMsg"), n, SwapName(v.cur.filename), tcolor.Reset)
+}
+
+// Idle is called when there is no input, it flushes the swap files when due.
+func (v *Vi) Idle() {
+	v.flushSwaps(false)
+}
+
+// FlushSwap forces pending changes to the swap files (e.g. before exiting on error, so they can be recovered).
+func (v *Vi) FlushSwap() {
+	v.flushSwaps(true)
+}
+
+// flushSwaps flushes the swap file of every modified buffer, including the hidden ones.
+func (v *Vi) flushSwaps(force bool) {
+	for _, e := range v.bufs {
+		if e.buf == nil || !e.buf.IsDirty() {
+			continue
+		}
+		if err := e.buf.FlushSwap(force); err != nil {
+			log.Errf("Error writing swap file for %s: %v", e.name(), err)
+		}
+	}
+}
+
+// Close is called on clean exit: removes the swap files and closes the buffers.
+func (v *Vi) Close() {
+	for _, e := range v.bufs {
+		v.unload(e)
+	}
 }
@@ -0,0 +1,435 @@
+package vi
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+// vcell is a cell of the VTerm grid: a grapheme and its width, 0 for the right half of a wide one.
+type vcell struct {
+	s     string
+	w     int
+	style string // SGR sequence the cell was written with, empty for the default.
+}
+
+var blankCell = vcell{s: " ", w: 1}
+
+// VTerm is an in-memory terminal implementing Screen, for tests and embedding: a grid of cells
+// with a cursor and tab stops, interpreting the control characters and the escape sequences
+// the editor writes (cursor moves, erase, colors, scroll region). Other sequences are ignored.
+type VTerm struct {
+	w, h     int
+	cells    [][]vcell
+	x, y     int
+	wrapNext bool // Last column written: the next character goes on the next line.
+	savedX   int
+	savedY   int
+	style    string
+	tabStops []bool
+	top      int    // Scroll region first row.
+	bottom   int    // Scroll region end (excluded).
+	dirty    []bool // Rows changed since the last clearDirty.
+	pending  string // Incomplete escape sequence at the end of the last write.
+	bells    int
+}
+
+// NewVTerm returns an empty w x h VTerm with tab stops every 8 columns.
+func NewVTerm(w, h int) *VTerm {
+	t := &VTerm{}
+	t.Resize(w, h)
+	return t
+}
+
+// Resize changes the size of the terminal, keeping the top left content, and resets the tab stops.
+func (t *VTerm) Resize(w, h int) {
+	cells := make([][]vcell, h)
+	for y := range cells {
+		cells[y] = blankLine(w)
+		if y < len(t.cells) {
+			copy(cells[y], t.cells[y])
+			if w < t.w && w > 0 && cells[y][w-1].w == 2 {
+				cells[y][w-1] = blankCell
+			}
+		}
+	}
+	t.w, t.h, t.cells = w, h, cells
+	t.top, t.bottom = 0, h
+	t.dirty = make([]bool, h)
+	t.markDirty(0, h)
+	t.tabStops = make([]bool, w)
+	for x := 8; x < w; x += 8 {
+		t.tabStops[x] = true
+	}
+	t.x, t.y = min(t.x, w-1), min(t.y, h-1)
+	t.wrapNext = false
+}
+
+// markDirty marks the rows from y1 to y2 (excluded) as changed.
+func (t *VTerm) markDirty(y1, y2 int) {
+	for y := y1; y < y2; y++ {
+		t.dirty[y] = true
+	}
+}
+
+// clearDirty marks all the rows as unchanged.
+func (t *VTerm) clearDirty() {
+	clear(t.dirty)
+}
+
+func blankLine(w int) []vcell {
+	line := make([]vcell, w)
+	for x := range line {
+		line[x] = blankCell
+	}
+	return line
+}
+
+func (t *VTerm) W() int { return t.w }
+func (t *VTerm) H() int { return t.h }
+
+func (t *VTerm) MoveCursor(x, y int) {
+	t.x, t.y = max(0, min(x, t.w-1)), max(0, min(y, t.h-1))
+	t.wrapNext = false
+}
+
+func (t *VTerm) ClearEndOfLine() {
+	t.erase(t.y, t.x, t.w)
+}
+
+// ClearScreen clears the screen and moves the cursor to the top left corner.
+func (t *VTerm) ClearScreen() {
+	for y := range t.cells {
+		t.erase(y, 0, t.w)
+	}
+	t.MoveCursor(0, 0)
+}
+
+// StartSyncMode does nothing: the content is always up to date.
+func (t *VTerm) StartSyncMode() {}
+
+// ReadCursorPosXY returns the cursor position, like a terminal does: on the last column when
+// it is past it.
+func (t *VTerm) ReadCursorPosXY() (int, int, error) {
+	return t.x, t.y, nil
+}
+
+// Cursor returns the cursor position.
+func (t *VTerm) Cursor() (x, y int) {
+	return t.x, t.y
+}
+
+// Bells returns the number of bells (\a) written.
+func (t *VTerm) Bells() int {
+	return t.bells
+}
+
+// Line returns the text of the row y, without its trailing spaces.
+func (t *VTerm) Line(y int) string {
+	var sb strings.Builder
+	for _, c := range t.cells[y] {
+		if c.w > 0 {
+			sb.WriteString(c.s)
+		}
+	}
+	return strings.TrimRight(sb.String(), " ")
+}
+
+// String returns the text of the screen, one line per row.
+func (t *VTerm) String() string {
+	var sb strings.Builder
+	for y := range t.cells {
+		sb.WriteString(t.Line(y))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// Style returns the SGR sequence the cell at x, y was written with, empty for the default style.
+func (t *VTerm) Style(x, y int) string {
+	c := t.cells[y][x]
+	if c.w == 0 && x > 0 {
+		c = t.cells[y][x-1]
+	}
+	return c.style
+}
+
+// erase blanks the cells of row y from x1 to x2 (excluded), and the other half of the wide
+// characters cut at either end.
+func (t *VTerm) erase(y, x1, x2 int) {
+	if x1 >= x2 {
+		return
+	}
+	t.dirty[y] = true
+	t.clearWide(y, x1)
+	t.clearWide(y, x2-1)
+	for x := x1; x < x2; x++ {
+		t.cells[y][x] = blankCell
+	}
+}
+
+// clearWide blanks the wide character at x, y if there is one, both halves.
+func (t *VTerm) clearWide(y, x int) {
+	line := t.cells[y]
+	switch {
+	case line[x].w == 0 && x > 0:
+		line[x-1], line[x] = blankCell, blankCell
+	case line[x].w == 2 && x+1 < t.w:
+		line[x], line[x+1] = blankCell, blankCell
+	}
+}
+
+func (t *VTerm) lineFeed() {
+	switch {
+	case t.y == t.bottom-1:
+		t.scroll(1)
+	case t.y < t.h-1:
+		t.y++
+	}
+}
+
+// scroll scrolls the scroll region up n rows, down if n is negative, with blank rows coming in.
+func (t *VTerm) scroll(n int) {
+	rows := t.cells[t.top:t.bottom]
+	n = max(-len(rows), min(n, len(rows)))
+	if n > 0 {
+		copy(rows, rows[n:])
+		for y := len(rows) - n; y < len(rows); y++ {
+			rows[y] = blankLine(t.w)
+		}
+	} else {
+		copy(rows[-n:], rows)
+		for y := range -n {
+			rows[y] = blankLine(t.w)
+		}
+	}
+	t.markDirty(t.top, t.bottom)
+}
+
+// put writes the grapheme g of width w at the cursor position.
+func (t *VTerm) put(g string, w int) {
+	if w == 0 {
+		// Zero width (combining characters written on their own...): joins the previous cell.
+		x := t.x
+		if !t.wrapNext && x > 0 {
+			x--
+		}
+		if t.cells[t.y][x].w == 0 && x > 0 {
+			x--
+		}
+		t.cells[t.y][x].s += g
+		t.dirty[t.y] = true
+		return
+	}
+	w = min(w, 2)
+	if t.wrapNext || t.x+w > t.w {
+		if t.x+w > t.w && !t.wrapNext {
+			t.erase(t.y, t.x, t.w)
+		}
+		t.x, t.wrapNext = 0, false
+		t.lineFeed()
+	}
+	if w > t.w {
+		return
+	}
+	t.erase(t.y, t.x, t.x+w)
+	t.cells[t.y][t.x] = vcell{s: g, w: w, style: t.style}
+	if w == 2 {
+		t.cells[t.y][t.x+1] = vcell{w: 0, style: t.style}
+	}
+	t.x += w
+	if t.x >= t.w {
+		t.x, t.wrapNext = t.w-1, true
+	}
+}
+
+// WriteString writes s at the cursor position, interpreting the control characters and escape sequences.
+func (t *VTerm) WriteString(s string) {
+	if t.w <= 0 || t.h <= 0 {
+		return
+	}
+	s = t.pending + s
+	t.pending = ""
+	for len(s) > 0 {
+		switch c := s[0]; {
+		case c == 0x1b:
+			n := t.escape(s)
+			if n == 0 {
+				t.pending = s
+				return
+			}
+			s = s[n:]
+			continue
+		case c == '\r':
+			t.x, t.wrapNext = 0, false
+		case c == '\n':
+			t.lineFeed()
+		case c == '\t':
+			t.x = t.nextTabStop(t.x)
+			t.wrapNext = false
+		case c == '\b':
+			if t.x > 0 && !t.wrapNext {
+				t.x--
+			}
+			t.wrapNext = false
+		case c == '\a':
+			t.bells++
+		case c < 0x20 || c == 0x7f:
+		default:
+			g, rest, w, _ := uniseg.FirstGraphemeClusterInString(s, -1)
+			t.put(g, w)
+			s = rest
+			continue
+		}
+		s = s[1:]
+	}
+}
+
+// nextTabStop returns the column of the next tab stop after x, the last column if there is none.
+func (t *VTerm) nextTabStop(x int) int {
+	for x++; x < t.w-1; x++ {
+		if t.tabStops[x] {
+			return x
+		}
+	}
+	return t.w - 1
+}
+
+// escape handles the escape sequence at the start of s and returns its length, 0 if it is incomplete.
+func (t *VTerm) escape(s string) int {
+	if len(s) < 2 {
+		return 0
+	}
+	switch s[1] {
+	case '[':
+		return t.csi(s)
+	case ']': // Operating system command (title...), until BEL or ST.
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+			if s[i] == 0x1b && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return 0
+	case '7':
+		t.savedX, t.savedY = t.x, t.y
+	case '8':
+		t.MoveCursor(t.savedX, t.savedY)
+	case 'H':
+		t.tabStops[t.x] = true
+	case 'c':
+		t.style = ""
+		t.ClearScreen()
+		t.Resize(t.w, t.h)
+	}
+	return 2
+}
+
+// csi handles the control sequence (ESC [ params final) at the start of s and returns its length,
+// 0 if it is incomplete.
+func (t *VTerm) csi(s string) int {
+	i := 2
+	for i < len(s) && s[i] >= 0x20 && s[i] < 0x40 {
+		i++
+	}
+	if i >= len(s) {
+		return 0
+	}
+	params, final := s[2:i], s[i]
+	if params != "" && strings.ContainsAny(params[:1], "?<=>") {
+		return i + 1 // Private modes (sync mode, focus reporting...) don't change the content.
+	}
+	args := strings.Split(params, ";")
+	arg := func(n, def int) int {
+		if n >= len(args) {
+			return def
+		}
+		v, err := strconv.Atoi(args[n])
+		if err != nil || v == 0 {
+			return def
+		}
+		return v
+	}
+	switch final {
+	case 'H', 'f':
+		t.MoveCursor(arg(1, 1)-1, arg(0, 1)-1)
+	case 'G':
+		t.MoveCursor(arg(0, 1)-1, t.y)
+	case 'A':
+		t.MoveCursor(t.x, t.y-arg(0, 1))
+	case 'B':
+		t.MoveCursor(t.x, t.y+arg(0, 1))
+	case 'C':
+		t.MoveCursor(t.x+arg(0, 1), t.y)
+	case 'D':
+		t.MoveCursor(t.x-arg(0, 1), t.y)
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			t.erase(t.y, t.x, t.w)
+			for y := t.y + 1; y < t.h; y++ {
+				t.erase(y, 0, t.w)
+			}
+		case 1:
+			for y := range t.y {
+				t.erase(y, 0, t.w)
+			}
+			t.erase(t.y, 0, t.x+1)
+		case 2, 3:
+			for y := range t.cells {
+				t.erase(y, 0, t.w)
+			}
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			t.erase(t.y, t.x, t.w)
+		case 1:
+			t.erase(t.y, 0, t.x+1)
+		case 2:
+			t.erase(t.y, 0, t.w)
+		}
+	case 'r':
+		top, bottom := arg(0, 1), arg(1, t.h)
+		if top < bottom && bottom <= t.h {
+			t.top, t.bottom = top-1, bottom
+			t.MoveCursor(0, 0)
+		}
+	case 'S':
+		t.scroll(arg(0, 1))
+	case 'T':
+		t.scroll(-arg(0, 1))
+	case 'g':
+		switch arg(0, 0) {
+		case 0:
+			t.tabStops[t.x] = false
+		case 3:
+			clear(t.tabStops)
+		}
+	case 'm':
+		t.sgr(args)
+	}
+	return i + 1
+}
+
+// sgr updates the current style: 0 (or nothing) resets it, other attributes are added to it.
+func (t *VTerm) sgr(args []string) {
+	var attrs []string
+	if t.style != "" {
+		attrs = strings.Split(t.style[2:len(t.style)-1], ";")
+	}
+	for _, a := range args {
+		if a == "" || a == "0" {
+			attrs = attrs[:0]
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	t.style = ""
+	if len(attrs) > 0 {
+		t.style = "\x1b[" + strings.Join(attrs, ";") + "m"
+	}
+}
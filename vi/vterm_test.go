@@ -0,0 +1,95 @@
+package vi
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestVTerm(t *testing.T) {
+	term := NewVTerm(10, 3)
+	term.WriteString("ab\tc\x1b[31md\x1b[0m\r\n日本語abcde")
+	if l := term.Line(0); l != "ab      cd" {
+		t.Errorf("line 0 = %q", l)
+	}
+	if s := term.Style(9, 0); s != "\x1b[31m" {
+		t.Errorf("style of d = %q", s)
+	}
+	if s := term.Style(8, 0); s != "" {
+		t.Errorf("style of c = %q", s)
+	}
+	// The wide characters take 2 cells, abcde wraps after a.
+	if l := term.Line(1); l != "日本語abcd" {
+		t.Errorf("line 1 = %q", l)
+	}
+	if x, y := term.Cursor(); x != 1 || y != 2 || term.Line(2) != "e" {
+		t.Errorf("cursor at %d,%d, line 2 %q", x, y, term.Line(2))
+	}
+	// Overwriting half of a wide character clears the other half.
+	term.MoveCursor(3, 1)
+	term.WriteString("x")
+	if l := term.Line(1); l != "日 x語abcd" {
+		t.Errorf("line 1 after overwrite = %q", l)
+	}
+	term.MoveCursor(4, 1)
+	term.ClearEndOfLine()
+	if l := term.Line(1); l != "日 x" {
+		t.Errorf("line 1 after clear = %q", l)
+	}
+	// Writing a wide character on the last column wraps it, at the bottom the screen scrolls.
+	term.WriteString("\x1b[3;10H日\a")
+	if s := term.String(); s != "日 x\ne\n日\n" || term.Bells() != 1 {
+		t.Errorf("screen after scroll %q, %d bells", s, term.Bells())
+	}
+	// Escape sequences split across writes.
+	term.WriteString("\x1b[")
+	term.WriteString("1;1H>")
+	if l := term.Line(0); l != ">  x" {
+		t.Errorf("line 0 after split sequence = %q", l)
+	}
+	term.ClearScreen()
+	if s := term.String(); s != "\n\n\n" {
+		t.Errorf("screen after clear %q", s)
+	}
+}
+
+func TestVTermTabStops(t *testing.T) {
+	term := NewVTerm(20, 2)
+	v := &Vi{screen: term}
+	v.UpdateTabs()
+	tabs, err := v.readTabs()
+	if err != nil || !slices.Equal(tabs, v.tabs) || len(tabs) != 2 || tabs[0] != 8 || tabs[1] != 16 {
+		t.Errorf("terminal tabs %v (%v), computed %v, expected [8 16]", tabs, err, v.tabs)
+	}
+	term.WriteString("\r\x1b[3g\t")
+	if x, _ := term.Cursor(); x != 19 {
+		t.Errorf("tab without stops went to %d, expected 19", x)
+	}
+}
+
+func TestViOnVTerm(t *testing.T) {
+	term := NewVTerm(40, 10)
+	v := NewVi(term)
+	_ = v.UpdateRS()
+	if !strings.Contains(term.String(), "Welcome to gvi") {
+		t.Errorf("no splash screen:\n%s", term.String())
+	}
+	for _, keys := range []string{"i", "hello", "\x1b"} {
+		if !v.Process([]byte(keys)) {
+			t.Fatalf("Process(%q) returned false", keys)
+		}
+	}
+	if l := term.Line(0); l != "hello" {
+		t.Errorf("line 0 = %q, expected hello", l)
+	}
+	if strings.Contains(term.String(), "Welcome to gvi") {
+		t.Errorf("splash screen still shown:\n%s", term.String())
+	}
+	if x, y := term.Cursor(); x != 5 || y != 0 {
+		t.Errorf("cursor at %d,%d, expected 5,0", x, y)
+	}
+	v.Process([]byte(":"))
+	if v.Process([]byte("q!\r")) {
+		t.Errorf("Process returned true after :q!")
+	}
+}
@@ -0,0 +1,630 @@
+package vi
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"fortio.org/terminal/ansipixels/tcolor"
+	"github.com/rivo/uniseg"
+)
+
+// window is a view onto a buffer: a region of the screen with its own cursor and scroll
+// offset, and a status line below its text. The cursor and offset of the current window
+// are the Vi fields (cx, cy, offset), saved here when switching to another window.
+type window struct {
+	e          *bufEntry
+	cx, cy     int
+	offset     int
+	x, y, w, h int // Position and size of the text on screen, the status line is below it.
+	drawn      int // Version of the buffer last drawn.
+}
+
+// layout is a node of the window layout tree: either a window (leaf) or children
+// stacked (:split) or side by side (:vsplit, separated by a vertical line).
+type layout struct {
+	win      *window
+	parent   *layout
+	children []*layout
+	vertical bool // Children side by side.
+	size     int  // Rows (including the status line) or columns taken in the parent.
+}
+
+const (
+	minWinHeight = 2 // One line of text and the status line.
+	minWinWidth  = 1
+)
+
+var errNoRoom = errors.New("not enough room")
+
+// windows appends the windows of the layout to res, in order (top to bottom, left to right).
+func (n *layout) windows(res []*window) []*window {
+	if n.win != nil {
+		return append(res, n.win)
+	}
+	for _, c := range n.children {
+		res = c.windows(res)
+	}
+	return res
+}
+
+func (n *layout) find(w *window) *layout {
+	if n.win == w {
+		return n
+	}
+	for _, c := range n.children {
+		if f := c.find(w); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func (n *layout) index() int {
+	return slices.Index(n.parent.children, n)
+}
+
+// minSize is the minimum number of columns (vertical) or rows the layout can take.
+func (n *layout) minSize(vertical bool) int {
+	if n.win != nil {
+		if vertical {
+			return minWinWidth
+		}
+		return minWinHeight
+	}
+	res := 0
+	for _, c := range n.children {
+		m := c.minSize(vertical)
+		if n.vertical == vertical {
+			res += m
+		} else {
+			res = max(res, m)
+		}
+	}
+	if n.vertical && vertical {
+		res += len(n.children) - 1 // Separators.
+	}
+	return res
+}
+
+// distribute sets the children sizes to fill avail, keeping their proportions.
+func distribute(children []*layout, avail, minSize int) {
+	total := 0
+	for _, c := range children {
+		total += c.size
+	}
+	if total == avail {
+		return
+	}
+	left := avail
+	for i, c := range children {
+		if i == len(children)-1 {
+			c.size = left
+			break
+		}
+		c.size = max(minSize, c.size*avail/max(1, total))
+		left -= c.size
+	}
+}
+
+// arrange sets the position and size of the windows to fill the given area.
+func (n *layout) arrange(x, y, w, h int) {
+	if n.win != nil {
+		n.win.x, n.win.y, n.win.w, n.win.h = x, y, w, max(1, h-1)
+		return
+	}
+	if n.vertical {
+		distribute(n.children, w-len(n.children)+1, minWinWidth)
+		for _, c := range n.children {
+			c.arrange(x, y, c.size, h)
+			x += c.size + 1
+		}
+		return
+	}
+	distribute(n.children, h, minWinHeight)
+	for _, c := range n.children {
+		c.arrange(x, y, w, c.size)
+		y += c.size
+	}
+}
+
+// equalize makes all the windows the same size.
+func (n *layout) equalize() {
+	for _, c := range n.children {
+		c.size = 1
+		c.equalize()
+	}
+}
+
+// windows returns the windows of the current tab page.
+func (v *Vi) windows() []*window {
+	if v.tab == nil {
+		return nil
+	}
+	return v.tab.layout.windows(nil)
+}
+
+// shown returns the number of windows, in all the tab pages, showing e, not counting except.
+func (v *Vi) shown(e *bufEntry, except *window) int {
+	n := 0
+	for _, w := range v.allWindows() {
+		if w.e == e && w != except {
+			n++
+		}
+	}
+	return n
+}
+
+// arrange lays out the windows on the screen, after a resize or a change of the layout.
+func (v *Vi) arrange() {
+	v.saveWindow()
+	top := v.tabLineHeight()
+	v.tab.layout.arrange(0, top, v.screen.W(), v.screen.H()-1-top)
+	for _, w := range v.windows() {
+		if w.cy >= w.h {
+			w.offset += w.cy - w.h + 1
+			w.cy = w.h - 1
+		}
+	}
+	v.cy, v.offset = v.win.cy, v.win.offset
+	v.usableHeight = v.win.h
+}
+
+// saveWindow saves the cursor and scroll offset of the current window.
+func (v *Vi) saveWindow() {
+	v.win.cx, v.win.cy, v.win.offset = v.cx, v.cy, v.offset
+}
+
+// enterWindow makes w the current window.
+func (v *Vi) enterWindow(w *window) {
+	v.saveWindow()
+	v.win, v.cur, v.buf = w, w.e, w.e.buf
+	v.cx, v.cy, v.offset = w.cx, w.cy, w.offset
+	v.usableHeight = w.h
+	// The buffer may have been shortened in another window.
+	if last := max(0, v.buf.NumLines()-1); v.BufferLineNumber() > last {
+		v.offset, v.cy = v.calculateCenteredPosition(last, v.buf.NumLines())
+	}
+}
+
+// Split splits the current window in two, the new window (above or on the left) shows
+// the same buffer and becomes the current one.
+func (v *Vi) Split(vertical bool) bool {
+	v.saveWindow()
+	old := v.win
+	leaf := v.tab.layout.find(old)
+	avail, minSize := old.h+1, minWinHeight
+	if vertical {
+		avail, minSize = old.w-1, minWinWidth // 1 column for the separator.
+	}
+	newSize := avail / 2
+	if newSize < minSize || avail-newSize < minSize {
+		v.ShowError("Error", errNoRoom)
+		return false
+	}
+	nw := &window{e: old.e, cx: old.cx, cy: old.cy, offset: old.offset}
+	nl := &layout{win: nw, size: newSize}
+	p := leaf.parent
+	if p != nil && p.vertical == vertical {
+		nl.parent = p
+		p.children = slices.Insert(p.children, leaf.index(), nl)
+	} else {
+		node := &layout{parent: p, vertical: vertical, size: leaf.size}
+		if p == nil {
+			v.tab.layout = node
+		} else {
+			p.children[leaf.index()] = node
+		}
+		leaf.parent, nl.parent = node, node
+		node.children = []*layout{nl, leaf}
+	}
+	leaf.size = avail - newSize
+	v.arrange()
+	v.enterWindow(nw)
+	v.cmdMode = NavMode
+	v.Update()
+	return true
+}
+
+// removeWindow removes w from the tab page's layout and returns the window that takes its space.
+func (t *tabPage) removeWindow(w *window) *window {
+	leaf := t.layout.find(w)
+	p := leaf.parent
+	i := leaf.index()
+	nb := p.children[max(0, i-1)]
+	if i == 0 {
+		nb = p.children[1]
+	}
+	nb.size += leaf.size
+	if p.vertical {
+		nb.size++ // The separator.
+	}
+	p.children = slices.Delete(p.children, i, i+1)
+	if len(p.children) == 1 {
+		c := p.children[0]
+		c.size, c.parent = p.size, p.parent
+		if p.parent == nil {
+			t.layout = c
+		} else {
+			p.parent.children[p.index()] = c
+		}
+	}
+	return nb.windows(nil)[0]
+}
+
+// CloseWindow closes w (:close, :q when there is more than one window), or the tab page if
+// it's its last window. Its buffer becomes hidden if it has unsaved changes (which requires
+// force or the hidden option) or is unloaded.
+func (v *Vi) CloseWindow(w *window, force bool) {
+	if v.tab.layout.win != nil {
+		if len(v.tabPages) > 1 {
+			v.CloseTab(v.tab, force)
+			return
+		}
+		v.ShowError("Error", errors.New("cannot close last window"))
+		return
+	}
+	e := w.e
+	if e.buf.IsDirty() && !force && !v.hidden && v.shown(e, w) == 0 {
+		v.ShowError("Error", errNoWrite)
+		return
+	}
+	next := v.tab.removeWindow(w)
+	if w == v.win {
+		v.win = next // Not entering with enterWindow: nothing to save from the closed window.
+		v.cx, v.cy, v.offset = next.cx, next.cy, next.offset
+		v.cur, v.buf = next.e, next.e.buf
+	}
+	v.release(e)
+	v.arrange()
+	v.cmdMode = NavMode
+	v.Update()
+}
+
+// Only closes all the windows but the current one (:only, Ctrl-W o).
+func (v *Vi) Only(force bool) {
+	for _, w := range v.windows() {
+		if w.e != v.cur && w.e.buf.IsDirty() && !force && !v.hidden {
+			v.ShowError("Error", fmt.Errorf("no write since last change for buffer %d (add ! to override)", w.e.num))
+			return
+		}
+	}
+	others := v.windows()
+	v.tab.layout = &layout{win: v.win}
+	for _, w := range others {
+		v.release(w.e)
+	}
+	v.arrange()
+	v.cmdMode = NavMode
+	v.Update()
+}
+
+// release unloads e if it's no longer shown in any window and has no unsaved changes
+// (otherwise it stays loaded, hidden).
+func (v *Vi) release(e *bufEntry) {
+	switch {
+	case e.buf == nil || v.shown(e, nil) > 0 || e.buf.IsDirty():
+	case e.filename == "" && e.buf.NumLines() == 0:
+		v.wipe(e)
+	case e.filename == "":
+		// Keep it loaded, there is no file to read it back from (e.g. read from stdin).
+	default:
+		v.unload(e)
+	}
+}
+
+// ResizeWindow changes the height (or width if vertical) of the current window by delta,
+// taking the space from (or giving it to) the next or previous window.
+func (v *Vi) ResizeWindow(vertical bool, delta int) {
+	n := v.tab.layout.find(v.win)
+	for n.parent != nil && n.parent.vertical != vertical {
+		n = n.parent
+	}
+	if n.parent == nil {
+		v.Beep() // Nothing in that direction.
+		return
+	}
+	sib := n.parent.children[max(0, n.index()-1)]
+	if n.index() < len(n.parent.children)-1 {
+		sib = n.parent.children[n.index()+1]
+	}
+	delta = max(delta, n.minSize(vertical)-n.size)
+	delta = min(delta, sib.size-sib.minSize(vertical))
+	n.size += delta
+	sib.size -= delta
+	v.arrange()
+	v.Update()
+}
+
+// Equalize makes all the windows (almost) the same size (Ctrl-W =).
+func (v *Vi) Equalize() {
+	v.tab.layout.equalize()
+	v.arrange()
+	v.Update()
+}
+
+// gotoDirection goes to the window left, below, above or right of the current one (Ctrl-W h, j, k, l).
+func (v *Vi) gotoDirection(dir byte) {
+	w := v.win
+	x, y := w.x+min(v.cx, w.w-1), w.y+v.cy
+	switch dir {
+	case 'h':
+		x = w.x - 2 // Skip the separator.
+	case 'j':
+		y = w.y + w.h + 1 // Skip the status line.
+	case 'k':
+		y = w.y - 1
+	case 'l':
+		x = w.x + w.w + 1
+	}
+	for _, o := range v.windows() {
+		if x >= o.x && x < o.x+o.w && y >= o.y && y <= o.y+o.h {
+			v.enterWindow(o)
+			v.Update()
+			return
+		}
+	}
+	v.Beep()
+}
+
+// gotoWindow goes to the next (delta 1) or previous (-1) window, or window number count if not 0.
+func (v *Vi) gotoWindow(delta, count int) {
+	wins := v.windows()
+	i := slices.Index(wins, v.win)
+	if count > 0 {
+		i = min(count, len(wins)) - 1
+	} else {
+		i = (i + delta + len(wins)) % len(wins)
+	}
+	if wins[i] != v.win {
+		v.enterWindow(wins[i])
+		v.Update()
+	}
+}
+
+// windowCommand handles the key after Ctrl-W.
+func (v *Vi) windowCommand(c byte, count int) {
+	switch c {
+	case 'h', 'j', 'k', 'l':
+		v.gotoDirection(c)
+	case 8, 10, 11, 12: // Ctrl-H, Ctrl-J, Ctrl-K, Ctrl-L
+		v.gotoDirection(c + 'h' - 8)
+	case 'w', 0x17:
+		v.gotoWindow(1, count)
+	case 'W':
+		v.gotoWindow(-1, count)
+	case 'c':
+		v.CloseWindow(v.win, false)
+	case 'q':
+		v.quitWindow(false)
+	case 'o':
+		v.Only(false)
+	case 's', 'S', 0x13:
+		v.Split(false)
+	case 'v', 0x16:
+		v.Split(true)
+	case '=':
+		v.Equalize()
+	case '+', '-', '<', '>':
+		delta := max(1, count)
+		if c == '-' || c == '<' {
+			delta = -delta
+		}
+		v.ResizeWindow(c == '<' || c == '>', delta)
+	case 0x1b:
+	default:
+		v.Beep()
+	}
+}
+
+// windowExCommand handles the window ex commands, returns false if name isn't one of them.
+func (v *Vi) windowExCommand(name string, force bool, arg string) bool {
+	switch name {
+	case "sp", "split", "new", "vs", "vsplit", "vne", "vnew":
+		vertical := name[0] == 'v'
+		if !v.Split(vertical) {
+			break
+		}
+		switch {
+		case strings.HasSuffix(name, "new"):
+			e := v.newBufEntry("")
+			e.buf = v.newBuffer("")
+			v.win.e, v.cur, v.buf = e, e, e.buf
+			v.cx, v.cy, v.offset = 0, 0, 0
+			v.Update()
+		case arg != "":
+			v.EditCommand(arg, force)
+		}
+	case "clo", "close":
+		v.CloseWindow(v.win, force)
+	case "on", "only":
+		v.Only(force)
+	default:
+		return false
+	}
+	return true
+}
+
+// quitWindow implements :q: closes the current window (or tab page), or exits (returns false)
+// if it's the last one and there are no unsaved changes (or force).
+func (v *Vi) quitWindow(force bool) bool {
+	if v.tab.layout.win == nil || len(v.tabPages) > 1 {
+		v.CloseWindow(v.win, force)
+		return true
+	}
+	switch {
+	case force:
+		v.writeAt(0, v.screen.H()-1, "Exiting without saving...\r\n")
+		return false
+	case v.buf.IsDirty():
+		v.WriteBottom("Use :wq to save and exit. :q! to exit without saving.")
+	default:
+		if e := v.dirtyBuffer(); e != nil {
+			v.WriteBottom("No write since last change for buffer %d (:b %d to go to it, :q! to exit without saving).", e.num, e.num)
+			break
+		}
+		v.WriteBottom("Exiting...\r\n")
+		return false
+	}
+	return true
+}
+
+// drawWindow draws the text and status line of w.
+func (v *Vi) drawWindow(w *window) {
+	if w == v.win {
+		v.saveWindow()
+	}
+	b := w.e.buf
+	lines := b.GetLines(w.offset, w.h)
+	for i := range w.h {
+		line := ""
+		if i < len(lines) {
+			line = lines[i]
+		}
+		v.drawLine(w, i, line)
+	}
+	w.drawn = b.version
+	v.drawStatus(w)
+}
+
+// drawLine draws line at row y of w.
+func (v *Vi) drawLine(w *window, y int, line string) {
+	offset := w.offset
+	if w == v.win {
+		offset = v.offset
+	}
+	s := v.highlightString(w.e.buf, offset+y, line, w.w)
+	v.screen.MoveCursor(w.x, w.y+y)
+	v.screen.WriteString(s)
+	n := w.w - ansiWidth(s)
+	switch {
+	case n <= 0:
+		// Full: clearing would erase the last column, the cursor stays on it.
+	case w.x+w.w >= v.screen.W():
+		v.screen.ClearEndOfLine()
+	default:
+		v.screen.WriteString(strings.Repeat(" ", n))
+	}
+}
+
+// clearEOL clears from the terminal cursor, at column cx of the current window, to the end of the window's line.
+func (v *Vi) clearEOL(cx int) {
+	if v.win.x+v.win.w >= v.screen.W() {
+		v.screen.ClearEndOfLine()
+	} else if n := v.win.w - cx; n > 0 {
+		v.screen.WriteString(strings.Repeat(" ", n))
+	}
+}
+
+// moveCursor puts the terminal cursor at the editing position in the current window.
+func (v *Vi) moveCursor() {
+	v.screen.MoveCursor(v.win.x+min(v.cx, v.win.w-1), v.win.y+v.cy)
+}
+
+// drawSeparators draws the vertical lines between side by side windows.
+func (v *Vi) drawSeparators(n *layout) {
+	if n.vertical {
+		for _, c := range n.children[:len(n.children)-1] {
+			wins := c.windows(nil)
+			first, last := wins[0], wins[len(wins)-1]
+			x := first.x + c.size
+			for y := first.y; y <= last.y+last.h; y++ {
+				v.screen.MoveCursor(x, y)
+				v.screen.WriteString("│")
+			}
+		}
+	}
+	for _, c := range n.children {
+		v.drawSeparators(c)
+	}
+}
+
+// drawStatus draws the status line of w, the current window's has more details.
+func (v *Vi) drawStatus(w *window) {
+	b := w.e.buf
+	style := v.hl("StatusLineNC")
+	if w == v.win {
+		style = v.hl("StatusLine")
+	}
+	dirty := ""
+	if b.IsDirty() {
+		dirty = v.hlText(style, "Modified", "*")
+	}
+	filename := w.e.filename
+	if filename == "" {
+		filename = "..."
+	}
+	if b.ReadOnly() {
+		filename += " [RO]"
+	}
+	if b.IsNew() {
+		filename += " [New]"
+	}
+	v.screen.MoveCursor(w.x, w.y+w.h)
+	if v.statusItems != nil {
+		v.screen.WriteString(v.evalStatusLine(w, style) + tcolor.Reset)
+		return
+	}
+	var status string
+	if w == v.win {
+		debugInfo := ""
+		if v.Debug {
+			debugInfo = fmt.Sprintf(" F:%d SW:%d SA:%d LC:%d/%d", v.fullRefresh, v.screenWidthCnt, v.screenAtCnt,
+				v.lineCacheHits, v.lineCacheHits+v.lineCacheMisses) // Line layouts found cached / needed.
+			if r := v.renderer; r != nil {
+				debugInfo += fmt.Sprintf(" R:%d B:%d", r.frames, r.bytes) // Frames sent, bytes of the last one.
+			}
+		}
+		status = fmt.Sprintf(" %sFile: %s (%d/%d lines) [%s] - %s - @%d,%d [%dx%d]%s ",
+			dirty, filename, v.cy+1+v.offset, b.NumLines(), b.FormatInfo(),
+			v.hlText(style, v.cmdMode.group(), v.cmdMode.String()), v.cx+1, v.cy+1, v.screen.W(), v.screen.H(), debugInfo)
+	} else {
+		status = fmt.Sprintf(" %sFile: %s (%d/%d lines) [%s] ", dirty, filename, w.cy+1+w.offset, b.NumLines(), b.FormatInfo())
+	}
+	v.screen.WriteString(style + fitWidth(status, w.w) + tcolor.Reset)
+}
+
+// fitWidth clips or pads s, which can contain ANSI escape sequences, to width screen columns.
+func fitWidth(s string, width int) string {
+	var sb strings.Builder
+	used := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\x1b' {
+			// Copy escape sequences (ESC [ params final) as is.
+			j := i + 2
+			for j < len(s) && (s[j] < 0x40 || s[j] > 0x7e) {
+				j++
+			}
+			j = min(j+1, len(s))
+			sb.WriteString(s[i:j])
+			i = j
+			continue
+		}
+		cluster, _, w, _ := uniseg.FirstGraphemeClusterInString(s[i:], -1)
+		if used+w > width {
+			break
+		}
+		sb.WriteString(cluster)
+		used += w
+		i += len(cluster)
+	}
+	if used < width {
+		sb.WriteString(strings.Repeat(" ", width-used))
+	}
+	return sb.String()
+}
+
+// refreshWindows redraws the other windows showing the current buffer after it changed.
+func (v *Vi) refreshWindows() {
+	redrawn := false
+	for _, w := range v.windows() {
+		if w != v.win && w.drawn != w.e.buf.version {
+			v.drawWindow(w)
+			redrawn = true
+		}
+	}
+	if redrawn {
+		v.moveCursor()
+	}
+}
@@ -0,0 +1,72 @@
+package vi
+
+import "testing"
+
+func TestLayoutArrange(t *testing.T) {
+	// Left: a above b, right: c. On an 80x24 screen (23 rows above the command line).
+	a, b, c := &window{}, &window{}, &window{}
+	left := &layout{size: 40}
+	left.children = []*layout{{win: a, parent: left, size: 10}, {win: b, parent: left, size: 13}}
+	root := &layout{vertical: true, children: []*layout{left, {win: c, size: 39}}}
+	left.parent, root.children[1].parent = root, root
+	root.arrange(0, 0, 80, 23)
+	tests := []struct {
+		win        *window
+		x, y, w, h int
+	}{
+		{a, 0, 0, 40, 9},
+		{b, 0, 10, 40, 12},
+		{c, 41, 0, 39, 22},
+	}
+	for i, test := range tests {
+		w := test.win
+		if w.x != test.x || w.y != test.y || w.w != test.w || w.h != test.h {
+			t.Errorf("window %d at %d,%d %dx%d, expected %d,%d %dx%d",
+				i, w.x, w.y, w.w, w.h, test.x, test.y, test.w, test.h)
+		}
+	}
+	// Resize keeps the proportions.
+	root.arrange(0, 0, 40, 46)
+	if a.w != 19 || c.w != 20 || a.h != 19 || b.h != 25 {
+		t.Errorf("after resize a is %dx%d, b is %dx%d, c is %dx%d", a.w, a.h, b.w, b.h, c.w, c.h)
+	}
+	if m := root.minSize(true); m != 3 {
+		t.Errorf("minSize(vertical) = %d, expected 3", m)
+	}
+	if m := root.minSize(false); m != 2*minWinHeight {
+		t.Errorf("minSize = %d, expected %d", m, 2*minWinHeight)
+	}
+	root.equalize()
+	root.arrange(0, 0, 81, 24)
+	if a.w != 40 || c.w != 40 || a.h != 11 || b.h != 11 {
+		t.Errorf("after equalize a is %dx%d, b is %dx%d, c is %dx%d", a.w, a.h, b.w, b.h, c.w, c.h)
+	}
+	tab := &tabPage{layout: root}
+	if next := tab.removeWindow(a); next != b {
+		t.Errorf("removing a should give its space to b, got %v", next)
+	}
+	if left := root.children[0]; left.win != b || left.size != 40 || left.parent != root {
+		t.Errorf("b should replace the left column: %+v", left)
+	}
+	if next := tab.removeWindow(c); next != b || tab.layout.win != b {
+		t.Errorf("removing c should leave b alone, got %v, %+v", next, tab.layout)
+	}
+}
+
+func TestFitWidth(t *testing.T) {
+	tests := []struct {
+		s        string
+		width    int
+		expected string
+	}{
+		{"abc", 5, "abc  "},
+		{"abcdef", 3, "abc"},
+		{"\x1b[1mab\x1b[0mcd", 3, "\x1b[1mab\x1b[0mc"},
+		{"日本", 3, "日 "},
+	}
+	for _, test := range tests {
+		if s := fitWidth(test.s, test.width); s != test.expected {
+			t.Errorf("fitWidth(%q, %d) = %q, expected %q", test.s, test.width, s, test.expected)
+		}
+	}
+}